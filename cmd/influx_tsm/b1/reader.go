@@ -0,0 +1,477 @@
+package b1
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/tsdb"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// DefaultChunkSize is the size of chunks read from the b1 shard
+const DefaultChunkSize int = 1000
+
+// excludedBuckets are the top-level buckets which do not hold series data.
+var excludedBuckets = map[string]bool{
+	"fields": true,
+	"meta":   true,
+	"series": true,
+	"wal":    true,
+}
+
+// Reader is used to read all data from a b1 shard.
+type Reader struct {
+	path string
+	db   *bolt.DB
+	tx   *bolt.Tx
+	iter *Iterator
+
+	series map[string][]string   // series keys, by measurement
+	wal    map[string][]walEntry // unflushed WAL entries, by series
+
+	fields     map[string]*tsdb.MeasurementFields
+	fieldNames map[string][]string // sorted field names, by measurement
+	codecs     map[string]*tsdb.FieldCodec
+
+	// ChunkSize is the maximum number of values returned by a single Read.
+	ChunkSize int
+}
+
+// NewReader returns a reader for the b1 shard at path.
+func NewReader(path string) *Reader {
+	return &Reader{
+		path:       path,
+		series:     make(map[string][]string),
+		fields:     make(map[string]*tsdb.MeasurementFields),
+		fieldNames: make(map[string][]string),
+		codecs:     make(map[string]*tsdb.FieldCodec),
+
+		ChunkSize: DefaultChunkSize,
+	}
+}
+
+// Open opens the reader.
+func (r *Reader) Open() error {
+	// Open underlying storage.
+	db, err := bolt.Open(r.path, 0666, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	r.db = db
+
+	// Load fields.
+	if err := r.db.View(func(tx *bolt.Tx) error { return readFields(tx, r.fields) }); err != nil {
+		return err
+	}
+	for k, mf := range r.fields {
+		r.codecs[k] = tsdb.NewFieldCodec(mf.Fields)
+		for _, f := range mf.Fields {
+			r.fieldNames[k] = append(r.fieldNames[k], f.Name)
+		}
+		sort.Strings(r.fieldNames[k])
+	}
+
+	r.tx, err = r.db.Begin(false)
+	if err != nil {
+		return err
+	}
+
+	// Points which were never flushed from the WAL are still in the shard.
+	r.wal = r.indexWAL()
+
+	// Find all series in this shard, whether flushed or not.
+	seriesSet := make(map[string]bool)
+	r.tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if key := string(name); !excludedBuckets[key] {
+			seriesSet[key] = true
+		}
+		return nil
+	})
+	for key := range r.wal {
+		seriesSet[key] = true
+	}
+
+	// Group series by measurement, ignoring those without fields.
+	for s := range seriesSet {
+		measurement := tsdb.MeasurementFromSeriesKey(s)
+		if r.fields[measurement] == nil {
+			continue
+		}
+		r.series[measurement] = append(r.series[measurement], s)
+	}
+
+	r.iter = r.newIterator(r.tx, r.Measurements())
+
+	return nil
+}
+
+// readFields reads the fields of each measurement in the shard into fields.
+func readFields(tx *bolt.Tx, fields map[string]*tsdb.MeasurementFields) error {
+	meta := tx.Bucket([]byte("fields"))
+	if meta == nil {
+		return nil
+	}
+
+	c := meta.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		mf := &tsdb.MeasurementFields{}
+		if err := mf.UnmarshalBinary(v); err != nil {
+			return err
+		}
+		fields[string(k)] = mf
+	}
+	return nil
+}
+
+// FieldTypes returns the type of each field of each measurement in the
+// shard. Only the shard's field index is read, so the reader need not be
+// open.
+func (r *Reader) FieldTypes() (map[string]map[string]influxql.DataType, error) {
+	db, err := bolt.Open(r.path, 0666, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	fields := make(map[string]*tsdb.MeasurementFields)
+	if err := db.View(func(tx *bolt.Tx) error { return readFields(tx, fields) }); err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]map[string]influxql.DataType, len(fields))
+	for measurement, mf := range fields {
+		types[measurement] = make(map[string]influxql.DataType, len(mf.Fields))
+		for name, f := range mf.Fields {
+			types[measurement][name] = f.Type
+		}
+	}
+	return types, nil
+}
+
+// Measurements returns the sorted names of the measurements in the shard.
+func (r *Reader) Measurements() []string {
+	a := make([]string, 0, len(r.series))
+	for name := range r.series {
+		a = append(a, name)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// KeyN returns the number of keys in the shard, one for each field of each
+// series. Keys without any values are not read.
+func (r *Reader) KeyN() int {
+	var n int
+	for measurement, series := range r.series {
+		n += len(series) * len(r.fields[measurement].Fields)
+	}
+	return n
+}
+
+// MeasurementIterator returns an iterator over the data of a single measurement.
+// Each iterator reads within its own transaction, so iterators may be used
+// concurrently. Iterators must be closed before the reader is closed.
+func (r *Reader) MeasurementIterator(name string) (*Iterator, error) {
+	tx, err := r.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+
+	itr := r.newIterator(tx, []string{name})
+	itr.owned = true
+	return itr, nil
+}
+
+// newIterator returns an iterator over every field of every series of the
+// given measurements, read within tx.
+func (r *Reader) newIterator(tx *bolt.Tx, measurements []string) *Iterator {
+	itr := &Iterator{r: r, tx: tx, wal: tx.Bucket([]byte("wal"))}
+	for _, measurement := range measurements {
+		itr.series = append(itr.series, r.series[measurement]...)
+	}
+	sort.Sort(seriesKeys(itr.series))
+	return itr
+}
+
+// walEntry locates a point still in the WAL, so that its data is only read
+// once the iterator reaches its series.
+type walEntry struct {
+	timestamp int64
+	partition byte
+	seq       uint64
+}
+
+// indexWAL returns the sorted, deduplicated locations of the WAL entries of
+// the shard, keyed by series. The data of the entries is not read.
+func (r *Reader) indexWAL() map[string][]walEntry {
+	index := make(map[string][]walEntry)
+
+	wal := r.tx.Bucket([]byte("wal"))
+	if wal == nil {
+		return index
+	}
+
+	wal.ForEach(func(k, _ []byte) error {
+		b := wal.Bucket(k)
+		if b == nil || len(k) != 1 {
+			return nil
+		}
+
+		return b.ForEach(func(seq, v []byte) error {
+			key, timestamp, _ := unmarshalWALEntry(v)
+			index[string(key)] = append(index[string(key)], walEntry{timestamp: timestamp, partition: k[0], seq: btou64(seq)})
+			return nil
+		})
+	})
+
+	for k, a := range index {
+		index[k] = dedupeWALEntries(a)
+	}
+	return index
+}
+
+// dedupeWALEntries sorts the entries by timestamp, keeping only the last
+// written of those with the same timestamp.
+func dedupeWALEntries(a []walEntry) []walEntry {
+	sort.Stable(walEntries(a))
+	other := a[:0]
+	for i, e := range a {
+		if i+1 < len(a) && a[i+1].timestamp == e.timestamp {
+			continue
+		}
+		other = append(other, e)
+	}
+	return other
+}
+
+// walEntries sorts WAL entries by timestamp.
+type walEntries []walEntry
+
+func (a walEntries) Len() int           { return len(a) }
+func (a walEntries) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a walEntries) Less(i, j int) bool { return a[i].timestamp < a[j].timestamp }
+
+// Next returns whether any data remains to be read. It must be called before
+// the next call to Read().
+func (r *Reader) Next() bool { return r.iter.Next() }
+
+// Read returns the next chunk of data in the shard, converted to tsm1 values. Data is
+// emitted completely for every field, in every series, before the next field is processed.
+// Data from Read() is only valid between calls to Next().
+func (r *Reader) Read() (string, []tsm1.Value, error) { return r.iter.Read() }
+
+// Close closes the reader.
+func (r *Reader) Close() error {
+	if r.tx != nil {
+		r.tx.Rollback()
+	}
+	if r.db != nil {
+		return r.db.Close()
+	}
+	return nil
+}
+
+// Iterator reads the data of a set of measurements in a b1 shard. A cursor
+// is only opened for each key once the previous key has been read.
+type Iterator struct {
+	r     *Reader
+	tx    *bolt.Tx     // transaction read within
+	owned bool         // whether tx is rolled back by Close
+	wal   *bolt.Bucket // WAL bucket of tx
+
+	series []string // series keys, sorted by key
+	field  int      // index of the next field of series[0] to read
+	cursor *cursor
+
+	keyBuf    string
+	valuesBuf []tsm1.Value
+}
+
+// Next returns whether any data remains to be read. It must be called before
+// the next call to Read().
+func (itr *Iterator) Next() bool {
+	for itr.cursor != nil || itr.nextCursor() {
+		c := itr.cursor
+
+		itr.keyBuf = tsm1.SeriesFieldKey(c.series, c.field)
+		itr.valuesBuf = make([]tsm1.Value, 0, itr.r.ChunkSize)
+		for len(itr.valuesBuf) < itr.r.ChunkSize {
+			k, v := c.Next()
+			if k == tsdb.EOF {
+				itr.cursor = nil
+				break
+			}
+			itr.valuesBuf = append(itr.valuesBuf, tsm1.NewValue(time.Unix(0, k), v))
+		}
+
+		if len(itr.valuesBuf) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nextCursor opens the cursor of the next key, returning false once every
+// key has been read.
+func (itr *Iterator) nextCursor() bool {
+	for len(itr.series) > 0 {
+		s := itr.series[0]
+		measurement := tsdb.MeasurementFromSeriesKey(s)
+		if names := itr.r.fieldNames[measurement]; itr.field < len(names) {
+			var bc *bolt.Cursor
+			if b := itr.tx.Bucket([]byte(s)); b != nil {
+				bc = b.Cursor()
+			}
+			itr.cursor = newCursor(bc, s, names[itr.field], itr.r.codecs[measurement], itr.wal, itr.r.wal[s])
+			itr.field++
+			return true
+		}
+		itr.series, itr.field = itr.series[1:], 0
+	}
+	return false
+}
+
+// Read returns the next chunk of data, converted to tsm1 values.
+// Data from Read() is only valid between calls to Next().
+func (itr *Iterator) Read() (string, []tsm1.Value, error) {
+	return itr.keyBuf, itr.valuesBuf, nil
+}
+
+// Close releases the iterator's transaction.
+func (itr *Iterator) Close() error {
+	if itr.owned {
+		return itr.tx.Rollback()
+	}
+	return nil
+}
+
+// cursor provides ordered iteration across a single field of a series,
+// merging flushed points with those still in the WAL.
+type cursor struct {
+	// Bolt cursor and readahead buffer.
+	cursor *bolt.Cursor
+	buf    struct {
+		key, value []byte
+	}
+
+	// Unflushed WAL entries, their bucket, and current index.
+	wal     *bolt.Bucket
+	entries []walEntry
+	index   int
+	walKey  []byte
+
+	// Previously read key.
+	prev []byte
+
+	started bool
+
+	series string
+	field  string
+	dec    *tsdb.FieldCodec
+}
+
+// newCursor returns an instance of a cursor over a single field of a series.
+func newCursor(c *bolt.Cursor, series, field string, dec *tsdb.FieldCodec, wal *bolt.Bucket, entries []walEntry) *cursor {
+	return &cursor{
+		cursor:  c,
+		wal:     wal,
+		entries: entries,
+		walKey:  make([]byte, 8),
+		series:  series,
+		field:   field,
+		dec:     dec,
+	}
+}
+
+// Next returns the next timestamp and value for the field, skipping points
+// which don't carry the field. It returns tsdb.EOF once the field is exhausted.
+func (c *cursor) Next() (int64, interface{}) {
+	for {
+		k, v := c.read()
+		if k == nil {
+			return tsdb.EOF, nil
+		}
+
+		value, err := c.dec.DecodeByName(c.field, v)
+		if err != nil {
+			continue
+		}
+		return int64(btou64(k)), value
+	}
+}
+
+// read returns the next key/value from the bolt bucket or WAL, whichever is lower.
+// Keys present in both are read from the WAL only.
+func (c *cursor) read() (key, value []byte) {
+	for {
+		// Read next value from the bolt cursor.
+		if c.buf.key == nil && c.cursor != nil {
+			if !c.started {
+				c.buf.key, c.buf.value = c.cursor.First()
+				c.started = true
+			} else {
+				c.buf.key, c.buf.value = c.cursor.Next()
+			}
+		}
+
+		if c.buf.key != nil && (c.index >= len(c.entries) || int64(btou64(c.buf.key)) < c.entries[c.index].timestamp) {
+			key, value = c.buf.key, c.buf.value
+			c.buf.key, c.buf.value = nil, nil
+		} else if c.index < len(c.entries) {
+			key, value = c.readWAL(c.entries[c.index])
+			c.index++
+		} else {
+			return nil, nil
+		}
+
+		// Skip keys which have already been read.
+		if !bytes.Equal(key, c.prev) {
+			c.prev = append(c.prev[:0], key...)
+			return key, value
+		}
+	}
+}
+
+// readWAL returns the key and data of the WAL entry.
+func (c *cursor) readWAL(e walEntry) (key, value []byte) {
+	binary.BigEndian.PutUint64(c.walKey, uint64(e.timestamp))
+	if b := c.wal.Bucket([]byte{e.partition}); b != nil {
+		if v := b.Get(u64tob(e.seq)); v != nil {
+			_, _, value = unmarshalWALEntry(v)
+		}
+	}
+	return c.walKey, value
+}
+
+// seriesKeys sorts series keys by the tsm1 keys of their fields.
+type seriesKeys []string
+
+func (a seriesKeys) Len() int      { return len(a) }
+func (a seriesKeys) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a seriesKeys) Less(i, j int) bool {
+	return tsm1.SeriesFieldKey(a[i], "") < tsm1.SeriesFieldKey(a[j], "")
+}
+
+// unmarshalWALEntry decodes a WAL entry into it's separate parts.
+// Returned byte slices point to the original slice.
+func unmarshalWALEntry(v []byte) (key []byte, timestamp int64, data []byte) {
+	keyLen := binary.BigEndian.Uint32(v[8:12])
+	key = v[12 : 12+keyLen]
+	timestamp = int64(binary.BigEndian.Uint64(v[0:8]))
+	data = v[12+keyLen:]
+	return
+}
+
+// u64tob converts a uint64 into an 8-byte slice.
+func u64tob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// btou64 converts an 8-byte slice to a uint64.
+func btou64(b []byte) uint64 { return binary.BigEndian.Uint64(b) }
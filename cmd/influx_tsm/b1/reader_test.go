@@ -0,0 +1,235 @@
+package b1_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/b1"
+	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/models"
+	"github.com/influxdb/influxdb/tsdb"
+	eb1 "github.com/influxdb/influxdb/tsdb/engine/b1"
+)
+
+// Ensure the reader returns flushed and unflushed points, per field, in key order.
+func TestReader_Read(t *testing.T) {
+	path := MustCreateShard(t,
+		[]string{
+			"cpu,host=a value=1,status=\"ok\" 1",
+			"cpu,host=a value=2 2",
+			"cpu,host=b value=3 1",
+		},
+		[]string{
+			"cpu,host=a value=20 2",
+			"cpu,host=a value=4,status=\"bad\" 4",
+		},
+	)
+	defer os.Remove(path)
+
+	r := b1.NewReader(path)
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	type kv struct {
+		Key    string
+		Times  []int64
+		Values []interface{}
+	}
+
+	var got []kv
+	for r.Next() {
+		k, values, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := kv{Key: k}
+		for _, v := range values {
+			e.Times = append(e.Times, v.UnixNano())
+			e.Values = append(e.Values, v.Value())
+		}
+		got = append(got, e)
+	}
+
+	exp := []kv{
+		{Key: "cpu,host=a#!~#status", Times: []int64{1e9, 4e9}, Values: []interface{}{"ok", "bad"}},
+		{Key: "cpu,host=a#!~#value", Times: []int64{1e9, 2e9, 4e9}, Values: []interface{}{1.0, 20.0, 4.0}},
+		{Key: "cpu,host=b#!~#value", Times: []int64{1e9}, Values: []interface{}{3.0}},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected data:\n\ngot=%+v\n\nexp=%+v", got, exp)
+	}
+}
+
+// Ensure the reader iterates over a single measurement independently.
+func TestReader_MeasurementIterator(t *testing.T) {
+	path := MustCreateShard(t,
+		[]string{"cpu value=1 1", "mem value=2 1"},
+		[]string{"mem value=3 2"},
+	)
+	defer os.Remove(path)
+
+	r := b1.NewReader(path)
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if names := r.Measurements(); !reflect.DeepEqual(names, []string{"cpu", "mem"}) {
+		t.Fatalf("unexpected measurements: %v", names)
+	}
+	if n := r.KeyN(); n != 4 {
+		t.Fatalf("unexpected key count: %d", n)
+	}
+
+	itr, err := r.MeasurementIterator("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer itr.Close()
+
+	if !itr.Next() {
+		t.Fatal("expected data")
+	} else if k, values, err := itr.Read(); err != nil {
+		t.Fatal(err)
+	} else if k != "mem#!~#value" || len(values) != 2 || values[1].Value() != 3.0 {
+		t.Fatalf("unexpected data: %s %v", k, values)
+	} else if itr.Next() {
+		t.Fatal("expected end of data")
+	}
+}
+
+// Ensure the reader splits a field's values into chunks.
+func TestReader_Read_Chunked(t *testing.T) {
+	path := MustCreateShard(t,
+		[]string{"cpu value=1 1", "cpu value=2 2", "cpu value=3 3"},
+		nil,
+	)
+	defer os.Remove(path)
+
+	r := b1.NewReader(path)
+	r.ChunkSize = 2
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var sizes []int
+	for r.Next() {
+		_, values, _ := r.Read()
+		sizes = append(sizes, len(values))
+	}
+	if !reflect.DeepEqual(sizes, []int{2, 1}) {
+		t.Fatalf("unexpected chunk sizes: %v", sizes)
+	}
+}
+
+// Ensure the points of a WAL larger than the memory allowed are read without
+// holding the WAL in memory, when the reader is opened or read.
+func TestReader_Read_LargeWAL(t *testing.T) {
+	const budget = 1 << 20
+	status := strings.Repeat("x", 40<<10)
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("cpu,host=%d status=%q %d", i%8, status, i+1))
+	}
+	path := MustCreateShard(t, nil, lines)
+	defer os.Remove(path)
+
+	base := heapAlloc()
+	r := b1.NewReader(path)
+	r.ChunkSize = 1
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if n := heapAlloc() - base; n > budget {
+		t.Fatalf("opening the reader holds %d bytes", n)
+	}
+
+	var n int
+	for r.Next() {
+		_, values, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		} else if values[0].Value() != status {
+			t.Fatalf("unexpected value: %v", values[0].Value())
+		}
+		n++
+		if n%20 == 0 {
+			if m := heapAlloc() - base; m > budget {
+				t.Fatalf("reading holds %d bytes after %d values", m, n)
+			}
+		}
+	}
+	if n != len(lines) {
+		t.Fatalf("unexpected value count: %d", n)
+	}
+}
+
+// heapAlloc returns the bytes of live heap objects, after a garbage collection.
+func heapAlloc() int64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapAlloc)
+}
+
+// MustCreateShard returns the path to a new b1 shard. The flushed points are
+// written and flushed to the series buckets; the unflushed points are left in the WAL.
+func MustCreateShard(t *testing.T, flushed, unflushed []string) string {
+	f, err := ioutil.TempFile("", "influx_tsm-b1-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	e := eb1.NewEngine(f.Name(), "", tsdb.NewEngineOptions()).(*eb1.Engine)
+	if err := e.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	mf := &tsdb.MeasurementFields{Fields: make(map[string]*tsdb.Field)}
+	mf.CreateFieldIfNotExists("value", influxql.Float, false)
+	mf.CreateFieldIfNotExists("status", influxql.String, false)
+	fields := make(map[string]*tsdb.MeasurementFields)
+
+	write := func(lines []string) {
+		for _, line := range lines {
+			points, err := models.ParsePointsWithPrecision([]byte(line), time.Now().UTC(), "s")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := mf.Codec.EncodeFields(points[0].Fields())
+			if err != nil {
+				t.Fatal(err)
+			}
+			points[0].SetData(data)
+			fields[points[0].Name()] = mf
+
+			series := []*tsdb.SeriesCreate{{Series: tsdb.NewSeries(string(points[0].Key()), nil)}}
+			if err := e.WritePoints(points, fields, series); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	write(flushed)
+	if err := e.Flush(0); err != nil {
+		t.Fatal(err)
+	}
+	write(unflushed)
+
+	return f.Name()
+}
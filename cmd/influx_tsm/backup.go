@@ -0,0 +1,90 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// backupArchiveExt is the extension of compressed backups, following backupExt.
+const backupArchiveExt = "tar.gz"
+
+// archiveDatabase backs up the database at src to dest, as a gzipped tar
+// archive, adding the archive to the manifest m. Files are archived below
+// the name of the database, so that extracting the archive in the data
+// directory restores the database.
+func archiveDatabase(src, dest string, m *BackupManifest) error {
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return fmt.Errorf("backup of %v already exists at %v", src, dest)
+	} else if err != nil {
+		return err
+	}
+
+	w := m.Writer(filepath.Base(dest))
+	if err := writeArchive(io.MultiWriter(f, w), src); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// writeArchive writes the directory at src to w as a gzipped tar archive.
+func writeArchive(w io.Writer, src string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	base := filepath.Base(src)
+	if err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(base, rel))
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, limiter.Reader(in))
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
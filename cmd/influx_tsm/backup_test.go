@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Ensure a database is archived below its name.
+func TestArchiveDatabase(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	MustWriteFile(filepath.Join(dir, "db0", "default", "1"), "data")
+	dest := filepath.Join(dir, "db0.bak.tar.gz")
+	m := NewBackupManifest(defaultChunkSize, 1)
+	if err := archiveDatabase(filepath.Join(dir, "db0"), dest, m); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(b)
+	}
+
+	exp := map[string]string{"db0/": "", "db0/default/": "", "db0/default/1": "data"}
+	if !reflect.DeepEqual(files, exp) {
+		t.Fatalf("unexpected archive: %v", files)
+	}
+
+	if len(m.Files) != 1 || m.Files[0].Path != "db0.bak.tar.gz" {
+		t.Fatalf("unexpected manifest files: %+v", m.Files)
+	}
+
+	// An existing backup is not overwritten.
+	if err := archiveDatabase(filepath.Join(dir, "db0"), dest, m); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure a database is backed up by hard links, which are in the manifest.
+func TestLinkDatabase(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "db0", "default", "1")
+	MustWriteFile(src, "data")
+	dest := filepath.Join(dir, "db0.bak")
+	m := NewBackupManifest(defaultChunkSize, 1)
+	if err := linkDatabase(filepath.Join(dir, "db0"), dest, m); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bfi, err := os.Stat(filepath.Join(dest, "default", "1"))
+	if err != nil {
+		t.Fatal(err)
+	} else if !os.SameFile(fi, bfi) {
+		t.Fatal("backup is not a link to the shard")
+	}
+
+	if len(m.Files) != 1 || m.Files[0].Path != "db0.bak/default/1" || m.Files[0].SHA256 != sha256Hex("data") {
+		t.Fatalf("unexpected manifest files: %+v", m.Files)
+	} else if errs := m.Verify(dir, 1); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// An existing backup is not overwritten.
+	if err := linkDatabase(filepath.Join(dir, "db0"), dest, m); err == nil {
+		t.Fatal("expected error")
+	}
+}
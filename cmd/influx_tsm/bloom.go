@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/influxdb/influxdb/models"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// bloomFile is the name of the bloom filter sidecar within a converted shard.
+// tsm1 ignores anything in a shard other than TSM files.
+const bloomFile = "series.bloom"
+
+// bloomFalsePositiveRate is the false positive rate bloom filters are sized for.
+const bloomFalsePositiveRate = 0.01
+
+// bloomMagic identifies a bloom filter file.
+const bloomMagic = "TSMBLM01"
+
+// ErrBloomFilterInvalid is returned when a bloom filter file can't be decoded.
+var ErrBloomFilterInvalid = errors.New("invalid bloom filter")
+
+// BloomFilter is a set of keys which may report false positives, but never
+// false negatives.
+type BloomFilter struct {
+	mu   sync.Mutex
+	k    uint32 // hash functions
+	bits []byte
+}
+
+// NewBloomFilter returns a filter sized for n keys at false positive rate p.
+func NewBloomFilter(n int, p float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := uint32(math.Ceil(m / float64(n) * math.Ln2))
+
+	// Very small filters are padded, as their bits are poorly spread.
+	sz := (uint64(m) + 7) / 8
+	if sz < 64 {
+		sz = 64
+	}
+	return &BloomFilter{k: k, bits: make([]byte, sz)}
+}
+
+// Add adds key to the filter.
+func (f *BloomFilter) Add(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, i := range f.locations(key) {
+		f.bits[i/8] |= 1 << (i % 8)
+	}
+}
+
+// Contains returns whether key may have been added to the filter.
+func (f *BloomFilter) Contains(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, i := range f.locations(key) {
+		if f.bits[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// locations returns the bits of key, by double hashing.
+func (f *BloomFilter) locations(key string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+
+	h = fnv.New64()
+	h.Write([]byte(key))
+	h2 := h.Sum64() | 1
+
+	m := uint64(len(f.bits)) * 8
+	a := make([]uint64, f.k)
+	for i := range a {
+		a[i] = (h1 + uint64(i)*h2) % m
+	}
+	return a
+}
+
+// MarshalBinary encodes the filter as its magic, the number of hash
+// functions, and its bits.
+func (f *BloomFilter) MarshalBinary() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b := make([]byte, len(bloomMagic)+4, len(bloomMagic)+4+len(f.bits))
+	copy(b, bloomMagic)
+	binary.BigEndian.PutUint32(b[len(bloomMagic):], f.k)
+	return append(b, f.bits...), nil
+}
+
+// UnmarshalBinary decodes a filter encoded by MarshalBinary.
+func (f *BloomFilter) UnmarshalBinary(b []byte) error {
+	if len(b) <= len(bloomMagic)+4 || string(b[:len(bloomMagic)]) != bloomMagic {
+		return ErrBloomFilterInvalid
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.k = binary.BigEndian.Uint32(b[len(bloomMagic):])
+	f.bits = append([]byte(nil), b[len(bloomMagic)+4:]...)
+	if f.k == 0 {
+		return ErrBloomFilterInvalid
+	}
+	return nil
+}
+
+// Iterator returns a KeyIterator adding the series read from itr to the filter.
+func (f *BloomFilter) Iterator(itr KeyIterator) KeyIterator {
+	return &bloomIterator{KeyIterator: itr, filter: f}
+}
+
+// bloomIterator is a KeyIterator adding the series read through it to a filter.
+type bloomIterator struct {
+	KeyIterator
+	filter *BloomFilter
+	prev   string
+}
+
+func (itr *bloomIterator) Read() (string, []tsm1.Value, error) {
+	k, v, err := itr.KeyIterator.Read()
+	if err == nil {
+		series := k
+		if i := strings.Index(k, keyFieldSeparator); i != -1 {
+			series = k[:i]
+		}
+
+		// Keys are read in order, so each series is usually read repeatedly.
+		if series != itr.prev {
+			itr.filter.Add(series)
+			itr.prev = series
+		}
+	}
+	return k, v, err
+}
+
+const lookupUsage = `Usage: influx_tsm lookup <data-path> <series-key> [series-key...]
+
+List the shards which may contain each series, such as 'cpu,host=server01',
+using the bloom filters written alongside shards converted with -bloom.
+Shards converted without -bloom are not searched, and a bloom filter only
+describes a shard as it was converted.`
+
+func runLookup(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf(lookupUsage)
+	}
+	dataPath := args[0]
+
+	// Series are matched in the canonical form of their key, with sorted tags.
+	var keys []string
+	for _, s := range args[1:] {
+		key, err := canonicalSeriesKey(s)
+		if err != nil {
+			return fmt.Errorf("bad series key %q: %v", s, err)
+		}
+		keys = append(keys, key)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dataPath, "*", "*", "*", bloomFile))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(w, "Series\tDatabase\tRetention\tShard")
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		f := &BloomFilter{}
+		if err := f.UnmarshalBinary(b); err != nil {
+			return fmt.Errorf("read %v: %v", path, err)
+		}
+
+		shard := filepath.Dir(path)
+		rp := filepath.Dir(shard)
+		db := filepath.Dir(rp)
+		for _, key := range keys {
+			if f.Contains(key) {
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", key, filepath.Base(db), filepath.Base(rp), filepath.Base(shard))
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// canonicalSeriesKey returns the series key s as stored in shards, with its
+// tags sorted. It is parsed as a point, since keys are normalized as points are.
+func canonicalSeriesKey(s string) (string, error) {
+	points, err := models.ParsePointsString(s + " value=1")
+	if err != nil {
+		return "", err
+	} else if len(points) != 1 {
+		return "", fmt.Errorf("expected a single series")
+	}
+	return string(points[0].Key()), nil
+}
+
+// writeBloomFilter writes the filter, if not nil, to the shard directory at
+// path within sink.
+func writeBloomFilter(f *BloomFilter, path string, sink Sink) error {
+	if f == nil {
+		return nil
+	}
+
+	b, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	w, err := sink.Create(filepath.Join(path, bloomFile))
+	if err != nil {
+		return fmt.Errorf("create bloom filter: %v", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return fmt.Errorf("write bloom filter: %v", err)
+	}
+	return w.Close()
+}
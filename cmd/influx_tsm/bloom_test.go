@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Ensure a bloom filter contains every key added, after being encoded.
+func TestBloomFilter_Contains(t *testing.T) {
+	f := NewBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add(fmt.Sprintf("cpu,host=server%d", i))
+	}
+
+	b, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &BloomFilter{}
+	if err := other.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if key := fmt.Sprintf("cpu,host=server%d", i); !other.Contains(key) {
+			t.Fatalf("expected filter to contain %s", key)
+		}
+	}
+
+	// Allow for variation around the expected false positive rate.
+	var n int
+	for i := 0; i < 10000; i++ {
+		if other.Contains(fmt.Sprintf("mem,host=server%d", i)) {
+			n++
+		}
+	}
+	if n > 300 {
+		t.Fatalf("unexpected false positives: %d", n)
+	}
+
+	if err := other.UnmarshalBinary([]byte("junk")); err != ErrBloomFilterInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,374 @@
+package bz1
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/snappy"
+	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/tsdb"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// DefaultChunkSize is the size of chunks read from the bz1 shard
+const DefaultChunkSize int = 1000
+
+// Reader is used to read all data from a bz1 shard.
+type Reader struct {
+	path string
+	db   *bolt.DB
+	tx   *bolt.Tx
+	iter *Iterator
+
+	series map[string][]string // series keys, by measurement
+
+	fields     map[string]*tsdb.MeasurementFields
+	fieldNames map[string][]string // sorted field names, by measurement
+	codecs     map[string]*tsdb.FieldCodec
+
+	// ChunkSize is the maximum number of values returned by a single Read.
+	ChunkSize int
+}
+
+// NewReader returns a reader for the bz1 shard at path.
+func NewReader(path string) *Reader {
+	return &Reader{
+		path:       path,
+		series:     make(map[string][]string),
+		fields:     make(map[string]*tsdb.MeasurementFields),
+		fieldNames: make(map[string][]string),
+		codecs:     make(map[string]*tsdb.FieldCodec),
+
+		ChunkSize: DefaultChunkSize,
+	}
+}
+
+// Open opens the reader.
+func (r *Reader) Open() error {
+	// Open underlying storage.
+	db, err := bolt.Open(r.path, 0666, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	r.db = db
+
+	// Load fields.
+	if err := r.db.View(func(tx *bolt.Tx) error { return readFields(tx, &r.fields) }); err != nil {
+		return err
+	}
+
+	for k, mf := range r.fields {
+		r.codecs[k] = tsdb.NewFieldCodec(mf.Fields)
+		for _, f := range mf.Fields {
+			r.fieldNames[k] = append(r.fieldNames[k], f.Name)
+		}
+		sort.Strings(r.fieldNames[k])
+	}
+
+	r.tx, err = r.db.Begin(false)
+	if err != nil {
+		return err
+	}
+
+	// Group series by measurement, ignoring those without fields.
+	if points := r.tx.Bucket([]byte("points")); points != nil {
+		if err := points.ForEach(func(k, _ []byte) error {
+			if points.Bucket(k) == nil {
+				return nil
+			}
+
+			series := string(k)
+			measurement := tsdb.MeasurementFromSeriesKey(series)
+			if r.fields[measurement] == nil {
+				return nil
+			}
+			r.series[measurement] = append(r.series[measurement], series)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	r.iter = r.newIterator(r.tx, r.Measurements())
+
+	return nil
+}
+
+// readFields reads the fields of each measurement in the shard into fields.
+func readFields(tx *bolt.Tx, fields *map[string]*tsdb.MeasurementFields) error {
+	meta := tx.Bucket([]byte("meta"))
+	if meta == nil {
+		return nil
+	}
+
+	buf := meta.Get([]byte("fields"))
+	if buf == nil {
+		return nil
+	}
+
+	data, err := snappy.Decode(nil, buf)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, fields)
+}
+
+// FieldTypes returns the type of each field of each measurement in the
+// shard. Only the shard's field index is read, so the reader need not be
+// open.
+func (r *Reader) FieldTypes() (map[string]map[string]influxql.DataType, error) {
+	db, err := bolt.Open(r.path, 0666, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	fields := make(map[string]*tsdb.MeasurementFields)
+	if err := db.View(func(tx *bolt.Tx) error { return readFields(tx, &fields) }); err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]map[string]influxql.DataType, len(fields))
+	for measurement, mf := range fields {
+		types[measurement] = make(map[string]influxql.DataType, len(mf.Fields))
+		for name, f := range mf.Fields {
+			types[measurement][name] = f.Type
+		}
+	}
+	return types, nil
+}
+
+// Measurements returns the sorted names of the measurements in the shard.
+func (r *Reader) Measurements() []string {
+	a := make([]string, 0, len(r.series))
+	for name := range r.series {
+		a = append(a, name)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// KeyN returns the number of keys in the shard, one for each field of each
+// series. Keys without any values are not read.
+func (r *Reader) KeyN() int {
+	var n int
+	for measurement, series := range r.series {
+		n += len(series) * len(r.fields[measurement].Fields)
+	}
+	return n
+}
+
+// MeasurementIterator returns an iterator over the data of a single measurement.
+// Each iterator reads within its own transaction, so iterators may be used
+// concurrently. Iterators must be closed before the reader is closed.
+func (r *Reader) MeasurementIterator(name string) (*Iterator, error) {
+	tx, err := r.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+
+	itr := r.newIterator(tx, []string{name})
+	itr.owned = true
+	return itr, nil
+}
+
+// newIterator returns an iterator over every field of every series of the
+// given measurements, read within tx.
+func (r *Reader) newIterator(tx *bolt.Tx, measurements []string) *Iterator {
+	itr := &Iterator{r: r, tx: tx, points: tx.Bucket([]byte("points"))}
+	if itr.points == nil {
+		return itr
+	}
+
+	for _, measurement := range measurements {
+		itr.series = append(itr.series, r.series[measurement]...)
+	}
+	sort.Sort(seriesKeys(itr.series))
+	return itr
+}
+
+// Next returns whether any data remains to be read. It must be called before
+// the next call to Read().
+func (r *Reader) Next() bool { return r.iter.Next() }
+
+// Read returns the next chunk of data in the shard, converted to tsm1 values. Data is
+// emitted completely for every field, in every series, before the next field is processed.
+// Data from Read() is only valid between calls to Next().
+func (r *Reader) Read() (string, []tsm1.Value, error) { return r.iter.Read() }
+
+// Close closes the reader.
+func (r *Reader) Close() error {
+	if r.tx != nil {
+		r.tx.Rollback()
+	}
+	if r.db != nil {
+		return r.db.Close()
+	}
+	return nil
+}
+
+// Iterator reads the data of a set of measurements in a bz1 shard. A cursor
+// is only opened for each key once the previous key has been read.
+type Iterator struct {
+	r      *Reader
+	tx     *bolt.Tx     // transaction read within
+	owned  bool         // whether tx is rolled back by Close
+	points *bolt.Bucket // points bucket of tx
+
+	series []string // series keys, sorted by key
+	field  int      // index of the next field of series[0] to read
+	cursor *cursor
+
+	keyBuf    string
+	valuesBuf []tsm1.Value
+	err       error
+}
+
+// Next returns whether any data remains to be read. It must be called before
+// the next call to Read().
+func (itr *Iterator) Next() bool {
+	for itr.cursor != nil || itr.nextCursor() {
+		c := itr.cursor
+
+		itr.keyBuf = tsm1.SeriesFieldKey(c.series, c.field)
+		itr.valuesBuf = make([]tsm1.Value, 0, itr.r.ChunkSize)
+		for len(itr.valuesBuf) < itr.r.ChunkSize {
+			k, v := c.Next()
+			if k == tsdb.EOF {
+				itr.cursor = nil
+				break
+			}
+			itr.valuesBuf = append(itr.valuesBuf, tsm1.NewValue(time.Unix(0, k), v))
+		}
+
+		// Surface any decoding error through Read().
+		if c.err != nil {
+			itr.err = c.err
+			return true
+		}
+
+		if len(itr.valuesBuf) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nextCursor opens the cursor of the next key, returning false once every
+// key has been read.
+func (itr *Iterator) nextCursor() bool {
+	for len(itr.series) > 0 {
+		s := itr.series[0]
+		measurement := tsdb.MeasurementFromSeriesKey(s)
+		if names := itr.r.fieldNames[measurement]; itr.field < len(names) {
+			b := itr.points.Bucket([]byte(s))
+			itr.cursor = newCursor(b.Cursor(), s, names[itr.field], itr.r.codecs[measurement])
+			itr.field++
+			return true
+		}
+		itr.series, itr.field = itr.series[1:], 0
+	}
+	return false
+}
+
+// Read returns the next chunk of data, converted to tsm1 values.
+// Data from Read() is only valid between calls to Next().
+func (itr *Iterator) Read() (string, []tsm1.Value, error) {
+	if itr.err != nil {
+		return "", nil, itr.err
+	}
+	return itr.keyBuf, itr.valuesBuf, nil
+}
+
+// Close releases the iterator's transaction.
+func (itr *Iterator) Close() error {
+	if itr.owned {
+		return itr.tx.Rollback()
+	}
+	return nil
+}
+
+// cursor provides ordered iteration across a single field of a series.
+type cursor struct {
+	cursor  *bolt.Cursor
+	buf     []byte // uncompressed buffer
+	off     int    // buffer offset
+	started bool
+	err     error
+
+	series string
+	field  string
+	dec    *tsdb.FieldCodec
+}
+
+// newCursor returns an instance of a bz1 cursor.
+func newCursor(c *bolt.Cursor, series, field string, dec *tsdb.FieldCodec) *cursor {
+	return &cursor{
+		cursor: c,
+		series: series,
+		field:  field,
+		dec:    dec,
+	}
+}
+
+// Next returns the next timestamp and value for the field, skipping points
+// which don't carry the field. It returns tsdb.EOF once the field is exhausted
+// or a block could not be decoded.
+func (c *cursor) Next() (int64, interface{}) {
+	for {
+		// Move to the next block once the current one is exhausted.
+		if c.off >= len(c.buf) {
+			var v []byte
+			if !c.started {
+				_, v = c.cursor.First()
+				c.started = true
+			} else {
+				_, v = c.cursor.Next()
+			}
+			if v == nil {
+				return tsdb.EOF, nil
+			}
+
+			// Skip over the first 8 bytes since they are the max timestamp.
+			buf, err := snappy.Decode(nil, v[8:])
+			if err != nil {
+				c.err = fmt.Errorf("decode block of %s: %s", c.series, err)
+				return tsdb.EOF, nil
+			}
+			c.buf, c.off = buf, 0
+			continue
+		}
+
+		// Read the current entry and move forward.
+		entry := c.buf[c.off:]
+		dataSize := entryDataSize(entry)
+		timestamp := int64(binary.BigEndian.Uint64(entry[0:8]))
+		data := entry[entryHeaderSize : entryHeaderSize+dataSize]
+		c.off += entryHeaderSize + dataSize
+
+		value, err := c.dec.DecodeByName(c.field, data)
+		if err != nil {
+			continue
+		}
+		return timestamp, value
+	}
+}
+
+// seriesKeys sorts series keys by the tsm1 keys of their fields.
+type seriesKeys []string
+
+func (a seriesKeys) Len() int      { return len(a) }
+func (a seriesKeys) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a seriesKeys) Less(i, j int) bool {
+	return tsm1.SeriesFieldKey(a[i], "") < tsm1.SeriesFieldKey(a[j], "")
+}
+
+// entryHeaderSize is the number of bytes required for the header.
+const entryHeaderSize = 8 + 4
+
+// entryDataSize returns the size of an entry's data field, in bytes.
+func entryDataSize(v []byte) int { return int(binary.BigEndian.Uint32(v[8:12])) }
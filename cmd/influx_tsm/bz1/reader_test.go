@@ -0,0 +1,109 @@
+package bz1_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/bz1"
+	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/models"
+	"github.com/influxdb/influxdb/tsdb"
+	ebz1 "github.com/influxdb/influxdb/tsdb/engine/bz1"
+)
+
+// Ensure the reader decompresses blocks and returns every field in key order.
+func TestReader_Read(t *testing.T) {
+	mf := &tsdb.MeasurementFields{Fields: make(map[string]*tsdb.Field)}
+	mf.CreateFieldIfNotExists("value", influxql.Float, false)
+	mf.CreateFieldIfNotExists("count", influxql.Integer, false)
+
+	path := MustCreateShard(t, mf, map[string][][]byte{
+		"cpu,host=a": {
+			append(u64tob(1), MustEncodeFields(mf.Codec, models.Fields{"value": 1.0, "count": int64(10)})...),
+			append(u64tob(2), MustEncodeFields(mf.Codec, models.Fields{"value": 2.0})...),
+		},
+		"cpu,host=b": {
+			append(u64tob(1), MustEncodeFields(mf.Codec, models.Fields{"value": 3.0})...),
+		},
+	})
+	defer os.RemoveAll(path)
+
+	r := bz1.NewReader(path)
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	type kv struct {
+		Key    string
+		Times  []int64
+		Values []interface{}
+	}
+
+	var got []kv
+	for r.Next() {
+		k, values, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := kv{Key: k}
+		for _, v := range values {
+			e.Times = append(e.Times, v.UnixNano())
+			e.Values = append(e.Values, v.Value())
+		}
+		got = append(got, e)
+	}
+
+	exp := []kv{
+		{Key: "cpu,host=a#!~#count", Times: []int64{1}, Values: []interface{}{int64(10)}},
+		{Key: "cpu,host=a#!~#value", Times: []int64{1, 2}, Values: []interface{}{1.0, 2.0}},
+		{Key: "cpu,host=b#!~#value", Times: []int64{1}, Values: []interface{}{3.0}},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected data:\n\ngot=%+v\n\nexp=%+v", got, exp)
+	}
+}
+
+// MustCreateShard returns the path to a new bz1 shard containing the given
+// points, written directly to the shard's blocks.
+func MustCreateShard(t *testing.T, mf *tsdb.MeasurementFields, points map[string][][]byte) string {
+	dir, err := ioutil.TempDir("", "influx_tsm-bz1-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "1")
+
+	e := ebz1.NewEngine(path, filepath.Join(dir, "wal"), tsdb.NewEngineOptions()).(*ebz1.Engine)
+	if err := e.Open(); err != nil {
+		t.Fatal(err)
+	} else if err := e.WAL.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	if err := e.WriteIndex(points, map[string]*tsdb.MeasurementFields{"cpu": mf}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// MustEncodeFields encodes fields with codec. Panic on error.
+func MustEncodeFields(codec *tsdb.FieldCodec, fields models.Fields) []byte {
+	b, err := codec.EncodeFields(fields)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// u64tob converts a uint64 into an 8-byte slice.
+func u64tob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// checkpointFile is the default name of the checkpoint, in the output or data directory.
+const checkpointFile = ".influx_tsm_checkpoint"
+
+// Checkpoint records the progress of a run, so that a run which stops part
+// way through can be resumed by running the tool again. It records the
+// databases backed up and the shards converted, for the output the run
+// converts to. A nil checkpoint records nothing.
+type Checkpoint struct {
+	mu   sync.Mutex
+	path string
+
+	data checkpointData
+}
+
+// checkpointData is the content of the checkpoint file.
+type checkpointData struct {
+	Target    string          `json:"target"`
+	BackedUp  map[string]bool `json:"backedUp"`
+	Completed map[string]bool `json:"completed"`
+}
+
+// OpenCheckpoint returns the checkpoint stored in the file at path, for
+// runs converting to target. A missing file, or one recording a run to
+// another target, is an empty checkpoint.
+func OpenCheckpoint(path, target string) (*Checkpoint, error) {
+	c := &Checkpoint{
+		path: path,
+		data: checkpointData{
+			Target:    target,
+			BackedUp:  make(map[string]bool),
+			Completed: make(map[string]bool),
+		},
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var data checkpointData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	} else if data.Target != target {
+		return c, nil
+	}
+	if data.BackedUp != nil {
+		c.data.BackedUp = data.BackedUp
+	}
+	if data.Completed != nil {
+		c.data.Completed = data.Completed
+	}
+	return c, nil
+}
+
+// readCheckpointShards returns the keys of the shards recorded as converted
+// by the checkpoint at path, whatever the target of its run.
+func readCheckpointShards(path string) (map[string]bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var data checkpointData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	return data.Completed, nil
+}
+
+// Completed returns the number of shards recorded as converted.
+func (c *Checkpoint) Completed() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.data.Completed)
+}
+
+// IsCompleted returns whether the shard was converted by a previous run.
+func (c *Checkpoint) IsCompleted(si *tsdb.ShardInfo) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.data.Completed[shardKey(si)]
+}
+
+// Complete records the shard as converted.
+func (c *Checkpoint) Complete(si *tsdb.ShardInfo) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data.Completed[shardKey(si)] = true
+	return c.save()
+}
+
+// IsBackedUp returns whether the database was backed up by a previous run.
+func (c *Checkpoint) IsBackedUp(db string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.data.BackedUp[db]
+}
+
+// BackedUp records the database as backed up.
+func (c *Checkpoint) BackedUp(db string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data.BackedUp[db] = true
+	return c.save()
+}
+
+// Remove deletes the checkpoint, once the run it records is complete.
+func (c *Checkpoint) Remove() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// save writes the checkpoint to its file, replacing it atomically so that
+// stopping during a write never loses progress.
+func (c *Checkpoint) save() error {
+	b, err := json.Marshal(c.data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0777); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// shardKey returns the path of the shard relative to the data directory.
+func shardKey(si *tsdb.ShardInfo) string {
+	return filepath.ToSlash(filepath.Join(si.Database, si.RetentionPolicy, si.Path))
+}
+
+// checkpointTarget describes where the shards of a run are converted to,
+// so that a checkpoint is only resumed by a run converting to the same place.
+func checkpointTarget() string {
+	switch {
+	case opts.Out != "":
+		if abs, err := filepath.Abs(opts.Out); err == nil {
+			return "out:" + abs
+		}
+		return "out:" + opts.Out
+	case opts.SinkCmd != "":
+		return "sink-cmd:" + opts.SinkCmd
+	case opts.TargetDir != "":
+		return "target-dir:" + opts.TargetDir
+	default:
+		return "in-place"
+	}
+}
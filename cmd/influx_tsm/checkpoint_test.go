@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Ensure a checkpoint is resumed only by runs converting to the same target.
+func TestCheckpoint_Resume(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, checkpointFile)
+
+	si := &tsdb.ShardInfo{Database: "db0", RetentionPolicy: "default", Path: "1"}
+	c, err := OpenCheckpoint(path, "in-place")
+	if err != nil {
+		t.Fatal(err)
+	} else if err := c.BackedUp("db0"); err != nil {
+		t.Fatal(err)
+	} else if err := c.Complete(si); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err := OpenCheckpoint(path, "in-place"); err != nil {
+		t.Fatal(err)
+	} else if !c.IsBackedUp("db0") || !c.IsCompleted(si) || c.Completed() != 1 {
+		t.Fatal("expected progress to be resumed")
+	}
+
+	if c, err := OpenCheckpoint(path, "out:/data"); err != nil {
+		t.Fatal(err)
+	} else if c.IsBackedUp("db0") || c.IsCompleted(si) {
+		t.Fatal("unexpected progress for another target")
+	}
+
+	if err := c.Remove(); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected checkpoint to be removed: %v", err)
+	}
+}
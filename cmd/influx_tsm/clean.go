@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+const cleanUsage = `Usage: influx_tsm clean [options] <data-path>
+
+Move the backups of the data directory, or those of the databases given,
+along with their manifests, to the trash once the converted data has been
+checked. They can be restored from the trash until it is emptied with
+'influx_tsm trash empty'. A conversion which has not completed must be
+resumed first, as its backups may still be needed.
+
+With -orphans, the partial shards and temporary files left in the data
+directory by conversions which were interrupted are moved to the trash too.
+Each file is listed with its age, and with the conversion it was left by,
+found in the conversion manifest. While a conversion has not completed,
+only these are cleaned, leaving the backups and the shards its checkpoint
+lists.
+
+Nothing is deleted until the trash is emptied: run
+'influx_tsm trash empty' to reclaim the space.
+
+Options:`
+
+func runClean(args []string) error {
+	fs := flag.NewFlagSet("clean", flag.ExitOnError)
+	dbs := fs.String("dbs", "", "Comma-delimited list of databases whose backups to delete. Default is every database with a backup.")
+	backupDir := fs.String("backup-dir", "", "Directory the backups were written to. Default is the data directory.")
+	checkpoint := fs.String("checkpoint-file", "", "Checkpoint of the conversion of the data directory, as given to the conversion. Default is '"+checkpointFile+"' in the data directory, if writable.")
+	manifestPath := fs.String("conversion-manifest", "", "Conversion manifest of the data directory, as given to the conversion. Default is '"+conversionManifestFile+"' in the data directory, if writable.")
+	orphans := fs.Bool("orphans", false, "Also move the partial shards (."+tsmExt+") and temporary files (.tmp) left in the data directory by interrupted conversions to the trash, even while a conversion has not completed.")
+	yes := fs.Bool("y", false, "Don't ask for confirmation, just delete.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, cleanUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) < 1 {
+		return fmt.Errorf("no data directory specified")
+	}
+	dataPath := fs.Args()[0]
+	if *backupDir == "" {
+		*backupDir = dataPath
+	}
+
+	// The checkpoint and manifest are found as the conversion finds them.
+	o := options{DataPath: dataPath}
+	if *checkpoint == "" {
+		*checkpoint = o.stateFile(checkpointFile)
+	}
+	if *manifestPath == "" {
+		*manifestPath = o.stateFile(conversionManifestFile)
+	}
+	// The backups of a conversion which has not completed are kept, as are
+	// the shards it has converted, but the files it left behind are not.
+	var unfinished map[string]bool
+	if _, err := os.Stat(*checkpoint); err == nil {
+		if !*orphans {
+			return fmt.Errorf("a conversion of %v has not completed, resume it before deleting backups", dataPath)
+		}
+		if unfinished, err = readCheckpointShards(*checkpoint); err != nil {
+			return fmt.Errorf("read checkpoint %v: %v", *checkpoint, err)
+		}
+		if unfinished == nil {
+			unfinished = make(map[string]bool)
+		}
+		fmt.Printf("A conversion of %v has not completed, only orphaned files are cleaned.\n\n", dataPath)
+	}
+
+	manifest, err := ReadConversionManifest(*manifestPath)
+	if err != nil {
+		return err
+	}
+
+	// With -orphans, databases need not have a backup.
+	backups, err := findBackups(*backupDir)
+	if err != nil {
+		return err
+	}
+	if unfinished != nil {
+		backups = nil
+	} else if !*orphans {
+		if backups, err = filterBackups(backups, *backupDir, *dbs); err != nil {
+			return err
+		}
+	} else if *dbs != "" {
+		var selected []*backup
+		for _, db := range strings.Split(*dbs, ",") {
+			if b := findBackup(backups, db); b != nil {
+				selected = append(selected, b)
+			}
+		}
+		backups = selected
+	}
+
+	var found []*orphan
+	if *orphans {
+		if found, err = findOrphans(dataPath, *dbs, manifest, unfinished); err != nil {
+			return err
+		}
+	}
+	if len(backups) == 0 && len(found) == 0 {
+		return fmt.Errorf("no backups or orphaned files found in %v", dataPath)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(w, "Database\tPath\tSize\tAge\tOrigin")
+	var total int64
+	for _, b := range backups {
+		fi, err := os.Stat(b.path)
+		if err != nil {
+			return err
+		}
+		sz, err := dirSize(b.path)
+		if err != nil {
+			return err
+		}
+		total += sz
+		fmt.Fprintf(w, "%v\t%v\t%d\t%v\t%v\n", b.db, b.path, sz, age(now, fi.ModTime()), backupOrigin(b, manifest))
+	}
+	for _, o := range found {
+		total += o.size
+		fmt.Fprintf(w, "%v\t%v\t%d\t%v\t%v\n", o.db, filepath.Join(dataPath, o.path), o.size, age(now, o.modTime), o.origin)
+	}
+	w.Flush()
+
+	if !*yes {
+		fmt.Printf("\n%d backup(s) and %d orphaned file(s), totalling %d bytes, will be moved to the trash.\n", len(backups), len(found), total)
+		fmt.Printf("Proceed? y/N: ")
+
+		yn, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read response: %v", err)
+		}
+		if strings.TrimSpace(strings.ToLower(yn)) != "y" {
+			return fmt.Errorf("clean aborted")
+		}
+	}
+
+	// Backups are moved to the trash of the directory holding them, in a
+	// batch of their own.
+	trash := NewTrash(*backupDir)
+	for _, b := range backups {
+		name := filepath.Base(b.path)
+		if err := trash.Move(name); err != nil {
+			return err
+		}
+		if err := trash.Move(name + "." + manifestExt); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fmt.Printf("Moved %v to %v\n", b.path, trash.Path())
+	}
+
+	// Orphaned files are moved to the trash of the data directory.
+	orphanTrash := NewTrash(dataPath)
+	for _, o := range found {
+		if err := orphanTrash.Move(o.path); err != nil {
+			return err
+		}
+		fmt.Printf("Moved %v to %v\n", filepath.Join(dataPath, o.path), orphanTrash.Path())
+	}
+	return nil
+}
+
+// orphan is a file or directory left in the data directory by a conversion
+// which was interrupted.
+type orphan struct {
+	db      string
+	path    string // relative to the data directory
+	size    int64
+	modTime time.Time
+	origin  string
+}
+
+// findOrphans returns the partial shards and temporary files in dataPath,
+// limited to the comma-delimited list of databases if not empty, with their
+// origin from the conversion manifest. The files of the shards in keep,
+// by their checkpoint key, are left out.
+func findOrphans(dataPath, dbs string, manifest *ConversionManifest, keep map[string]bool) ([]*orphan, error) {
+	var selected map[string]bool
+	if dbs != "" {
+		selected = make(map[string]bool)
+		for _, db := range strings.Split(dbs, ",") {
+			selected[db] = true
+		}
+	}
+
+	var orphans []*orphan
+	add := func(db, rel string, fi os.FileInfo, origin string) error {
+		sz := fi.Size()
+		if fi.IsDir() {
+			var err error
+			if sz, err = dirSize(filepath.Join(dataPath, rel)); err != nil {
+				return err
+			}
+		}
+		orphans = append(orphans, &orphan{db: db, path: rel, size: sz, modTime: fi.ModTime(), origin: origin})
+		return nil
+	}
+
+	// Temporary files of the manifests and checkpoint, only cleaned with
+	// every database.
+	fis, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if selected == nil && !fi.IsDir() && strings.HasSuffix(fi.Name(), ".tmp") {
+			if err := add("", fi.Name(), fi, "unfinished write of "+strings.TrimSuffix(fi.Name(), ".tmp")); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Partial shards, within the retention policies of each database.
+	for _, fi := range fis {
+		db := fi.Name()
+		if !fi.IsDir() || strings.HasPrefix(db, ".") || isBackupName(db) || (selected != nil && !selected[db]) {
+			continue
+		}
+		rps, err := ioutil.ReadDir(filepath.Join(dataPath, db))
+		if err != nil {
+			return nil, err
+		}
+		for _, rp := range rps {
+			if !rp.IsDir() {
+				continue
+			}
+			shards, err := ioutil.ReadDir(filepath.Join(dataPath, db, rp.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, sh := range shards {
+				name := sh.Name()
+				id := strings.TrimSuffix(strings.TrimSuffix(name, ".tmp"), "."+tsmExt)
+				if keep[shardKey(&tsdb.ShardInfo{Database: db, RetentionPolicy: rp.Name(), Path: id})] {
+					continue
+				}
+				if strings.HasSuffix(name, ".tmp") {
+					rel := filepath.Join(db, rp.Name(), name)
+					if err := add(db, rel, sh, "unfinished write of "+strings.TrimSuffix(name, ".tmp")); err != nil {
+						return nil, err
+					}
+				} else if strings.HasSuffix(name, "."+tsmExt) && sh.IsDir() {
+					rel := filepath.Join(db, rp.Name(), name)
+					if err := add(db, rel, sh, shardOrigin(manifest, db, rp.Name(), strings.TrimSuffix(name, "."+tsmExt))); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// shardOrigin describes the conversion which left the partial shard at
+// path, from its entry in the conversion manifest.
+func shardOrigin(manifest *ConversionManifest, db, rp, path string) string {
+	s := manifest.Shard(db, rp, path)
+	if s == nil {
+		return "interrupted conversion, not in the conversion manifest"
+	}
+	switch s.Outcome {
+	case "failed":
+		return fmt.Sprintf("conversion failed at %v: %v", s.Time.Format(time.RFC3339), s.Error)
+	default:
+		return fmt.Sprintf("interrupted conversion, after one which %v at %v", s.Outcome, s.Time.Format(time.RFC3339))
+	}
+}
+
+// backupOrigin describes the conversion which took the backup, from the
+// shards backed up to it in the conversion manifest.
+func backupOrigin(b *backup, manifest *ConversionManifest) string {
+	var n int
+	var last time.Time
+	for _, s := range manifest.Shards {
+		if filepath.Clean(s.Backup) != filepath.Clean(b.path) {
+			continue
+		}
+		n++
+		if s.Time.After(last) {
+			last = s.Time
+		}
+	}
+	if n == 0 {
+		return "not in the conversion manifest"
+	}
+	return fmt.Sprintf("conversion of %d shard(s), at %v", n, last.Format(time.RFC3339))
+}
+
+// age returns the time since t, to the second.
+func age(now, t time.Time) time.Duration {
+	d := now.Sub(t)
+	return d - d%time.Second
+}
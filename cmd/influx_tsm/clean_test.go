@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Ensure the selected backups, and their manifests, are moved to the trash,
+// from which they can be restored.
+func TestRunClean(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	MustWriteFile(filepath.Join(dir, "db0.bak", "default", "1"), "data")
+	MustWriteFile(filepath.Join(dir, "db0.bak.manifest"), "{}")
+	MustWriteFile(filepath.Join(dir, "db1.bak.tar.gz"), "data")
+	MustWriteFile(filepath.Join(dir, "db0", "default", "1"), "data")
+
+	if err := runClean([]string{"-y", "-dbs", "db0", dir}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"db0.bak", "db0.bak.manifest"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%v not deleted: %v", name, err)
+		}
+	}
+	for _, name := range []string{"db1.bak.tar.gz", "db0"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("%v deleted: %v", name, err)
+		}
+	}
+
+	trash := NewTrash(dir)
+	batches, err := trash.Batches()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(batches) != 1 || !reflect.DeepEqual(batches[0].Paths, []string{"db0.bak", "db0.bak.manifest"}) {
+		t.Fatalf("unexpected trash batches: %+v", batches)
+	}
+	if err := trash.Restore(batches[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"db0.bak", "db0.bak.manifest"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("%v not restored: %v", name, err)
+		}
+	}
+
+	// Backups of an unfinished conversion are kept.
+	MustWriteFile(filepath.Join(dir, checkpointFile), "{}")
+	if err := runClean([]string{"-y", dir}); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "db1.bak.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+
+	// As are those of a conversion checkpointed elsewhere.
+	os.Remove(filepath.Join(dir, checkpointFile))
+	checkpoint := filepath.Join(MustTempDir(), "checkpoint")
+	defer os.RemoveAll(filepath.Dir(checkpoint))
+	MustWriteFile(checkpoint, "{}")
+	if err := runClean([]string{"-y", "-checkpoint-file", checkpoint, dir}); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "db1.bak.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure the partial shards and temporary files left by interrupted
+// conversions are listed with their origin, and moved to the trash, with
+// -orphans.
+func TestRunClean_Orphans(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	MustWriteFile(filepath.Join(dir, "db0", "default", "1"), "data")
+	MustWriteFile(filepath.Join(dir, "db0", "default", "1.tsm", "000000001-000000001.tsm"), "data")
+	MustWriteFile(filepath.Join(dir, "db1", "default", "2.tsm", "000000001-000000001.tsm"), "data")
+	cm := &ConversionManifest{}
+	cm.Update([]*ManifestShard{{Database: "db0", RetentionPolicy: "default", Path: "1", Outcome: "failed", Error: "disk full", Time: time.Unix(0, 0)}})
+	if err := cm.Save(filepath.Join(dir, conversionManifestFile)); err != nil {
+		t.Fatal(err)
+	}
+	MustWriteFile(filepath.Join(dir, conversionManifestFile+".tmp"), "{}")
+
+	a, err := findOrphans(dir, "", cm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, o := range a {
+		paths = append(paths, o.path)
+	}
+	exp := []string{conversionManifestFile + ".tmp", filepath.Join("db0", "default", "1.tsm"), filepath.Join("db1", "default", "2.tsm")}
+	if !reflect.DeepEqual(paths, exp) {
+		t.Fatalf("unexpected orphans: %v", paths)
+	} else if !strings.HasPrefix(a[1].origin, "conversion failed") {
+		t.Fatalf("unexpected origin: %v", a[1].origin)
+	} else if !strings.HasPrefix(a[2].origin, "interrupted conversion") {
+		t.Fatalf("unexpected origin: %v", a[2].origin)
+	}
+
+	// Only those of the databases given are cleaned.
+	if err := runClean([]string{"-y", "-orphans", "-dbs", "db0", dir}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "db0", "default", "1.tsm")); !os.IsNotExist(err) {
+		t.Fatalf("partial shard not deleted: %v", err)
+	}
+	for _, path := range []string{filepath.Join("db0", "default", "1"), filepath.Join("db1", "default", "2.tsm"), conversionManifestFile + ".tmp"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Fatalf("%v deleted: %v", path, err)
+		}
+	}
+
+	batches, err := NewTrash(dir).Batches()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(batches) != 1 || !reflect.DeepEqual(batches[0].Paths, []string{filepath.Join("db0", "default", "1.tsm")}) {
+		t.Fatalf("unexpected trash batches: %+v", batches)
+	}
+}
+
+// Ensure the orphaned files of a conversion which has not completed are
+// cleaned with -orphans, keeping its backups and the shards it converted.
+func TestRunClean_OrphansUnfinished(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	MustWriteFile(filepath.Join(dir, "db0.bak", "default", "1"), "data")
+	MustWriteFile(filepath.Join(dir, "db0", "default", "1.tsm", "000000001-000000001.tsm"), "data")
+	MustWriteFile(filepath.Join(dir, "db0", "default", "2.tsm", "000000001-000000001.tsm"), "data")
+	c, err := OpenCheckpoint(filepath.Join(dir, checkpointFile), "")
+	if err != nil {
+		t.Fatal(err)
+	} else if err := c.Complete(&tsdb.ShardInfo{Database: "db0", RetentionPolicy: "default", Path: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backups are still kept.
+	if err := runClean([]string{"-y", dir}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if err := runClean([]string{"-y", "-orphans", dir}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "db0", "default", "2.tsm")); !os.IsNotExist(err) {
+		t.Fatalf("partial shard not deleted: %v", err)
+	}
+	for _, path := range []string{"db0.bak", checkpointFile, filepath.Join("db0", "default", "1.tsm")} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Fatalf("%v deleted: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// TypeConflict is the policy for a field typed differently in the shards of
+// a database, such as one written as an integer to one shard and a float to
+// another. Each b1 and bz1 shard has a field index of its own, so this can
+// happen, but the converted shards of a database must agree on the type of
+// each field.
+type TypeConflict int
+
+const (
+	// TypeConflictFail fails every shard holding the field.
+	TypeConflictFail TypeConflict = iota
+
+	// TypeConflictWiden writes the field as a float in every shard, if it
+	// is only ever an integer or a float.
+	TypeConflictWiden
+
+	// TypeConflictSkip drops the field from every shard in which it has
+	// another type than in the earliest shard holding it.
+	TypeConflictSkip
+)
+
+var typeConflictNames = []string{"fail", "widen", "skip"}
+
+func (p TypeConflict) String() string {
+	return typeConflictNames[p]
+}
+
+// ParseTypeConflict returns the type conflict policy of the given name.
+func ParseTypeConflict(s string) (TypeConflict, error) {
+	for i, name := range typeConflictNames {
+		if strings.EqualFold(s, name) {
+			return TypeConflict(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown type conflict policy %q, must be one of %v", s, strings.Join(typeConflictNames, ", "))
+}
+
+// fieldAction is what is done with the values of a field of a shard, to
+// resolve a type conflict.
+type fieldAction int
+
+const (
+	fieldWiden fieldAction = iota + 1
+	fieldSkip
+)
+
+// fieldActions holds the action for each conflicting field of a shard, keyed
+// by measurement and field name, joined by keyFieldSeparator.
+type fieldActions map[string]fieldAction
+
+// typeConflicts holds the actions for the conflicting fields of each shard
+// being converted, once resolved.
+var typeConflicts map[*tsdb.ShardInfo]fieldActions
+
+// fieldType is the type of a field in a single shard.
+type fieldType struct {
+	shard *tsdb.ShardInfo
+	typ   influxql.DataType
+}
+
+// resolveTypeConflicts reads the field index of each shard, and applies
+// policy to the fields typed differently in shards of the same database. It
+// returns the actions for the fields of each of convert, and the error of
+// each of convert which can't be converted under the policy. The type a
+// field is skipped to is its type in the earliest shard holding it, of
+// convert and others, including those already converted to tsm1, so that
+// converting part of a database at a time resolves each field the same way.
+func resolveTypeConflicts(convert, others tsdb.ShardInfos, policy TypeConflict) (map[*tsdb.ShardInfo]fieldActions, map[*tsdb.ShardInfo]error, error) {
+	// Only shards of the databases being converted are read, once each.
+	dbs := make(map[string]bool)
+	for _, si := range convert {
+		dbs[si.Database] = true
+	}
+	seen := make(map[string]bool)
+	var shards []*shardFields
+	for _, si := range append(convert[:len(convert):len(convert)], others...) {
+		if !dbs[si.Database] || seen[si.FullPath(opts.DataPath)] {
+			continue
+		}
+		seen[si.FullPath(opts.DataPath)] = true
+
+		sf, err := readShardFields(si)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read fields of %v: %v", si.FullPath(opts.DataPath), err)
+		} else if sf.minTime.IsZero() {
+			continue
+		}
+		shards = append(shards, sf)
+	}
+	sort.Sort(byMinTime(shards))
+
+	fields := make(map[string]map[string][]fieldType)
+	for _, sf := range shards {
+		si := sf.shard
+		if fields[si.Database] == nil {
+			fields[si.Database] = make(map[string][]fieldType)
+		}
+		for measurement, m := range sf.types {
+			for name, typ := range m {
+				key := measurement + keyFieldSeparator + name
+				fields[si.Database][key] = append(fields[si.Database][key], fieldType{shard: si, typ: typ})
+			}
+		}
+	}
+
+	converting := make(map[*tsdb.ShardInfo]bool)
+	for _, si := range convert {
+		converting[si] = true
+	}
+	actions := make(map[*tsdb.ShardInfo]fieldActions)
+	failed := make(map[*tsdb.ShardInfo]error)
+	var dbNames []string
+	for db := range fields {
+		dbNames = append(dbNames, db)
+	}
+	sort.Strings(dbNames)
+	for _, db := range dbNames {
+		var keys []string
+		for key := range fields[db] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			a := fields[db][key]
+			first, other := a[0], conflicting(a)
+			if other == nil {
+				continue
+			}
+			measurement, name := splitKey(key)
+			desc := fmt.Sprintf("field %v of measurement %v in database %v is %v in %v but %v in %v",
+				name, measurement, db, first.typ, shardName(first.shard), other.typ, shardName(other.shard))
+
+			if policy == TypeConflictFail || (policy == TypeConflictWiden && !numeric(a)) {
+				err := fmt.Errorf("%v, see -type-conflict", desc)
+				if policy == TypeConflictWiden {
+					err = fmt.Errorf("%v, which can't be widened to one type", desc)
+				}
+				for _, ft := range a {
+					if converting[ft.shard] && failed[ft.shard] == nil {
+						failed[ft.shard] = err
+					}
+				}
+				continue
+			}
+
+			logger.Warnf("The %v, resolved by -type-conflict %v\n", desc, policy)
+			for _, ft := range a {
+				var action fieldAction
+				switch {
+				case policy == TypeConflictWiden && ft.typ == influxql.Integer:
+					action = fieldWiden
+				case policy == TypeConflictSkip && ft.typ != first.typ:
+					action = fieldSkip
+				default:
+					continue
+				}
+				if !converting[ft.shard] {
+					continue
+				}
+				if actions[ft.shard] == nil {
+					actions[ft.shard] = make(fieldActions)
+				}
+				actions[ft.shard][key] = action
+			}
+		}
+	}
+	return actions, failed, nil
+}
+
+// conflicting returns the first of a typed differently to the first, or nil.
+func conflicting(a []fieldType) *fieldType {
+	for i := range a {
+		if a[i].typ != a[0].typ {
+			return &a[i]
+		}
+	}
+	return nil
+}
+
+// numeric returns whether every type of a is an integer or a float.
+func numeric(a []fieldType) bool {
+	for _, ft := range a {
+		if ft.typ != influxql.Integer && ft.typ != influxql.Float {
+			return false
+		}
+	}
+	return true
+}
+
+// shardName returns the shard as database/retention policy/ID.
+func shardName(si *tsdb.ShardInfo) string {
+	return fmt.Sprintf("shard %v/%v/%v", si.Database, si.RetentionPolicy, si.Path)
+}
+
+// shardFields holds the field types of a shard, and the time of its
+// earliest point.
+type shardFields struct {
+	shard   *tsdb.ShardInfo
+	minTime time.Time
+	types   map[string]map[string]influxql.DataType
+}
+
+// readShardFields reads the field types of the shard. Those of a tsm1 shard
+// are read from the types of its blocks, and the time of its earliest point
+// from its index, as tsm1 shards aren't read when listed.
+func readShardFields(si *tsdb.ShardInfo) (*shardFields, error) {
+	if si.Format == tsdb.TSM1 {
+		s, err := OpenTSMShard(si.FullPath(opts.DataPath))
+		if err != nil {
+			return nil, err
+		}
+		defer s.Close()
+
+		types, err := s.FieldTypes()
+		if err != nil {
+			return nil, err
+		}
+		return &shardFields{shard: si, minTime: s.MinTime(), types: types}, nil
+	}
+
+	r, err := newShardReader(si)
+	if err != nil {
+		return nil, err
+	}
+	types, err := r.FieldTypes()
+	if err != nil {
+		return nil, err
+	}
+	return &shardFields{shard: si, minTime: si.MinTime, types: types}, nil
+}
+
+// byMinTime sorts shards by the time of their earliest point, then as ShardInfos.
+type byMinTime []*shardFields
+
+func (a byMinTime) Len() int      { return len(a) }
+func (a byMinTime) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byMinTime) Less(i, j int) bool {
+	if !a[i].minTime.Equal(a[j].minTime) {
+		return a[i].minTime.Before(a[j].minTime)
+	}
+	return tsdb.ShardInfos{a[i].shard, a[j].shard}.Less(0, 1)
+}
+
+// Iterator returns a KeyIterator applying the actions to the values read
+// from itr, or itr if there are none. Values are changed as they are read,
+// so nothing is held between reads.
+func (a fieldActions) Iterator(itr KeyIterator) KeyIterator {
+	if len(a) == 0 {
+		return itr
+	}
+	return &fieldActionIterator{KeyIterator: itr, actions: a}
+}
+
+// fieldActionIterator is a KeyIterator widening or skipping the values of
+// the fields with actions.
+type fieldActionIterator struct {
+	KeyIterator
+	actions fieldActions
+
+	key    string
+	values []tsm1.Value
+	err    error
+}
+
+func (itr *fieldActionIterator) Next() bool {
+	for itr.KeyIterator.Next() {
+		itr.key, itr.values, itr.err = itr.KeyIterator.Read()
+		if itr.err != nil {
+			return true
+		}
+
+		measurement, field := splitKey(itr.key)
+		switch itr.actions[measurement+keyFieldSeparator+field] {
+		case fieldSkip:
+			continue
+		case fieldWiden:
+			itr.values = widenAll(itr.values)
+		}
+		return true
+	}
+	return false
+}
+
+func (itr *fieldActionIterator) Read() (string, []tsm1.Value, error) {
+	return itr.key, itr.values, itr.err
+}
+
+// widenAll returns the values as floats. Values which are not integers are
+// returned unchanged.
+func widenAll(values []tsm1.Value) []tsm1.Value {
+	a := make([]tsm1.Value, len(values))
+	for i, v := range values {
+		if n, ok := v.Value().(int64); ok {
+			v = tsm1.NewValue(v.Time(), float64(n))
+		}
+		a[i] = v
+	}
+	return a
+}
+
+// applyTypeConflicts resolves the type conflicts of the shards with the
+// others of their databases, recording the actions for their fields in
+// typeConflicts. It returns the shards which can be converted, skipping the
+// rest.
+func applyTypeConflicts(shards, others tsdb.ShardInfos) tsdb.ShardInfos {
+	actions, failed, err := resolveTypeConflicts(shards, others, opts.TypeConflict)
+	if err != nil {
+		fatalf("Failed to read the fields of shards: %v\n", err)
+	}
+	if typeConflicts == nil {
+		typeConflicts = make(map[*tsdb.ShardInfo]fieldActions)
+	}
+	for si, a := range actions {
+		typeConflicts[si] = a
+	}
+
+	var remaining tsdb.ShardInfos
+	for _, si := range shards {
+		if err := failed[si]; err != nil {
+			skipShard(si, err)
+			continue
+		}
+		remaining = append(remaining, si)
+	}
+	return remaining
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// MustCreateConflictShards creates bz1 shards in which the value field of cpu
+// is an integer, then a float, then an integer again, in database db0, and a
+// shard of another database. It returns the shards loaded from the data
+// directory. Panic on error.
+func MustCreateConflictShards(dataPath string) tsdb.ShardInfos {
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db0", "default", "1"), "cpu value=1i 1000000000", "mem free=100i 1000000000")
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db0", "default", "2"), "cpu value=2.5 2000000000")
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db0", "default", "3"), "cpu value=3i 3000000000")
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db1", "default", "4"), "cpu value=4.5 4000000000")
+
+	shards, _, err := collectShards(dataPath, nil, false)
+	if err != nil {
+		panic(err)
+	}
+	return shards
+}
+
+// shardByID returns the shard with the given database and ID.
+func shardByID(shards tsdb.ShardInfos, db, id string) *tsdb.ShardInfo {
+	for _, si := range shards {
+		if si.Database == db && si.Path == id {
+			return si
+		}
+	}
+	panic("no shard " + db + "/" + id)
+}
+
+// Ensure every shard holding a field typed differently across the shards of
+// its database fails by default, while other databases convert.
+func TestResolveTypeConflicts_Fail(t *testing.T) {
+	defer func(o options) { opts = o }(opts)
+	opts.DataPath = MustTempDir()
+	defer os.RemoveAll(opts.DataPath)
+	shards := MustCreateConflictShards(opts.DataPath)
+
+	actions, failed, err := resolveTypeConflicts(shards, nil, TypeConflictFail)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(actions) != 0 {
+		t.Fatalf("unexpected actions: %v", actions)
+	} else if len(failed) != 3 {
+		t.Fatalf("unexpected failures: %v", failed)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if err := failed[shardByID(shards, "db0", id)]; err == nil || !strings.Contains(err.Error(), "field value of measurement cpu in database db0 is integer in shard db0/default/1 but float in shard db0/default/2") {
+			t.Fatalf("unexpected error of shard %v: %v", id, err)
+		}
+	}
+}
+
+// Ensure a field which is an integer in some shards and a float in others is
+// widened to a float in the integer shards.
+func TestResolveTypeConflicts_Widen(t *testing.T) {
+	defer func(o options) { opts = o }(opts)
+	opts.DataPath = MustTempDir()
+	defer os.RemoveAll(opts.DataPath)
+	shards := MustCreateConflictShards(opts.DataPath)
+
+	actions, failed, err := resolveTypeConflicts(shards, nil, TypeConflictWiden)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(failed) != 0 {
+		t.Fatalf("unexpected failures: %v", failed)
+	}
+	exp := map[*tsdb.ShardInfo]fieldActions{
+		shardByID(shards, "db0", "1"): {"cpu#!~#value": fieldWiden},
+		shardByID(shards, "db0", "3"): {"cpu#!~#value": fieldWiden},
+	}
+	if !reflect.DeepEqual(actions, exp) {
+		t.Fatalf("unexpected actions: %v", actions)
+	}
+
+	// Fields which aren't numbers can't be widened.
+	MustCreateBZ1Shard(filepath.Join(opts.DataPath, "db0", "default", "5"), `cpu value="x" 5000000000`)
+	shards, _, err = collectShards(opts.DataPath, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, failed, err := resolveTypeConflicts(shards, nil, TypeConflictWiden); err != nil {
+		t.Fatal(err)
+	} else if err := failed[shardByID(shards, "db0", "5")]; err == nil || !strings.Contains(err.Error(), "can't be widened") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a field is skipped in the shards in which it has another type than
+// in the earliest shard, including shards of the database not converted.
+func TestResolveTypeConflicts_Skip(t *testing.T) {
+	defer func(o options) { opts = o }(opts)
+	opts.DataPath = MustTempDir()
+	defer os.RemoveAll(opts.DataPath)
+	shards := MustCreateConflictShards(opts.DataPath)
+
+	actions, failed, err := resolveTypeConflicts(shards, nil, TypeConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(failed) != 0 {
+		t.Fatalf("unexpected failures: %v", failed)
+	}
+	if exp := map[*tsdb.ShardInfo]fieldActions{shardByID(shards, "db0", "2"): {"cpu#!~#value": fieldSkip}}; !reflect.DeepEqual(actions, exp) {
+		t.Fatalf("unexpected actions: %v", actions)
+	}
+
+	// Converting only the later shards resolves the field the same way.
+	convert := tsdb.ShardInfos{shardByID(shards, "db0", "2"), shardByID(shards, "db0", "3")}
+	actions, _, err = resolveTypeConflicts(convert, shards, TypeConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := map[*tsdb.ShardInfo]fieldActions{convert[0]: {"cpu#!~#value": fieldSkip}}; !reflect.DeepEqual(actions, exp) {
+		t.Fatalf("unexpected actions: %v", actions)
+	}
+}
+
+// Ensure the values of a shard are converted with the resolution of its
+// type conflicts.
+func TestConvertShard_TypeConflict(t *testing.T) {
+	defer func(o options) { opts = o }(opts)
+	defer func(m map[*tsdb.ShardInfo]fieldActions) { typeConflicts = m }(typeConflicts)
+	opts.DataPath = MustTempDir()
+	defer os.RemoveAll(opts.DataPath)
+	opts.Out = MustTempDir()
+	defer os.RemoveAll(opts.Out)
+	opts.TSMSize = maxTSMSz
+	opts.MeasurementParallel = 1
+	opts.TypeConflict = TypeConflictWiden
+	shards := MustCreateConflictShards(opts.DataPath)
+	typeConflicts = nil
+
+	if remaining := applyTypeConflicts(shards, nil); len(remaining) != len(shards) {
+		t.Fatalf("unexpected shards: %v", remaining)
+	}
+	for _, si := range shards {
+		if err := convertShard(si, NewDirSink(opts.Out), nil, newValueCounter(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		db, id string
+		exp    map[string][]interface{}
+	}{
+		{"db0", "1", map[string][]interface{}{"cpu#!~#value": {1.0}, "mem#!~#free": {int64(100)}}},
+		{"db0", "2", map[string][]interface{}{"cpu#!~#value": {2.5}}},
+		{"db0", "3", map[string][]interface{}{"cpu#!~#value": {3.0}}},
+		{"db1", "4", map[string][]interface{}{"cpu#!~#value": {4.5}}},
+	} {
+		if m := MustReadTSMShard(filepath.Join(opts.Out, tt.db, "default", tt.id)); !reflect.DeepEqual(m, tt.exp) {
+			t.Fatalf("unexpected values of shard %v/%v: %v", tt.db, tt.id, m)
+		}
+	}
+}
+
+func TestParseTypeConflict(t *testing.T) {
+	if p, err := ParseTypeConflict("Widen"); err != nil || p != TypeConflictWiden {
+		t.Fatalf("unexpected policy: %v, %v", p, err)
+	} else if _, err := ParseTypeConflict("coerce"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure a database converted over two runs resolves each field the same
+// way in both, reading the types of the shards already converted to tsm1.
+func TestConvert_TypeConflictTwoRuns(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db0", "default", "1"), "cpu value=1i,n=1i 1000000000")
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db0", "default", "2"), "cpu value=2.5,n=2i 2000000000")
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db0", "default", "3"), "cpu value=3.5,n=3i 3000000000")
+
+	// The first run resolves value as an integer, its type in the earliest shard.
+	if output, code := RunConvert("", "-y", "-nobackup", "-type-conflict", "skip", "-shards", "1", dataPath); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	}
+	// The second converts only shards in which it is a float, so it must be
+	// skipped from them, rather than written as a float.
+	if output, code := RunConvert("", "-y", "-nobackup", "-type-conflict", "skip", "-shards", "2,3", dataPath); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	}
+
+	for _, tt := range []struct {
+		id  string
+		exp map[string][]interface{}
+	}{
+		{"1", map[string][]interface{}{"cpu#!~#value": {int64(1)}, "cpu#!~#n": {int64(1)}}},
+		{"2", map[string][]interface{}{"cpu#!~#n": {int64(2)}}},
+		{"3", map[string][]interface{}{"cpu#!~#n": {int64(3)}}},
+	} {
+		if m := MustReadTSMShard(filepath.Join(dataPath, "db0", "default", tt.id)); !reflect.DeepEqual(m, tt.exp) {
+			t.Fatalf("shard %v: unexpected values: %v", tt.id, m)
+		}
+	}
+}
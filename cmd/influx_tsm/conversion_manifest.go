@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// conversionManifestFile is the default name of the conversion manifest.
+const conversionManifestFile = "conversion-manifest.json"
+
+// ConversionManifest lists every shard processed by the conversions of a
+// data directory, so that other tools, and the restore command, can find its
+// backup and check its files. A shard processed again by a later run, such
+// as one resuming a failed conversion, replaces its earlier entry.
+type ConversionManifest struct {
+	DataPath string           `json:"dataPath"`
+	Updated  time.Time        `json:"updated"`
+	Shards   []*ManifestShard `json:"shards"`
+}
+
+// ManifestShard is the entry of a shard in the conversion manifest.
+type ManifestShard struct {
+	Database        string    `json:"database"`
+	RetentionPolicy string    `json:"retentionPolicy"`
+	Path            string    `json:"path"`
+	Format          string    `json:"format"`
+	Time            time.Time `json:"time"`
+
+	// Outcome is "converted", or "failed" with the error.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+
+	// Backup is the path of the backup of the shard's database, if any.
+	Backup string `json:"backup,omitempty"`
+
+	// Source is the original shard, and Files the converted files, if any.
+	Source *FileChecksum   `json:"source,omitempty"`
+	Files  []*FileChecksum `json:"files,omitempty"`
+}
+
+// FileChecksum is the size and SHA-256 digest of a file.
+type FileChecksum struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ReadConversionManifest reads the manifest at path, returning an empty
+// manifest if the file does not exist.
+func ReadConversionManifest(path string) (*ConversionManifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &ConversionManifest{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	m := &ConversionManifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("read conversion manifest %v: %v", path, err)
+	}
+	return m, nil
+}
+
+// Shard returns the entry of the shard, or nil.
+func (m *ConversionManifest) Shard(database, retentionPolicy, path string) *ManifestShard {
+	for _, s := range m.Shards {
+		if s.Database == database && s.RetentionPolicy == retentionPolicy && s.Path == path {
+			return s
+		}
+	}
+	return nil
+}
+
+// BackupDir returns the directory of the backups recorded in the manifest,
+// as an s3:// URL for backups in S3, or an empty string if none are.
+func (m *ConversionManifest) BackupDir() string {
+	for _, s := range m.Shards {
+		switch {
+		case strings.HasPrefix(s.Backup, s3Scheme):
+			return s.Backup[:strings.LastIndex(s.Backup, "/")]
+		case s.Backup != "":
+			return filepath.Dir(s.Backup)
+		}
+	}
+	return ""
+}
+
+// Update adds the entries of shards, replacing any earlier entry of each.
+func (m *ConversionManifest) Update(shards []*ManifestShard) {
+	for _, s := range shards {
+		if prev := m.Shard(s.Database, s.RetentionPolicy, s.Path); prev != nil {
+			*prev = *s
+			continue
+		}
+		m.Shards = append(m.Shards, s)
+	}
+	sort.Sort(manifestShards(m.Shards))
+	m.Updated = time.Now().UTC()
+}
+
+// Save writes the manifest to path, replacing any existing file atomically.
+func (m *ConversionManifest) Save(path string) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// manifestShards sorts the entries of a manifest by database, retention
+// policy and shard.
+type manifestShards []*ManifestShard
+
+func (a manifestShards) Len() int      { return len(a) }
+func (a manifestShards) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a manifestShards) Less(i, j int) bool {
+	if a[i].Database != a[j].Database {
+		return a[i].Database < a[j].Database
+	}
+	if a[i].RetentionPolicy != a[j].RetentionPolicy {
+		return a[i].RetentionPolicy < a[j].RetentionPolicy
+	}
+	return a[i].Path < a[j].Path
+}
+
+// newManifestShard returns the entry of the conversion of a shard.
+func newManifestShard(r *ShardResult, backup string) *ManifestShard {
+	s := &ManifestShard{
+		Database:        r.Shard.Database,
+		RetentionPolicy: r.Shard.RetentionPolicy,
+		Path:            r.Shard.Path,
+		Format:          r.Shard.FormatAsString(),
+		Time:            time.Now().UTC(),
+		Outcome:         "converted",
+		Backup:          backup,
+		Source:          r.Source,
+		Files:           r.Files,
+	}
+	if r.Error != "" {
+		s.Outcome, s.Error = "failed", r.Error
+	}
+	return s
+}
+
+// updateConversionManifest adds the shards of the report to the manifest at path.
+func updateConversionManifest(path string, r *Report) error {
+	m, err := ReadConversionManifest(path)
+	if err != nil {
+		return err
+	}
+
+	shards := make([]*ManifestShard, 0, len(r.Shards))
+	for _, sr := range r.Shards {
+		var backup string
+		if opts.Backup() {
+			backup = opts.BackupPath(sr.Shard.Database)
+		}
+		shards = append(shards, newManifestShard(sr, backup))
+	}
+
+	m.DataPath = r.DataPath
+	m.Update(shards)
+	return m.Save(path)
+}
+
+// checksumFile returns the checksum of the file at path, read within the
+// rate limit.
+func checksumFile(path string) (*FileChecksum, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, limiter.Reader(f))
+	if err != nil {
+		return nil, err
+	}
+	return &FileChecksum{Name: filepath.Base(path), Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// checksumSink is a Sink recording the checksum of each file written to it.
+type checksumSink struct {
+	Sink
+
+	mu    sync.Mutex
+	files []*FileChecksum
+}
+
+func (s *checksumSink) Create(path string) (io.WriteCloser, error) {
+	w, err := s.Sink.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumWriter{WriteCloser: w, s: s, name: filepath.Base(path), h: sha256.New()}, nil
+}
+
+// add records the checksum of a file written elsewhere.
+func (s *checksumSink) add(f *FileChecksum) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = append(s.files, f)
+}
+
+// Files returns the checksums of the files closed so far, sorted by name.
+func (s *checksumSink) Files() []*FileChecksum {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := make([]*FileChecksum, len(s.files))
+	copy(a, s.files)
+	sort.Sort(fileChecksums(a))
+	return a
+}
+
+// Size returns the total size of the files closed so far.
+func (s *checksumSink) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for _, f := range s.files {
+		n += f.Size
+	}
+	return n
+}
+
+// checksumWriter digests the data written through it, recording its
+// checksum with the sink once closed.
+type checksumWriter struct {
+	io.WriteCloser
+	s    *checksumSink
+	name string
+	h    hash.Hash
+	n    int64
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.h.Write(p[:n])
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *checksumWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.s.files = append(w.s.files, &FileChecksum{Name: w.name, Size: w.n, SHA256: hex.EncodeToString(w.h.Sum(nil))})
+	return nil
+}
+
+// fileChecksums sorts checksums by the name of their file.
+type fileChecksums []*FileChecksum
+
+func (a fileChecksums) Len() int           { return len(a) }
+func (a fileChecksums) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a fileChecksums) Less(i, j int) bool { return a[i].Name < a[j].Name }
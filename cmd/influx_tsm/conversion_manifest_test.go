@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Ensure a later entry of a shard replaces the earlier one, and entries
+// survive being saved and read.
+func TestConversionManifest_Update(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, conversionManifestFile)
+
+	m, err := ReadConversionManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(m.Shards) != 0 {
+		t.Fatalf("unexpected shards: %v", m.Shards)
+	}
+
+	m.Update([]*ManifestShard{
+		{Database: "db1", RetentionPolicy: "default", Path: "2", Outcome: "converted", Backup: "/backups/db1.bak"},
+		{Database: "db0", RetentionPolicy: "default", Path: "1", Outcome: "failed", Error: "timeout"},
+	})
+	if err := m.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = ReadConversionManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Update([]*ManifestShard{{Database: "db0", RetentionPolicy: "default", Path: "1", Outcome: "converted"}})
+
+	if len(m.Shards) != 2 {
+		t.Fatalf("unexpected shards: %v", m.Shards)
+	} else if s := m.Shards[0]; s.Database != "db0" || s.Outcome != "converted" || s.Error != "" {
+		t.Fatalf("unexpected first shard: %+v", s)
+	} else if s := m.Shard("db1", "default", "2"); s == nil || s.Backup != "/backups/db1.bak" {
+		t.Fatalf("unexpected shard: %+v", s)
+	} else if dir := m.BackupDir(); dir != "/backups" {
+		t.Fatalf("unexpected backup directory: %v", dir)
+	}
+}
+
+// Ensure the checksum of each file written through the sink is recorded.
+func TestChecksumSink(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	s := &checksumSink{Sink: NewDirSink(dir)}
+	for _, f := range []struct{ name, data string }{{"b.tsm", "bar"}, {"a.tsm", "foo"}} {
+		if err := os.MkdirAll(filepath.Join(dir, "1"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		w, err := s.Create(filepath.Join("1", f.name))
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := w.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		} else if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exp := []*FileChecksum{
+		{Name: "a.tsm", Size: 3, SHA256: sha256Hex("foo")},
+		{Name: "b.tsm", Size: 3, SHA256: sha256Hex("bar")},
+	}
+	if got := s.Files(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("exp %v, got %v", exp, got)
+	} else if s.Size() != 6 {
+		t.Fatalf("unexpected size: %d", s.Size())
+	}
+
+	// The file on disk has the checksum recorded.
+	if sum, err := checksumFile(filepath.Join(dir, "1", "a.tsm")); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(sum, exp[0]) {
+		t.Fatalf("exp %v, got %v", exp[0], sum)
+	}
+}
+
+// Ensure a restored shard must match the checksum of the original shard.
+func TestVerifyRestoredShard(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	m := &ConversionManifest{Shards: []*ManifestShard{{
+		Database:        "db0",
+		RetentionPolicy: "default",
+		Path:            "1",
+		Source:          &FileChecksum{Name: "1", Size: 3, SHA256: sha256Hex("foo")},
+	}}}
+
+	MustWriteFile(filepath.Join(dir, "db0", "default", "1"), "foo")
+	if err := verifyRestoredShard(m, dir, filepath.Join("db0", "default", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	MustWriteFile(filepath.Join(dir, "db0", "default", "1"), "fob")
+	if err := verifyRestoredShard(m, dir, filepath.Join("db0", "default", "1")); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Shards not in the manifest are not checked.
+	MustWriteFile(filepath.Join(dir, "db0", "default", "2"), "bar")
+	if err := verifyRestoredShard(m, dir, filepath.Join("db0", "default", "2")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+const (
+	// maxBlocksPerKey is the maximum number of blocks a key may have in a single TSM file.
+	maxBlocksPerKey = 65535
+
+	// indexEntryMemory is the approximate memory used by each block in the
+	// index of a TSM file being written, including its share of the index
+	// once marshaled to be written.
+	indexEntryMemory = 128
+
+	// indexKeyMemory is the approximate memory used by each key in the index
+	// of a TSM file being written, excluding the key itself, which is held
+	// twice once the index is marshaled.
+	indexKeyMemory = 160
+)
+
+// KeyIterator is used to iterate over b* keys for conversion to tsm keys
+type KeyIterator interface {
+	Next() bool
+	Read() (string, []tsm1.Value, error)
+}
+
+// Converter encapsulates the logic for converting b*1 shards to tsm1 shards.
+// Process may be called concurrently, each call writing its own TSM files.
+type Converter struct {
+	path           string
+	maxTSMFileSize uint32
+	sink           Sink
+
+	// MaxIndexMemory is the approximate memory the index of each TSM file
+	// being written may use. The index of a TSM file is held in memory until
+	// the file is complete, so files are completed early, with their blocks
+	// spread across more files, to stay within it. 0 is no limit.
+	MaxIndexMemory uint64
+
+	mu       sync.Mutex
+	sequence int
+}
+
+// NewConverter returns a new instance of the Converter, writing TSM files to
+// the directory at path within sink.
+func NewConverter(path string, sz uint32, sink Sink) *Converter {
+	return &Converter{
+		path:           path,
+		maxTSMFileSize: sz,
+		sink:           sink,
+	}
+}
+
+// Process writes the data provided by iter to a tsm1 shard.
+func (c *Converter) Process(iter KeyIterator) error {
+	// Iterate until no more data remains.
+	var w tsm1.TSMWriter
+	var keyCount map[string]int
+	var indexMemory uint64
+	var prevKey string
+	for iter.Next() {
+		k, v, err := iter.Read()
+		if err != nil {
+			return err
+		}
+
+		// Keys must be written to a TSM file in order, so start a new file
+		// if the iterator moves backwards.
+		if w != nil && k < prevKey {
+			if err := c.closeTSMWriter(w); err != nil {
+				return err
+			}
+			w = nil
+		}
+		prevKey = k
+
+		if w == nil {
+			w, err = c.nextTSMWriter()
+			if err != nil {
+				return err
+			}
+			keyCount = map[string]int{}
+			indexMemory = 0
+		}
+		if err := w.Write(k, v); err != nil {
+			return err
+		}
+		keyCount[k]++
+		indexMemory += indexEntryMemory
+		if keyCount[k] == 1 {
+			indexMemory += indexKeyMemory + 2*uint64(len(k))
+		}
+
+		// If we're over the max file size, the key can't take another block,
+		// or the index is too large to hold in memory, start a new TSM file.
+		if w.Size() > c.maxTSMFileSize || keyCount[k] == maxBlocksPerKey ||
+			(c.MaxIndexMemory > 0 && indexMemory >= c.MaxIndexMemory) {
+			if err := c.closeTSMWriter(w); err != nil {
+				return err
+			}
+			w = nil
+		}
+	}
+
+	if w != nil {
+		return c.closeTSMWriter(w)
+	}
+	return nil
+}
+
+// nextTSMWriter returns the next TSMWriter for the Converter.
+func (c *Converter) nextTSMWriter() (tsm1.TSMWriter, error) {
+	c.mu.Lock()
+	c.sequence++
+	fileName := filepath.Join(c.path, fmt.Sprintf("%09d-%09d.%s", 1, c.sequence, tsm1.TSMFileExtension))
+	c.mu.Unlock()
+
+	f, err := c.sink.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the writer for the new TSM file.
+	w, err := tsm1.NewTSMWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// closeTSMWriter writes the index of the current TSM file and closes it.
+func (c *Converter) closeTSMWriter(w tsm1.TSMWriter) error {
+	if err := w.WriteIndex(); err != nil && err != tsm1.ErrNoValues {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
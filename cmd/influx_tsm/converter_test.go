@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// Ensure the converter writes every key and value to TSM files.
+func TestConverter_Process(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	iter := &sliceIterator{
+		keys: []string{"cpu#!~#value", "cpu#!~#value", "mem#!~#free"},
+		values: [][]tsm1.Value{
+			{tsm1.NewValue(time.Unix(1, 0), 1.0), tsm1.NewValue(time.Unix(2, 0), 2.0)},
+			{tsm1.NewValue(time.Unix(3, 0), 3.0)},
+			{tsm1.NewValue(time.Unix(1, 0), int64(100))},
+		},
+	}
+
+	path := filepath.Join(dir, "1")
+	if err := NewConverter("1", maxTSMSz, NewDirSink(dir)).Process(iter); err != nil {
+		t.Fatal(err)
+	}
+
+	r := MustOpenTSMReader(filepath.Join(path, "000000001-000000001.tsm"))
+	defer r.Close()
+
+	if keys := r.Keys(); !reflect.DeepEqual(keys, []string{"cpu#!~#value", "mem#!~#free"}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	values, err := r.ReadAll("cpu#!~#value")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(values) != 3 || values[2].Value() != 3.0 {
+		t.Fatalf("unexpected values: %v", values)
+	}
+}
+
+// Ensure the converter rolls over to a new TSM file once the size limit is reached.
+func TestConverter_Process_MaxFileSize(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	iter := &sliceIterator{
+		keys: []string{"cpu#!~#value", "mem#!~#free"},
+		values: [][]tsm1.Value{
+			{tsm1.NewValue(time.Unix(1, 0), 1.0)},
+			{tsm1.NewValue(time.Unix(1, 0), int64(100))},
+		},
+	}
+
+	path := filepath.Join(dir, "1")
+	if err := NewConverter("1", 1, NewDirSink(dir)).Process(iter); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*."+tsm1.TSMFileExtension))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != 2 {
+		t.Fatalf("unexpected file count: %d", len(files))
+	}
+}
+
+// Ensure the converter rolls over to a new TSM file once the index memory limit is reached.
+func TestConverter_Process_MaxIndexMemory(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	iter := &sliceIterator{keys: []string{"a#!~#v", "b#!~#v", "c#!~#v", "d#!~#v"}}
+	for range iter.keys {
+		iter.values = append(iter.values, []tsm1.Value{tsm1.NewValue(time.Unix(1, 0), 1.0)})
+	}
+
+	// Each file's index may hold two keys of a single block.
+	c := NewConverter("1", maxTSMSz, NewDirSink(dir))
+	c.MaxIndexMemory = 2 * (indexEntryMemory + indexKeyMemory + 2*uint64(len("a#!~#v")))
+	if err := c.Process(iter); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "1", "*."+tsm1.TSMFileExtension))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != 2 {
+		t.Fatalf("unexpected file count: %d", len(files))
+	}
+}
+
+// Ensure the converter starts a new TSM file when keys are out of order.
+func TestConverter_Process_UnorderedKeys(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	iter := &sliceIterator{
+		keys: []string{"mem#!~#free", "cpu#!~#value"},
+		values: [][]tsm1.Value{
+			{tsm1.NewValue(time.Unix(1, 0), int64(100))},
+			{tsm1.NewValue(time.Unix(1, 0), 1.0)},
+		},
+	}
+
+	if err := NewConverter("1", maxTSMSz, NewDirSink(dir)).Process(iter); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "1", "*."+tsm1.TSMFileExtension))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != 2 {
+		t.Fatalf("unexpected file count: %d", len(files))
+	}
+}
+
+// sliceIterator is a KeyIterator over in-memory keys and values.
+type sliceIterator struct {
+	keys   []string
+	values [][]tsm1.Value
+	i      int
+}
+
+func (itr *sliceIterator) Next() bool {
+	itr.i++
+	return itr.i <= len(itr.keys)
+}
+
+func (itr *sliceIterator) Read() (string, []tsm1.Value, error) {
+	return itr.keys[itr.i-1], itr.values[itr.i-1], nil
+}
+
+// MustTempDir returns a new temporary directory. Panic on error.
+func MustTempDir() string {
+	dir, err := ioutil.TempDir("", "influx_tsm-")
+	if err != nil {
+		panic(err)
+	}
+	return dir
+}
+
+// MustOpenTSMReader returns a reader for the TSM file at path. Panic on error.
+func MustOpenTSMReader(path string) *tsm1.TSMReader {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
@@ -0,0 +1,92 @@
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// diskFree returns the number of bytes available to the user on the
+// filesystem holding path.
+func diskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// diskUsage returns the fraction of the filesystem holding path in use, as
+// reported by df, not counting the space reserved for root as free.
+func diskUsage(path string) (float64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	used := uint64(st.Blocks) - uint64(st.Bfree)
+	if used+uint64(st.Bavail) == 0 {
+		return 0, nil
+	}
+	return float64(used) / float64(used+uint64(st.Bavail)), nil
+}
+
+// writable returns whether path can be written to. It is false for paths
+// on read-only filesystems.
+func writable(path string) bool {
+	const W_OK = 2 // not defined by package syscall
+	return syscall.Access(path, W_OK) == nil
+}
+
+// volumeID returns an identifier of the filesystem holding path, which is
+// the same for every path on that filesystem.
+func volumeID(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+	return fmt.Sprint(st.Dev), nil
+}
+
+// fileLocked returns whether another process holds an exclusive lock on the
+// file at path, as influxd does on each shard it has open.
+func fileLocked(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// processAlive returns whether the process with the ID is running.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// processUsage returns the user and system CPU time of the process, and its
+// peak resident set size in bytes.
+func processUsage() (time.Duration, int64, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0, err
+	}
+	cpu := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+
+	// Linux reports the peak in kilobytes, Darwin in bytes.
+	rss := int64(ru.Maxrss)
+	if runtime.GOOS != "darwin" {
+		rss *= 1024
+	}
+	return cpu, rss, nil
+}
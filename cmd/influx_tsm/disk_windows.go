@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// diskFree is not supported on Windows.
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("free disk space check not supported on windows")
+}
+
+// diskUsage is not supported on Windows.
+func diskUsage(path string) (float64, error) {
+	return 0, errors.New("disk usage check not supported on windows")
+}
+
+// writable returns true, as read-only filesystems are not detected on Windows.
+func writable(path string) bool { return true }
+
+// volumeID returns the volume name of path, such as "C:".
+func volumeID(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(filepath.VolumeName(abs)), nil
+}
+
+// fileLocked returns false, as locks are not detected on Windows.
+func fileLocked(path string) (bool, error) { return false, nil }
+
+// processAlive returns whether the process with the ID is running.
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
+
+// processUsage is not supported on Windows.
+func processUsage() (time.Duration, int64, error) {
+	return 0, 0, errors.New("process resource usage not supported on windows")
+}
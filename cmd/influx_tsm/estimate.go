@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// estimateSampleKeys is the number of keys of each shard read to estimate
+// the size of the shard once converted.
+const estimateSampleKeys = 1000
+
+// tsmFileOverhead is the size of the header and footer of a TSM file.
+const tsmFileOverhead = 5 + 8
+
+// ShardEstimate is the estimated size of a shard once converted.
+type ShardEstimate struct {
+	Shard *tsdb.ShardInfo
+
+	// Keys is the number of keys in the shard, and Sampled the number read.
+	Keys    int
+	Sampled int
+
+	// Size is the estimated size of the TSM files of the shard.
+	Size int64
+}
+
+// Ratio returns the estimated size of the converted shard, relative to its
+// size now.
+func (e *ShardEstimate) Ratio() float64 {
+	if e.Shard.Size == 0 {
+		return 0
+	}
+	return float64(e.Size) / float64(e.Shard.Size)
+}
+
+// estimateShard estimates the size of the shard once converted, by encoding
+// a sample of its keys, spread across its measurements, as TSM blocks, and
+// scaling their size to every key in the shard.
+func estimateShard(si *tsdb.ShardInfo) (*ShardEstimate, error) {
+	reader, err := newShardReader(si)
+	if err != nil {
+		return nil, err
+	}
+	if err := reader.Open(); err != nil {
+		return nil, fmt.Errorf("open %v shard: %v", si.FormatAsString(), err)
+	}
+	defer reader.Close()
+
+	e := &ShardEstimate{Shard: si, Keys: reader.KeyN()}
+	if e.Keys == 0 {
+		return e, nil
+	}
+
+	// Sample every measurement, or an even spread of them if there are more
+	// than keys to sample, reading the first keys of each.
+	measurements := reader.Measurements()
+	step := 1
+	if len(measurements) > estimateSampleKeys {
+		step = len(measurements) / estimateSampleKeys
+	}
+	perMeasurement := estimateSampleKeys / ((len(measurements) + step - 1) / step)
+	if perMeasurement < 1 {
+		perMeasurement = 1
+	}
+
+	var sampled int64
+	for i := 0; i < len(measurements); i += step {
+		itr, err := reader.MeasurementIterator(measurements[i])
+		if err != nil {
+			return nil, err
+		}
+		n, sz, err := sampleKeys(itr, perMeasurement)
+		itr.Close()
+		if err != nil {
+			return nil, err
+		}
+		e.Sampled += n
+		sampled += sz
+	}
+
+	if e.Sampled > 0 {
+		e.Size = tsmFileOverhead + sampled*int64(e.Keys)/int64(e.Sampled)
+	}
+	return e, nil
+}
+
+// sampleKeys encodes the values of up to n keys read from itr as TSM blocks,
+// as the converter does, and returns the number of keys read and the size
+// of their blocks and index entries.
+func sampleKeys(itr KeyIterator, n int) (int, int64, error) {
+	var keys int
+	var sz int64
+	var prevKey string
+	for itr.Next() {
+		k, v, err := itr.Read()
+		if err != nil {
+			return 0, 0, err
+		}
+		if k != prevKey {
+			if keys == n {
+				break
+			}
+			keys++
+			prevKey = k
+
+			// Key length, key, block type and block count.
+			sz += int64(2 + len(k) + 1 + 2)
+		}
+
+		block, err := tsm1.Values(v).Encode(nil)
+		if err != nil {
+			return 0, 0, err
+		}
+		// Checksum, block, and the block's index entry.
+		sz += int64(4+len(block)) + 28
+	}
+	return keys, sz, nil
+}
+
+// printEstimates estimates the size of each shard once converted, and prints
+// them with their total. It returns false if any shard could not be read.
+func printEstimates(w io.Writer, shards tsdb.ShardInfos) bool {
+	ok := true
+	var before, after int64
+
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "Database\tRetention\tPath\tEngine\tSize\tKeys Sampled\tEstimated Size\tRatio")
+	for _, si := range shards {
+		e, err := estimateShard(si)
+		if err != nil {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%d\t-\tcannot read shard: %v\t-\n", si.Database, si.RetentionPolicy, si.FullPath(opts.DataPath), si.FormatAsString(), si.Size, err)
+			ok = false
+			continue
+		}
+		before += si.Size
+		after += e.Size
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%d\t%d/%d\t%d\t%.1f%%\n", si.Database, si.RetentionPolicy, si.FullPath(opts.DataPath), si.FormatAsString(), si.Size, e.Sampled, e.Keys, e.Size, 100*e.Ratio())
+	}
+	tw.Flush()
+
+	var ratio float64
+	if before > 0 {
+		ratio = float64(after) / float64(before)
+	}
+	fmt.Fprintf(w, "\n%d shard(s), totalling %d bytes, are estimated to convert to %d bytes (%.1f%%).\n", len(shards), before, after, 100*ratio)
+	return ok
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// Ensure sampled keys are sized as the converter writes them.
+func TestSampleKeys(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	keys := []string{"cpu#!~#value", "cpu#!~#value", "mem#!~#free", "mem#!~#used"}
+	values := [][]tsm1.Value{
+		{tsm1.NewValue(time.Unix(1, 0), 1.0), tsm1.NewValue(time.Unix(2, 0), 2.0)},
+		{tsm1.NewValue(time.Unix(3, 0), 3.0)},
+		{tsm1.NewValue(time.Unix(1, 0), int64(100))},
+		{tsm1.NewValue(time.Unix(1, 0), int64(200))},
+	}
+
+	if err := NewConverter("1", maxTSMSz, NewDirSink(dir)).Process(&sliceIterator{keys: keys[:3], values: values[:3]}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "1", "000000001-000000001.tsm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first two keys are sampled.
+	n, sz, err := sampleKeys(&sliceIterator{keys: keys, values: values}, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected key count: %d", n)
+	} else if tsmFileOverhead+sz != fi.Size() {
+		t.Fatalf("unexpected size: %d, converted to %d", tsmFileOverhead+sz, fi.Size())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// unfinishedShard returns the shard whose converted copy is the file which
+// is not a shard, if it is the directory a run converting in-place writes
+// the shard to before swapping it in. Such a directory is left beside the
+// shard by a run interrupted before the swap.
+func unfinishedShard(e *tsdb.ShardError) (*tsdb.ShardInfo, bool) {
+	if !opts.InPlace() || outputDir() != "" {
+		return nil, false
+	}
+	id := strings.TrimSuffix(e.Path, "."+tsmExt)
+	if id == e.Path || !tsdb.ValidShardName(id) {
+		return nil, false
+	}
+	si := &tsdb.ShardInfo{Database: e.Database, RetentionPolicy: e.RetentionPolicy, Path: id}
+	if fi, err := os.Lstat(si.FullPath(opts.DataPath) + "." + tsmExt); err != nil || !fi.IsDir() {
+		return nil, false
+	}
+	return si, true
+}
+
+// finishShard swaps in the converted copy of the shard left beside it by a
+// run interrupted before the swap, rather than converting the shard again.
+// The copy is first verified against the shard with the counts verifier and
+// -verify, and false is returned if it fails, or there is no copy, for the
+// shard to be converted again. The checksums of the copy's files are recorded
+// in out, and its values counted with counter.
+func finishShard(si *tsdb.ShardInfo, trash *Trash, out *checksumSink, counter *valueCounter) (bool, error) {
+	rel := filepath.Join(si.Database, si.RetentionPolicy, si.Path)
+	src := si.FullPath(opts.DataPath)
+	dst := fmt.Sprintf("%v.%v", src, tsmExt)
+	if fi, err := os.Lstat(dst); err != nil || !fi.IsDir() {
+		return false, nil
+	}
+
+	names := []string{"counts"}
+	for _, name := range opts.Verify {
+		if name != "counts" {
+			names = append(names, name)
+		}
+	}
+	if err := verifyShard(si, dst, names); err != nil {
+		logger.Warnf("Converting %v again, as its converted copy left by an interrupted run is incomplete: %v\n", src, err)
+		return false, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dst, "*."+tsm1.TSMFileExtension))
+	if err != nil {
+		return false, err
+	}
+	for _, path := range paths {
+		f, err := checksumFile(path)
+		if err != nil {
+			return false, err
+		}
+		out.add(f)
+	}
+	if err := countShard(dst, counter); err != nil {
+		return false, err
+	}
+
+	logger.Infof("Swapping in the converted copy of %v left by an interrupted run\n", src)
+	if err := replaceShard(trash, rel, dst); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// countShard counts the values of the converted shard in the directory dir.
+func countShard(dir string, counter *valueCounter) error {
+	s, err := OpenTSMShard(dir)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	for _, k := range s.Keys() {
+		values, err := s.ReadAll(k)
+		if err != nil {
+			return err
+		}
+		counter.add(k, len(values))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Ensure the converted copy of a shard left by an interrupted run is
+// verified and swapped in, rather than converting the shard again.
+func TestConvert_Unfinished(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	outPath := MustTempDir()
+	defer os.RemoveAll(outPath)
+	shard := filepath.Join(dataPath, "db0", "default", "1")
+	MustCreateBZ1Shard(shard, "cpu value=1 1000000000", "cpu value=2 2000000000")
+
+	// Convert the shard elsewhere, and leave it beside the shard as an
+	// interrupted run would.
+	if output, code := RunConvert("", "-y", "-out", outPath, dataPath); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	}
+	dst := shard + "." + tsmExt
+	if err := os.Rename(filepath.Join(outPath, "db0", "default", "1"), dst); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dst, "*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected files: %v, %v", files, err)
+	}
+	fi, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, code := RunConvert("", "-y", "-nobackup", dataPath)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	} else if !strings.Contains(output, "1 shard(s) were converted by an interrupted run") {
+		t.Fatalf("converted copy not reported: %s", output)
+	} else if strings.Contains(output, "not shard IDs") {
+		t.Fatalf("converted copy reported as not a shard: %s", output)
+	}
+	if m := MustReadTSMShard(shard); !reflect.DeepEqual(m, map[string][]interface{}{"cpu#!~#value": {1.0, 2.0}}) {
+		t.Fatalf("unexpected values: %v", m)
+	}
+
+	// The copy's file is swapped in, rather than written again.
+	if after, err := os.Stat(filepath.Join(shard, filepath.Base(files[0]))); err != nil {
+		t.Fatal(err)
+	} else if !os.SameFile(fi, after) {
+		t.Fatal("shard converted again")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("converted copy not swapped in: %v", err)
+	}
+}
+
+// Ensure a shard is converted again if the copy left by an interrupted run
+// is incomplete.
+func TestConvert_UnfinishedIncomplete(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	shard := filepath.Join(dataPath, "db0", "default", "1")
+	MustCreateBZ1Shard(shard, "cpu value=1 1000000000", "cpu value=2 2000000000")
+	if err := os.MkdirAll(shard+"."+tsmExt, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	output, code := RunConvert("", "-y", "-nobackup", dataPath)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	}
+	if m := MustReadTSMShard(shard); !reflect.DeepEqual(m, map[string][]interface{}{"cpu#!~#value": {1.0, 2.0}}) {
+		t.Fatalf("unexpected values: %v", m)
+	}
+	if _, err := os.Stat(shard + "." + tsmExt); !os.IsNotExist(err) {
+		t.Fatalf("incomplete copy not removed: %v", err)
+	}
+}
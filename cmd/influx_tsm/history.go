@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdb/influxdb/tsdb"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// historyFile is the default name of the conversion history, in the output or data directory.
+const historyFile = ".influx_tsm_history"
+
+// keyFieldSeparator separates the series key from the field name in a tsm1 key.
+const keyFieldSeparator = "#!~#"
+
+// ShardRecord records the data of a shard when it was converted, so that
+// the converted shard can be checked once influxd is restarted.
+type ShardRecord struct {
+	Time            time.Time `json:"time"`
+	Database        string    `json:"database"`
+	RetentionPolicy string    `json:"retentionPolicy"`
+	Path            string    `json:"path"`
+	MinTime         time.Time `json:"minTime"`
+	MaxTime         time.Time `json:"maxTime"`
+
+	// Counts is the number of values of each field, by measurement.
+	Counts map[string]map[string]int64 `json:"counts"`
+}
+
+// RunRecord records the resources used by a run, so that later conversions
+// can be sized from it. Unlike shard records, it has no path.
+type RunRecord struct {
+	Time     time.Time `json:"time"`
+	DataPath string    `json:"dataPath"`
+	Shards   int       `json:"shards"`
+	Usage    *Usage    `json:"usage"`
+}
+
+// History is the log of converted shards, and of the resources used by each
+// run, stored as one JSON record per line.
+type History struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewHistory returns the history stored in the file at path.
+func NewHistory(path string) *History {
+	return &History{path: path}
+}
+
+// Append adds the record to the history.
+func (h *History) Append(r *ShardRecord) error {
+	return h.append(r)
+}
+
+// AppendRun adds the record of a run to the history.
+func (h *History) AppendRun(r *RunRecord) error {
+	return h.append(r)
+}
+
+// append adds the record, r, as a line of JSON.
+func (h *History) append(r interface{}) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Records returns the latest record of each shard in the history, in the
+// order they were added.
+func (h *History) Records() ([]*ShardRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var a []*ShardRecord
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		r := &ShardRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return nil, err
+		} else if r.Path == "" {
+			// The record of a run.
+			continue
+		}
+
+		// A shard converted again replaces its earlier record.
+		key := r.Database + "/" + r.RetentionPolicy + "/" + r.Path
+		if i, ok := index[key]; ok {
+			a[i] = r
+			continue
+		}
+		index[key] = len(a)
+		a = append(a, r)
+	}
+	return a, scanner.Err()
+}
+
+// Runs returns the record of each run in the history, in the order they
+// were added.
+func (h *History) Runs() ([]*RunRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var a []*RunRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		r := &RunRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return nil, err
+		} else if r.Usage == nil {
+			// The record of a shard.
+			continue
+		}
+		a = append(a, r)
+	}
+	return a, scanner.Err()
+}
+
+// valueCounter counts the values of each field, by measurement, read from
+// KeyIterators. It is safe for concurrent use.
+type valueCounter struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int64
+}
+
+func newValueCounter() *valueCounter {
+	return &valueCounter{counts: make(map[string]map[string]int64)}
+}
+
+// add counts n values of the tsm1 key.
+func (c *valueCounter) add(key string, n int) {
+	measurement, field := splitKey(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := c.counts[measurement]
+	if m == nil {
+		m = make(map[string]int64)
+		c.counts[measurement] = m
+	}
+	m[field] += int64(n)
+}
+
+// splitKey returns the measurement and field of the tsm1 key.
+func splitKey(key string) (measurement, field string) {
+	series := key
+	if i := strings.Index(key, keyFieldSeparator); i != -1 {
+		series, field = key[:i], key[i+len(keyFieldSeparator):]
+	}
+	return tsdb.MeasurementFromSeriesKey(series), field
+}
+
+// total returns the number of values counted across all keys.
+func (c *valueCounter) total() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int64
+	for _, fields := range c.counts {
+		for _, v := range fields {
+			n += v
+		}
+	}
+	return n
+}
+
+// Iterator returns a KeyIterator counting the values read from itr.
+func (c *valueCounter) Iterator(itr KeyIterator) KeyIterator {
+	return &countingIterator{KeyIterator: itr, counter: c}
+}
+
+// countingIterator is a KeyIterator counting the values read through it.
+type countingIterator struct {
+	KeyIterator
+	counter *valueCounter
+}
+
+func (itr *countingIterator) Read() (string, []tsm1.Value, error) {
+	k, v, err := itr.KeyIterator.Read()
+	if err == nil {
+		itr.counter.add(k, len(v))
+	}
+	return k, v, err
+}
+
+// defaultHistoryFile returns the history file of the data directory, or of
+// the system temporary directory if the data directory is read-only.
+func defaultHistoryFile(dataPath string) string {
+	if writable(dataPath) {
+		return filepath.Join(dataPath, historyFile)
+	}
+	return filepath.Join(os.TempDir(), historyFile)
+}
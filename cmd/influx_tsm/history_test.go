@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// Ensure the history returns the latest record of each shard.
+func TestHistory_Records(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	h := NewHistory(filepath.Join(dir, historyFile))
+	if records, err := h.Records(); err != nil || records != nil {
+		t.Fatalf("unexpected records: %v, %v", records, err)
+	}
+
+	for _, r := range []*ShardRecord{
+		{Database: "db0", RetentionPolicy: "default", Path: "1", Counts: map[string]map[string]int64{"cpu": {"value": 1}}},
+		{Database: "db0", RetentionPolicy: "default", Path: "2"},
+		{Database: "db0", RetentionPolicy: "default", Path: "1", Counts: map[string]map[string]int64{"cpu": {"value": 2}}},
+	} {
+		if err := h.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := h.Records()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(records) != 2 {
+		t.Fatalf("unexpected record count: %d", len(records))
+	} else if records[0].Path != "1" || records[0].Counts["cpu"]["value"] != 2 {
+		t.Fatalf("unexpected record: %+v", records[0])
+	} else if records[1].Path != "2" {
+		t.Fatalf("unexpected record: %+v", records[1])
+	}
+}
+
+// Ensure the records of runs are kept apart from those of shards.
+func TestHistory_Runs(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	h := NewHistory(filepath.Join(dir, historyFile))
+	if err := h.Append(&ShardRecord{Database: "db0", RetentionPolicy: "default", Path: "1"}); err != nil {
+		t.Fatal(err)
+	} else if err := h.AppendRun(&RunRecord{DataPath: "/data", Shards: 1, Usage: &Usage{MaxRSS: 1024}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if records, err := h.Records(); err != nil {
+		t.Fatal(err)
+	} else if len(records) != 1 || records[0].Path != "1" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if runs, err := h.Runs(); err != nil {
+		t.Fatal(err)
+	} else if len(runs) != 1 || runs[0].DataPath != "/data" || runs[0].Usage.MaxRSS != 1024 {
+		t.Fatalf("unexpected runs: %+v", runs)
+	}
+}
+
+// Ensure values read through a counting iterator are counted by measurement and field.
+func TestValueCounter_Iterator(t *testing.T) {
+	v := tsm1.NewValue(time.Unix(1, 0), 1.0)
+	c := newValueCounter()
+	itr := c.Iterator(&sliceIterator{
+		keys: []string{"cpu,host=a#!~#value", "cpu,host=b#!~#value", "mem#!~#free"},
+		values: [][]tsm1.Value{
+			{v, v},
+			{v},
+			{v},
+		},
+	})
+	for itr.Next() {
+		if _, _, err := itr.Read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exp := map[string]map[string]int64{"cpu": {"value": 3}, "mem": {"free": 1}}
+	if !reflect.DeepEqual(c.counts, exp) {
+		t.Fatalf("unexpected counts: %v", c.counts)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+const listUsage = `Usage: influx_tsm list [options] <data-path>
+
+List the shards of the data directory, including those already converted,
+by shard group, with the format, series count and size of each.
+
+Options:`
+
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	var sel selection
+	var card bool
+	opts.selectionFlags(fs, &sel)
+	fs.BoolVar(&opts.JSON, "json", false, "Print the shards as a JSON array.")
+	fs.BoolVar(&card, "cardinality", false, "Also read the measurements and fields of each shard not yet converted, and count its measurements and tsm1 keys.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, listUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) < 1 {
+		return fmt.Errorf("no data directory specified")
+	}
+	opts.DataPath = fs.Args()[0]
+	if err := opts.parseSelection(&sel); err != nil {
+		return err
+	}
+
+	shards, skipped, err := loadShards(&opts)
+	if err != nil {
+		return fmt.Errorf("failed to access data directory at %v: %v", opts.DataPath, err)
+	}
+	for _, e := range skipped {
+		logger.Warnf("Skipping %v: %v\n", filepath.Join(opts.DataPath, e.Database, e.RetentionPolicy, e.Path), e.Err)
+	}
+	shards = opts.Select(shards)
+	if !opts.Before.IsZero() {
+		shards = shards.Before(opts.Before, opts.GroupDuration)
+	}
+
+	if card {
+		cards, err := readCardinalities(shards)
+		if err != nil {
+			return err
+		}
+		if opts.JSON {
+			return json.NewEncoder(os.Stdout).Encode(cards)
+		}
+		printCardinalities(os.Stdout, cards)
+		return nil
+	}
+
+	if opts.JSON {
+		return printShardsJSON(os.Stdout, shards)
+	}
+
+	printShards(os.Stdout, shards)
+	fmt.Printf("\n%d shard(s), %d not yet converted, totalling %d bytes.\n", len(shards), len(shards.Filter(tsdb.TSM1)), shards.Size())
+	return nil
+}
+
+// Cardinality is the number of measurements and tsm1 keys of a shard. The
+// keys of a shard, one for each field of each series, drive the memory of
+// the tsm1 index.
+type Cardinality struct {
+	*tsdb.ShardInfo
+	MeasurementN int `json:"measurementN"`
+	KeyN         int `json:"keyN"`
+}
+
+// readCardinalities returns the cardinality of each shard. Shards already
+// converted are not read, and have none.
+func readCardinalities(shards tsdb.ShardInfos) ([]*Cardinality, error) {
+	a := make([]*Cardinality, 0, len(shards))
+	for _, si := range shards {
+		c := &Cardinality{ShardInfo: si}
+		a = append(a, c)
+		if si.Format == tsdb.TSM1 {
+			continue
+		}
+
+		r, err := newShardReader(si)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.Open(); err != nil {
+			return nil, fmt.Errorf("open %v: %v", si.FullPath(opts.DataPath), err)
+		}
+		c.MeasurementN, c.KeyN = len(r.Measurements()), r.KeyN()
+		r.Close()
+	}
+	return a, nil
+}
+
+// printCardinalities prints a table of the cardinality of each shard, by
+// shard group, and the shard of highest cardinality.
+func printCardinalities(w io.Writer, cards []*Cardinality) {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "Shard Group\tDatabase\tRetention\tPath\tEngine\tEarliest\tLatest\tSeries\tMeasurements\tKeys\tSize")
+
+	var max *Cardinality
+	for _, c := range cards {
+		si := c.ShardInfo
+		group := "-"
+		if start := si.GroupStart(opts.GroupDuration); !start.IsZero() {
+			group = start.Format(time.RFC3339)
+		}
+		if si.Format == tsdb.TSM1 {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t-\t-\t-\t-\t-\t%d\n", group, si.Database, si.RetentionPolicy, si.FullPath(opts.DataPath), si.FormatAsString(), si.Size)
+			continue
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%d\t%d\t%d\t%d\n", group, si.Database, si.RetentionPolicy, si.FullPath(opts.DataPath), si.FormatAsString(),
+			formatShardTime(si.MinTime), formatShardTime(si.MaxTime), si.SeriesN, c.MeasurementN, c.KeyN, si.Size)
+		if max == nil || c.KeyN > max.KeyN {
+			max = c
+		}
+	}
+	tw.Flush()
+
+	if max != nil {
+		fmt.Fprintf(w, "\nHighest cardinality: %v, with %d series, %d measurement(s) and %d keys.\n",
+			max.FullPath(opts.DataPath), max.SeriesN, max.MeasurementN, max.KeyN)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Ensure the shard of most keys is reported, ignoring converted shards.
+func TestPrintCardinalities(t *testing.T) {
+	defer func(o options) { opts = o }(opts)
+	opts = options{DataPath: "/data", GroupDuration: defaultGroupDuration}
+
+	cards := []*Cardinality{
+		{ShardInfo: &tsdb.ShardInfo{Database: "db0", RetentionPolicy: "default", Path: "1", Format: tsdb.B1, SeriesN: 10}, MeasurementN: 2, KeyN: 30},
+		{ShardInfo: &tsdb.ShardInfo{Database: "db0", RetentionPolicy: "default", Path: "2", Format: tsdb.BZ1, SeriesN: 5}, MeasurementN: 1, KeyN: 50},
+		{ShardInfo: &tsdb.ShardInfo{Database: "db1", RetentionPolicy: "default", Path: "3", Format: tsdb.TSM1}},
+	}
+
+	var buf bytes.Buffer
+	printCardinalities(&buf, cards)
+	if !strings.Contains(buf.String(), "Highest cardinality: /data/db0/default/2, with 5 series, 1 measurement(s) and 50 keys.") {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+// Ensure shards are listed with the times of their earliest and latest points.
+func TestPrintShards(t *testing.T) {
+	defer func(o options) { opts = o }(opts)
+	opts = options{DataPath: "/data", GroupDuration: defaultGroupDuration}
+
+	var buf bytes.Buffer
+	printShards(&buf, tsdb.ShardInfos{
+		{Database: "db0", RetentionPolicy: "default", Path: "1", Format: tsdb.B1, MinTime: time.Date(2016, 1, 4, 1, 0, 0, 0, time.UTC), MaxTime: time.Date(2016, 1, 10, 23, 0, 0, 0, time.UTC)},
+		{Database: "db0", RetentionPolicy: "default", Path: "2", Format: tsdb.TSM1},
+	})
+	out := strings.Join(strings.Fields(buf.String()), " ")
+	if !strings.Contains(out, "b1 2016-01-04T01:00:00Z 2016-01-10T23:00:00Z") {
+		t.Fatalf("missing time range:\n%s", buf.String())
+	} else if !strings.Contains(out, "tsm1 - -") {
+		t.Fatalf("missing unknown time range:\n%s", buf.String())
+	}
+}
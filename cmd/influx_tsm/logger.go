@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// String returns the name of the level, as given to -log-level.
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level of the given name.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be one of %v", s, strings.Join(levelNames, ", "))
+}
+
+// Logger writes messages of at least its level to the standard logger, and
+// to its log file if one is open. Lines of the log file are timestamped and
+// leveled, so that they can be searched after the run.
+type Logger struct {
+	mu    sync.Mutex
+	level Level
+	file  *os.File
+
+	// Quiet logs only warnings and errors to the standard logger. The log
+	// file, if any, still receives every message of at least the level.
+	Quiet bool
+}
+
+// NewLogger returns a logger of messages of at least level.
+func NewLogger(level Level) *Logger {
+	return &Logger{level: level}
+}
+
+// OpenFile appends log messages to the file at path, as well as to the
+// standard logger.
+func (l *Logger) OpenFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file = f
+	return nil
+}
+
+// Close closes the log file, if any.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Debugf logs the detail of a step of the conversion.
+func (l *Logger) Debugf(format string, v ...interface{}) { l.logf(LevelDebug, format, v...) }
+
+// Infof logs the progress of the conversion.
+func (l *Logger) Infof(format string, v ...interface{}) { l.logf(LevelInfo, format, v...) }
+
+// Warnf logs a failure which the conversion continues past.
+func (l *Logger) Warnf(format string, v ...interface{}) { l.logf(LevelWarn, format, v...) }
+
+// Errorf logs a failure to convert.
+func (l *Logger) Errorf(format string, v ...interface{}) { l.logf(LevelError, format, v...) }
+
+func (l *Logger) logf(level Level, format string, v ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := strings.TrimRight(fmt.Sprintf(format, v...), "\n")
+	if !l.Quiet || level >= LevelWarn {
+		log.Println(msg)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		fmt.Fprintf(l.file, "%v %-5v %v\n", time.Now().UTC().Format(time.RFC3339Nano), strings.ToUpper(level.String()), msg)
+	}
+}
+
+// logger logs the steps of the current run.
+var logger = NewLogger(LevelInfo)
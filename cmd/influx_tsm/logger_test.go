@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Ensure log levels are parsed by name, regardless of case.
+func TestParseLevel(t *testing.T) {
+	for _, tt := range []struct {
+		s     string
+		level Level
+		err   bool
+	}{
+		{s: "debug", level: LevelDebug},
+		{s: "info", level: LevelInfo},
+		{s: "WARN", level: LevelWarn},
+		{s: "error", level: LevelError},
+		{s: "trace", err: true},
+		{s: "", err: true},
+	} {
+		level, err := ParseLevel(tt.s)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.s, err)
+		} else if level != tt.level {
+			t.Errorf("%q: exp %v, got %v", tt.s, tt.level, level)
+		}
+	}
+}
+
+// Ensure messages below the level are dropped, and others written to the
+// log file with their time and level.
+func TestLogger_OpenFile(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	var stderr bytes.Buffer
+	log.SetOutput(&stderr)
+	defer log.SetOutput(os.Stderr)
+
+	path := filepath.Join(dir, "influx_tsm.log")
+	l := NewLogger(LevelInfo)
+	if err := l.OpenFile(path); err != nil {
+		t.Fatal(err)
+	}
+	l.Debugf("reading %v\n", "db0")
+	l.Infof("converted %v\n", "db0")
+	l.Errorf("failed %v", "db1")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected log file:\n%s", b)
+	}
+	for i, exp := range []string{"INFO  converted db0", "ERROR failed db1"} {
+		fields := strings.SplitN(lines[i], " ", 2)
+		if _, err := time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+			t.Fatalf("unexpected time: %v", err)
+		} else if fields[1] != exp {
+			t.Fatalf("exp %q, got %q", exp, fields[1])
+		}
+	}
+
+	if s := stderr.String(); strings.Contains(s, "reading") || !strings.Contains(s, "converted db0\n") || !strings.Contains(s, "failed db1\n") {
+		t.Fatalf("unexpected stderr:\n%s", s)
+	}
+}
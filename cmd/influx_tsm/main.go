@@ -0,0 +1,1801 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/b1"
+	"github.com/influxdb/influxdb/cmd/influx_tsm/bz1"
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// backupExt is the extension used for the backup of a database.
+const backupExt = "bak"
+
+// tsmExt is the extension used for a shard while it is being converted.
+const tsmExt = "tsm"
+
+// cacheFile is the default name of the shard metadata cache, in the output or data directory.
+const cacheFile = ".influx_tsm_cache"
+
+// maxTSMSz is the default maximum size of a single TSM file.
+const maxTSMSz = 2 * 1000 * 1000 * 1000
+
+// defaultTrashRetention is the default time deleted files are kept in the trash.
+const defaultTrashRetention = 7 * 24 * time.Hour
+
+// defaultGroupDuration is the default shard group duration of a retention policy.
+const defaultGroupDuration = 7 * 24 * time.Hour
+
+// defaultRetryBackoff is the default delay before the first retry of a shard.
+const defaultRetryBackoff = time.Second
+
+// maxRetryBackoff is the longest delay between retries of a shard.
+const maxRetryBackoff = time.Minute
+
+var description = fmt.Sprintf(`
+Convert a database from b1 or bz1 format to tsm1 format.
+
+This tool will backup any directory before conversion. It is up to the
+end-user to delete the backup on the disk, once the end-user is happy
+with the converted data. Backups are named by suffixing the database
+name with '.%v', and are written to the data directory unless another
+is given with -backup-dir. The backups will be ignored by the system
+since they are not registered with the cluster.
+
+To restore a backup, stop the node and run the restore command. Once the
+converted data is checked, delete the backups with the clean command.
+Run 'influx_tsm help' to list every command.`, backupExt)
+
+type options struct {
+	DataPath string
+	DBs      []string
+	ExcDBs   []string
+	RPs      []string
+	Shards   []string
+	TSMSize  uint64
+	SinkCmd  string
+	Out      string
+	Parallel int
+	DryRun   bool
+	Estimate bool
+	Yes      bool
+	JSON     bool
+	Quiet    bool
+
+	SkipErrors    bool
+	Salvage       bool
+	RenameInvalid bool
+	Retries       int
+	RetryBackoff  time.Duration
+
+	CacheFile          string
+	HistoryFile        string
+	SummaryJSON        string
+	ConversionManifest string
+	CheckpointFile     string
+	BackupDir          string
+	TargetDir          string
+
+	BackupCompress bool
+	BackupHardlink bool
+	BackupS3       string
+	S3Endpoint     string
+	NoBackup       bool
+	Bloom          bool
+	Verify         []string
+	TypeConflict   TypeConflict
+
+	TrashRetention time.Duration
+
+	MailTo     []string
+	MailFrom   string
+	SMTPServer string
+
+	LogFile  string
+	LogLevel Level
+
+	MetricsAddr string
+	RateLimit   float64
+	MaxMemory   uint64
+
+	StopAtDiskUsage float64
+
+	Force       bool
+	PIDFile     string
+	InfluxdAddr string
+
+	MeasurementParallel int
+	DatabaseParallel    int
+	Profile             string
+	Order               Order
+
+	GroupDuration time.Duration
+	Before        time.Time
+	SkipOlderThan time.Duration
+}
+
+// selection holds the values of the flags selecting shards, shared by the
+// commands which operate on shards, until they are parsed.
+type selection struct {
+	dbs, excDBs, rps, shards, before string
+}
+
+// selectionFlags registers the flags selecting shards, and where shard
+// metadata is cached, on fs.
+func (o *options) selectionFlags(fs *flag.FlagSet, sel *selection) {
+	fs.StringVar(&sel.dbs, "dbs", "", "Comma-delimited list of databases. Default is all databases.")
+	fs.StringVar(&sel.excDBs, "exclude-dbs", "", "Comma-delimited list of databases to exclude.")
+	fs.StringVar(&sel.rps, "rp", "", "Comma-delimited list of retention policies. Default is all retention policies.")
+	fs.StringVar(&sel.shards, "shards", "", "Comma-delimited list of shard IDs. Default is all shards.")
+	fs.DurationVar(&o.GroupDuration, "group-duration", defaultGroupDuration, "Shard group duration used to group shards by time.")
+	fs.StringVar(&sel.before, "before", "", "Only select shard groups ending at or before this time, as YYYY-MM-DD or RFC3339.")
+	fs.StringVar(&o.CacheFile, "cache-file", "", "File caching shard metadata between runs. Default is '"+cacheFile+"' in the output or data directory, if writable.")
+}
+
+// parseSelection parses the flags selecting shards, once the data path is known.
+func (o *options) parseSelection(sel *selection) error {
+	if o.CacheFile == "" {
+		o.CacheFile = o.stateFile(cacheFile)
+	}
+
+	if o.GroupDuration <= 0 {
+		return fmt.Errorf("bad shard group duration %v", o.GroupDuration)
+	}
+
+	if sel.before != "" {
+		t, err := parseTime(sel.before)
+		if err != nil {
+			return fmt.Errorf("bad time for -before: %v", err)
+		}
+		o.Before = t
+	}
+
+	// Check if specific databases were requested.
+	o.DBs = strings.Split(sel.dbs, ",")
+	if len(o.DBs) == 1 && o.DBs[0] == "" {
+		o.DBs = nil
+	}
+
+	if sel.excDBs != "" {
+		o.ExcDBs = strings.Split(sel.excDBs, ",")
+	}
+
+	// Check if specific retention policies were requested.
+	o.RPs = strings.Split(sel.rps, ",")
+	if len(o.RPs) == 1 && o.RPs[0] == "" {
+		o.RPs = nil
+	}
+
+	// Check if specific shards were requested.
+	o.Shards = strings.Split(sel.shards, ",")
+	if len(o.Shards) == 1 && o.Shards[0] == "" {
+		o.Shards = nil
+	}
+	for _, id := range o.Shards {
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			return fmt.Errorf("bad shard ID %q", id)
+		}
+	}
+
+	return nil
+}
+
+// Parse parses the options of the convert command from args.
+func (o *options) Parse(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+
+	var sel selection
+	var mailTo, verify, rateLimit, maxMemory, stopAtDiskUsage, skipOlderThan, logLevel, typeConflict, order string
+
+	o.selectionFlags(fs, &sel)
+	fs.Uint64Var(&o.TSMSize, "sz", maxTSMSz, "Maximum size of individual TSM files.")
+	fs.IntVar(&o.Parallel, "parallel", 1, "Number of shards to convert concurrently.")
+	fs.IntVar(&o.MeasurementParallel, "measurement-parallel", 1, "Number of measurements within each shard to convert concurrently.")
+	fs.IntVar(&o.DatabaseParallel, "database-parallel", 0, "Maximum number of shards of each database to convert concurrently, within -parallel. 0 is no limit.")
+	fs.IntVar(&o.DatabaseParallel, "max-parallel-per-db", 0, "Alias of -database-parallel.")
+	fs.StringVar(&order, "order", "db-order", "Order to convert shards in, one of db-order, largest-first, smallest-first, oldest-first or newest-first. db-order converts each database in turn, and the time orders are by the earliest or latest point of each shard.")
+	fs.StringVar(&rateLimit, "rate-limit", "", "Maximum rate of disk I/O, reading and writing, such as 50MB/s. Default is no limit.")
+	fs.StringVar(&maxMemory, "max-memory", "", "Approximate memory the conversion may use, such as 2GB, shared by every shard and measurement converted at once. The series keys of the shards are held beyond it. Default is no limit.")
+	fs.StringVar(&stopAtDiskUsage, "stop-at-disk-usage", "", "Pause before converting each shard while the disk converted shards are written to is this full, such as 90%, resuming once space is freed. Default is no limit.")
+	fs.StringVar(&o.Profile, "profile", "", "Concurrency profile, one of conservative, balanced or aggressive, setting -parallel and -measurement-parallel only. Options given explicitly take precedence.")
+	fs.StringVar(&mailTo, "mail-to", "", "Comma-delimited list of addresses to email the summary of the run, and any failure, to.")
+	fs.StringVar(&o.MailFrom, "mail-from", defaultMailFrom(), "Address to send email from.")
+	fs.StringVar(&o.SMTPServer, "smtp-server", "localhost:25", "SMTP server, as host:port, to send email through.")
+	fs.StringVar(&o.LogFile, "log-file", "", "File to append a timestamped log of each step of the run to, as well as logging to stderr.")
+	fs.StringVar(&logLevel, "log-level", "info", "Least severe messages to log, one of debug, info, warn or error. debug logs each step of converting each shard.")
+	fs.StringVar(&o.MetricsAddr, "metrics-addr", "", "Address, as host:port, to serve conversion metrics on at /metrics, in the Prometheus format.")
+	fs.StringVar(&o.HistoryFile, "history-file", "", "File recording the data of converted shards, for post-check. Default is '"+historyFile+"' in the output or data directory, if writable.")
+	fs.StringVar(&o.ConversionManifest, "conversion-manifest", "", "File listing every shard processed, its backup, the checksums of its files, and whether it converted, updated at the end of each run. Default is '"+conversionManifestFile+"' in the output or data directory, if writable.")
+	fs.StringVar(&o.SummaryJSON, "summary-json", "", "File to write the summary of the run to, as JSON.")
+	fs.StringVar(&o.CheckpointFile, "checkpoint-file", "", "File recording the progress of a run, so that it can be resumed. Default is '"+checkpointFile+"' in the output or data directory, if writable.")
+	fs.BoolVar(&o.JSON, "json", false, "Same as the list command with -json, kept for existing scripts.")
+	fs.DurationVar(&o.TrashRetention, "trash-retention", defaultTrashRetention, "Permanently delete trashed files older than this when run. 0 keeps them until the trash is emptied.")
+	fs.BoolVar(&o.Yes, "y", false, "Don't ask for confirmation, just convert.")
+	fs.BoolVar(&o.Yes, "yes", false, "Same as -y.")
+	fs.BoolVar(&o.Quiet, "q", false, "Print only a single line with the result of the run, for scripts. Warnings and errors are still logged to stderr. Requires -y.")
+	fs.BoolVar(&o.DryRun, "dry-run", false, "Describe the conversion, and check disk space, without changing anything.")
+	fs.BoolVar(&o.Estimate, "estimate", false, "Estimate the size of each shard once converted, by sampling its keys, without changing anything.")
+	fs.StringVar(&o.Out, "out", "", "Data directory to write converted shards to, leaving the source untouched. Required if the source is read-only.")
+	fs.StringVar(&o.TargetDir, "target-dir", "", "Directory, such as on another disk, to write converted shards to, swapping them into the data directory as symlinks at the end of the run. Databases are backed up, and original shards trashed, as when converting in-place.")
+	fs.StringVar(&o.BackupDir, "backup-dir", "", "Directory to back up databases to, such as on another disk. Default is the data directory.")
+	fs.BoolVar(&o.BackupCompress, "backup-compress", false, "Back up databases as gzipped tar archives, rather than copies of their directories.")
+	fs.BoolVar(&o.BackupHardlink, "backup-hardlink", false, "Back up databases as hard links to their files, rather than copies. The backup directory must be on the same filesystem as the data directory.")
+	fs.StringVar(&o.BackupS3, "backup-s3", "", "Back up databases to S3, as gzipped tar archives under bucket/prefix, rather than to local disk. Credentials and region are read from the AWS_* environment variables.")
+	fs.StringVar(&o.S3Endpoint, "s3-endpoint", "", "URL of the S3 service for -backup-s3, such as of a compatible store. Default is the S3 endpoint of the region.")
+	fs.BoolVar(&o.NoBackup, "nobackup", false, "Don't back up databases before converting them in-place. Only the trash allows converted shards to be rolled back.")
+	fs.BoolVar(&o.Bloom, "bloom", false, "Write a bloom filter of the series in each converted shard, for the lookup command.")
+	fs.StringVar(&verify, "verify", "", "Comma-delimited list of verifiers to check each converted shard against its source with, of: "+strings.Join(RegisteredVerifiers(), ", ")+".")
+	fs.StringVar(&typeConflict, "type-conflict", "fail", "Policy for a field typed differently across the shards of a database, one of fail, widen or skip. fail fails every shard holding the field, widen writes the field as a float in every shard if it is only an integer or a float, and skip drops the field from the shards in which it has another type than in the earliest shard.")
+	fs.StringVar(&skipOlderThan, "skip-older-than", "", "Leave shards with no points more recent than this unconverted, such as 2y, as they will soon expire. Units of d, w and y are accepted, as well as those of Go durations.")
+	fs.BoolVar(&o.SkipErrors, "skip-errors", false, "Skip shards which can't be read, and databases which can't be backed up, converting the rest. Skipped shards are listed, and the exit code is 1, at the end.")
+	fs.BoolVar(&o.Salvage, "salvage", false, "Salvage corrupt shards, which are otherwise skipped, by copying the buckets and keys which can still be read to a new shard, which is then converted. The corrupt original is moved to the trash.")
+	fs.BoolVar(&o.RenameInvalid, "rename-invalid", false, "Move files in retention policy directories whose names are not numeric shard IDs, such as editors' backup files, to the trash. They are otherwise listed, and ignored.")
+	fs.IntVar(&o.Retries, "retries", 0, "Number of times to retry converting a shard which fails, such as one briefly locked by another process, before it is marked failed.")
+	fs.DurationVar(&o.RetryBackoff, "retry-backoff", defaultRetryBackoff, "Delay before the first retry of a shard, doubling for each retry after, up to "+maxRetryBackoff.String()+".")
+	fs.BoolVar(&o.Force, "force", false, "Convert even if influxd appears to be running.")
+	fs.StringVar(&o.PIDFile, "pidfile", defaultPIDFile, "PID file of influxd, checked for a running process before converting in-place.")
+	fs.StringVar(&o.InfluxdAddr, "influxd-addr", defaultInfluxdAddr, "Address of the influxd HTTP API, checked for a running influxd before converting in-place.")
+	fs.StringVar(&o.SinkCmd, "sink-cmd", "", "Shell command to stream converted shards to, as a tar archive, instead of converting in-place.")
+
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: influx_tsm [convert] [options] <data-path>")
+		fmt.Fprintf(os.Stderr, "%v\n\nOptions:\n", description)
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if len(fs.Args()) < 1 {
+		return fmt.Errorf("no data directory specified")
+	}
+	o.DataPath = fs.Args()[0]
+
+	if err := o.parseSelection(&sel); err != nil {
+		return err
+	}
+
+	// A profile sets the concurrency options not given explicitly.
+	if o.Profile != "" {
+		p, err := lookupProfile(o.Profile, runtime.NumCPU())
+		if err != nil {
+			return err
+		}
+
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["parallel"] {
+			o.Parallel = p.Parallel
+		}
+		if !set["measurement-parallel"] {
+			o.MeasurementParallel = p.MeasurementParallel
+		}
+	}
+
+	if o.HistoryFile == "" {
+		o.HistoryFile = o.stateFile(historyFile)
+	}
+	if o.ConversionManifest == "" {
+		o.ConversionManifest = o.stateFile(conversionManifestFile)
+	}
+	if o.CheckpointFile == "" {
+		o.CheckpointFile = o.stateFile(checkpointFile)
+	}
+
+	if o.Out != "" && o.SinkCmd != "" {
+		return fmt.Errorf("-out and -sink-cmd cannot both be specified")
+	} else if o.TargetDir != "" && !o.InPlace() {
+		return fmt.Errorf("-target-dir cannot be specified with -out or -sink-cmd")
+	} else if o.Salvage && !o.InPlace() {
+		return fmt.Errorf("-salvage cannot be specified with -out or -sink-cmd, as the source is not modified")
+	} else if o.RenameInvalid && !o.InPlace() {
+		return fmt.Errorf("-rename-invalid cannot be specified with -out or -sink-cmd, as the source is not modified")
+	}
+	if o.TargetDir != "" {
+		// Symlinks to the converted shards must not depend on the working directory.
+		dir, err := filepath.Abs(o.TargetDir)
+		if err != nil {
+			return err
+		}
+		o.TargetDir = dir
+		if within(o.TargetDir, o.DataPath) || within(o.DataPath, o.TargetDir) {
+			return fmt.Errorf("target directory %v must not be within the data directory, or contain it", o.TargetDir)
+		}
+	}
+	if o.BackupDir != "" && !o.InPlace() {
+		return fmt.Errorf("-backup-dir cannot be specified with -out or -sink-cmd, as the source is not backed up")
+	} else if o.BackupCompress && !o.InPlace() {
+		return fmt.Errorf("-backup-compress cannot be specified with -out or -sink-cmd, as the source is not backed up")
+	} else if o.BackupHardlink && !o.InPlace() {
+		return fmt.Errorf("-backup-hardlink cannot be specified with -out or -sink-cmd, as the source is not backed up")
+	} else if o.BackupS3 != "" && !o.InPlace() {
+		return fmt.Errorf("-backup-s3 cannot be specified with -out or -sink-cmd, as the source is not backed up")
+	} else if o.NoBackup && (o.BackupDir != "" || o.BackupCompress || o.BackupHardlink || o.BackupS3 != "") {
+		return fmt.Errorf("-nobackup cannot be specified with -backup-dir, -backup-compress, -backup-hardlink or -backup-s3")
+	} else if o.BackupS3 != "" && (o.BackupDir != "" || o.BackupHardlink) {
+		return fmt.Errorf("-backup-s3 cannot be specified with -backup-dir or -backup-hardlink")
+	} else if o.S3Endpoint != "" && o.BackupS3 == "" {
+		return fmt.Errorf("-s3-endpoint requires -backup-s3")
+	} else if o.BackupHardlink && o.BackupCompress {
+		return fmt.Errorf("-backup-hardlink cannot be specified with -backup-compress, as archives cannot be linked")
+	} else if o.BackupDir != "" && within(o.BackupDir, o.DataPath) {
+		// It would be mistaken for a database by later runs.
+		return fmt.Errorf("backup directory %v must not be within the data directory", o.BackupDir)
+	} else if o.BackupHardlink && o.BackupDir != "" && !sameVolume(o.BackupDir, o.DataPath) {
+		// Hard links can't cross filesystems.
+		return fmt.Errorf("backup directory %v must be on the same filesystem as the data directory for -backup-hardlink", o.BackupDir)
+	}
+	if o.BackupS3 != "" {
+		if _, _, err := parseS3Location(o.BackupS3); err != nil {
+			return err
+		}
+		// Backups are streamed, so can only be archives.
+		o.BackupCompress = true
+	}
+
+	if o.TSMSize > maxTSMSz {
+		return fmt.Errorf("bad TSM file size, maximum TSM file size is %d", maxTSMSz)
+	}
+
+	if o.Parallel < 1 {
+		return fmt.Errorf("bad parallelism %d, at least 1 shard must be converted at a time", o.Parallel)
+	}
+	if o.MeasurementParallel < 1 {
+		return fmt.Errorf("bad measurement parallelism %d, at least 1 measurement must be converted at a time", o.MeasurementParallel)
+	}
+	if o.Retries < 0 {
+		return fmt.Errorf("bad retries %d, must not be negative", o.Retries)
+	} else if o.RetryBackoff < 0 {
+		return fmt.Errorf("bad retry backoff %v, must not be negative", o.RetryBackoff)
+	}
+	if o.DatabaseParallel < 0 {
+		return fmt.Errorf("bad database parallelism %d, must not be negative", o.DatabaseParallel)
+	}
+
+	if o.Quiet && !o.Yes {
+		return fmt.Errorf("-q requires -y, as there is no confirmation prompt to answer")
+	} else if o.Quiet && (o.DryRun || o.Estimate || o.JSON) {
+		return fmt.Errorf("-q cannot be specified with -dry-run, -estimate or -json, which only print")
+	}
+
+	level, err := ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	o.LogLevel = level
+
+	if o.TypeConflict, err = ParseTypeConflict(typeConflict); err != nil {
+		return err
+	}
+	if o.Order, err = ParseOrder(order); err != nil {
+		return err
+	}
+
+	if verify != "" {
+		if o.SinkCmd != "" {
+			return fmt.Errorf("-verify cannot be specified with -sink-cmd, as converted shards are not kept locally")
+		}
+		o.Verify = strings.Split(verify, ",")
+		for _, name := range o.Verify {
+			if _, ok := verifiers[name]; !ok {
+				return fmt.Errorf("unknown verifier %q, must be one of %v", name, strings.Join(RegisteredVerifiers(), ", "))
+			}
+		}
+	}
+
+	if mailTo != "" {
+		o.MailTo = strings.Split(mailTo, ",")
+	}
+
+	if rateLimit != "" {
+		r, err := parseRate(rateLimit)
+		if err != nil {
+			return err
+		}
+		o.RateLimit = r
+	}
+
+	if maxMemory != "" {
+		n, err := parseSize(maxMemory)
+		if err != nil {
+			return fmt.Errorf("bad -max-memory: %v", err)
+		}
+		o.MaxMemory = uint64(n)
+		if o.IndexMemory() < minIndexMemory {
+			return fmt.Errorf("-max-memory of %d bytes is too small to convert %d shard(s) with %d measurement(s) each at once, "+
+				"allow at least %d bytes or lower the parallelism", o.MaxMemory, o.Parallel, o.MeasurementParallel,
+				minIndexMemory*2*uint64(o.Parallel*o.MeasurementParallel))
+		}
+	}
+
+	if skipOlderThan != "" {
+		if o.SkipOlderThan, err = parseAge(skipOlderThan); err != nil {
+			return fmt.Errorf("bad -skip-older-than: %v", err)
+		}
+	}
+
+	if stopAtDiskUsage != "" {
+		if o.StopAtDiskUsage, err = parsePercent(stopAtDiskUsage); err != nil {
+			return fmt.Errorf("bad -stop-at-disk-usage: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// parseTime parses s as either a date or an RFC3339 time.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseAge parses a positive duration, such as "2y", accepting units of days,
+// weeks and years, of 24 hours, 7 days and 365 days, as well as those of
+// time.ParseDuration.
+func parseAge(s string) (time.Duration, error) {
+	for _, u := range []struct {
+		suffix string
+		unit   time.Duration
+	}{{"d", 24 * time.Hour}, {"w", 7 * 24 * time.Hour}, {"y", 365 * 24 * time.Hour}} {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad duration %q, must be positive, such as 2y", s)
+			}
+			return time.Duration(n * float64(u.unit)), nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad duration %q, must be positive, such as 2y", s)
+	}
+	return d, nil
+}
+
+// defaultMailFrom returns the default sender address for email.
+func defaultMailFrom() string {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	return "influx_tsm@" + host
+}
+
+// minIndexMemory is the least memory the index of each TSM file being written
+// may be limited to, below which files would be uselessly small.
+const minIndexMemory = 1000 * 1000
+
+// IndexMemory returns the memory the index of each TSM file being written
+// may use, or 0 if memory is not limited. Every shard and measurement being
+// converted at once writes its own TSM file. Only half of the limit is used,
+// as the Go heap grows to up to twice the memory in use between garbage
+// collections.
+func (o *options) IndexMemory() uint64 {
+	if o.MaxMemory == 0 {
+		return 0
+	}
+	return o.MaxMemory / 2 / uint64(o.Parallel*o.MeasurementParallel)
+}
+
+// Select returns the shards of the databases, retention policies and shard
+// IDs requested.
+func (o *options) Select(shards tsdb.ShardInfos) tsdb.ShardInfos {
+	return shards.
+		ExclusiveDatabases(o.DBs).
+		ExcludeDatabases(o.ExcDBs).
+		ExclusiveRetentionPolicies(o.RPs).
+		ExclusiveShards(o.Shards)
+}
+
+// InPlace returns whether shards are converted in place, rather than
+// written elsewhere leaving the source untouched.
+func (o *options) InPlace() bool {
+	return o.Out == "" && o.SinkCmd == ""
+}
+
+// stateFile returns the default path of the file of the given name, kept
+// between runs. It is kept in the output directory with -out, and in the
+// data directory when converting in-place, as the source must not be
+// modified otherwise. It is kept in the temporary directory if neither can
+// hold it.
+func (o *options) stateFile(name string) string {
+	switch {
+	case o.Out != "":
+		return filepath.Join(o.Out, name)
+	case o.InPlace() && writable(o.DataPath):
+		return filepath.Join(o.DataPath, name)
+	default:
+		return filepath.Join(os.TempDir(), name)
+	}
+}
+
+// Backup returns whether databases are backed up before conversion, which
+// is only needed when converting in-place.
+func (o *options) Backup() bool {
+	return o.InPlace() && !o.NoBackup
+}
+
+// within returns whether path is dir, or below it.
+func within(path, dir string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// BackupPath returns the path the database is backed up to.
+func (o *options) BackupPath(db string) string {
+	if o.BackupS3 != "" {
+		bucket, prefix, _ := parseS3Location(o.BackupS3)
+		return s3Scheme + path.Join(bucket, prefix, db+"."+backupExt+"."+backupArchiveExt)
+	}
+	dir := o.BackupDir
+	if dir == "" {
+		dir = o.DataPath
+	}
+	if o.BackupCompress {
+		return filepath.Join(dir, db+"."+backupExt+"."+backupArchiveExt)
+	}
+	return filepath.Join(dir, db+"."+backupExt)
+}
+
+var opts options
+
+// stdout receives the output of the convert command, discarded by -q.
+var stdout io.Writer = os.Stdout
+
+// stdin is read for the confirmation of the convert command.
+var stdin io.Reader = os.Stdin
+
+// command is a command of the tool, run with the arguments following its name.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+// commands are the commands of the tool. Without a command, shards are converted.
+var commands = []command{
+	{"list", "List the shards of the data directory", runList},
+	{"status", "Summarize the progress of converting the data directory", runStatus},
+	{"convert", "Convert b1 and bz1 shards to tsm1", runConvert},
+	{"verify", "Verify backups against their manifests", runVerify},
+	{"restore", "Restore shards from their backups", runRestore},
+	{"clean", "Delete backups once the converted data is checked", runClean},
+	{"post-check", "Check the data served by InfluxDB against that converted", runPostCheck},
+	{"trash", "List, restore or empty the trash", runTrash},
+	{"lookup", "Find the shards containing a series", runLookup},
+	{"verify-backup", "Verify a single backup against its manifest", runVerifyBackup},
+}
+
+// lookupCommand returns the command with the name, or nil.
+func lookupCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// printCommands prints the usage of the tool, listing its commands.
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "Usage: influx_tsm <command> [options] <data-path>")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %v\t%v\n", c.name, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Without a command, shards are converted. Run 'influx_tsm <command> -h' for the options of a command.")
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "help" {
+		printCommands(os.Stdout)
+		return
+	}
+
+	// Without a command, convert, as before commands were added.
+	c := lookupCommand("convert")
+	if len(args) > 0 {
+		if other := lookupCommand(args[0]); other != nil {
+			c, args = other, args[1:]
+		}
+	}
+
+	if err := c.run(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runConvert converts the selected shards of the data directory to tsm1.
+func runConvert(args []string) error {
+	if err := opts.Parse(args); err != nil {
+		return err
+	}
+
+	log.SetFlags(log.LstdFlags)
+	logger = NewLogger(opts.LogLevel)
+	logger.Quiet = opts.Quiet
+	if opts.Quiet {
+		stdout = ioutil.Discard
+	}
+	if opts.LogFile != "" {
+		if err := logger.OpenFile(opts.LogFile); err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		defer logger.Close()
+	}
+
+	report.Host, _ = os.Hostname()
+	report.DataPath = opts.DataPath
+
+	// Converting in-place writes to the source, which may be read-only.
+	if opts.InPlace() && !writable(opts.DataPath) {
+		fmt.Fprintf(os.Stderr, "data directory %v is not writable, use -out to write converted shards elsewhere\n", opts.DataPath)
+		report.Error = "data directory is not writable"
+		exit(1)
+	}
+
+	// Get the list of shards for conversion.
+	shards, skipped, err := loadShards(&opts)
+	if err != nil {
+		fatalf("failed to access data directory at %v: %v\n", opts.DataPath, err)
+	}
+
+	if opts.JSON {
+		return printShardsJSON(os.Stdout, opts.Select(shards))
+	}
+
+	// Dump summary of what is about to happen.
+	fmt.Fprintln(stdout, "b1 and bz1 shard conversion.")
+	fmt.Fprintln(stdout, "-----------------------------------")
+	fmt.Fprintln(stdout, "Data directory is:       ", opts.DataPath)
+	if opts.BackupDir != "" {
+		fmt.Fprintln(stdout, "Backup directory is:     ", opts.BackupDir)
+	}
+	if opts.TargetDir != "" {
+		fmt.Fprintln(stdout, "Target directory is:     ", opts.TargetDir)
+	}
+	if opts.BackupS3 != "" {
+		fmt.Fprintln(stdout, "Backups uploaded to:     ", s3Scheme+strings.TrimPrefix(opts.BackupS3, s3Scheme))
+	}
+	if opts.BackupCompress {
+		fmt.Fprintln(stdout, "Backups compressed:       yes")
+	}
+	if opts.BackupHardlink {
+		fmt.Fprintln(stdout, "Backups hard-linked:      yes")
+	}
+	if opts.NoBackup && opts.InPlace() {
+		fmt.Fprintln(stdout, "Backups:                  NONE")
+	}
+	fmt.Fprintln(stdout, "Databases specified:     ", listOrAll(opts.DBs))
+	if len(opts.ExcDBs) > 0 {
+		fmt.Fprintln(stdout, "Databases excluded:      ", strings.Join(opts.ExcDBs, ", "))
+	}
+	fmt.Fprintln(stdout, "Retention policies:      ", listOrAll(opts.RPs))
+	fmt.Fprintln(stdout, "Shards specified:        ", listOrAll(opts.Shards))
+	fmt.Fprintln(stdout, "Maximum TSM file size:   ", opts.TSMSize)
+	if opts.Profile != "" {
+		fmt.Fprintln(stdout, "Profile:                 ", opts.Profile)
+	}
+	fmt.Fprintln(stdout, "Parallel conversions:    ", opts.Parallel)
+	fmt.Fprintln(stdout, "Parallel measurements:   ", opts.MeasurementParallel)
+	if opts.DatabaseParallel > 0 {
+		fmt.Fprintln(stdout, "Parallel per database:   ", opts.DatabaseParallel)
+	}
+	if opts.Order != OrderDB {
+		fmt.Fprintln(stdout, "Order:                   ", opts.Order)
+	}
+	if opts.RateLimit > 0 {
+		fmt.Fprintf(stdout, "Rate limit:               %.0f bytes/s\n", opts.RateLimit)
+	}
+	if opts.MaxMemory > 0 {
+		fmt.Fprintln(stdout, "Maximum memory:          ", opts.MaxMemory)
+	}
+	if opts.StopAtDiskUsage > 0 {
+		fmt.Fprintf(stdout, "Stop at disk usage:       %.0f%%\n", opts.StopAtDiskUsage*100)
+	}
+	if opts.TypeConflict != TypeConflictFail {
+		fmt.Fprintln(stdout, "Type conflicts:          ", opts.TypeConflict)
+	}
+	fmt.Fprintln(stdout, "Shard group duration:    ", opts.GroupDuration)
+	if len(opts.Verify) > 0 {
+		fmt.Fprintln(stdout, "Verifiers:               ", strings.Join(opts.Verify, ", "))
+	}
+	if !opts.Before.IsZero() {
+		fmt.Fprintln(stdout, "Shard groups ending by:  ", opts.Before.Format(time.RFC3339))
+	}
+	if opts.SkipOlderThan > 0 {
+		fmt.Fprintln(stdout, "Skip older than:         ", opts.SkipOlderThan)
+	}
+	if opts.MetricsAddr != "" {
+		fmt.Fprintln(stdout, "Metrics address:         ", opts.MetricsAddr)
+	}
+	fmt.Fprintln(stdout)
+
+	if opts.NoBackup && opts.InPlace() {
+		fmt.Fprintln(os.Stderr, "WARNING: -nobackup was given, so databases will NOT be backed up before conversion.")
+		fmt.Fprintln(os.Stderr, "WARNING: Original shards can only be restored from the trash, until they expire or it is emptied.")
+		fmt.Fprintln(os.Stderr)
+	}
+
+	// Filter out any shards already converted, or not requested.
+	convertible := opts.Select(shards.Filter(tsdb.TSM1))
+	if !opts.Before.IsZero() {
+		convertible = convertible.Before(opts.Before, opts.GroupDuration)
+	}
+
+	// Shards with no recent points are left unconverted, as they will soon
+	// expire. influxd still reads them as they are.
+	var stale time.Time
+	if opts.SkipOlderThan > 0 {
+		stale = time.Now().Add(-opts.SkipOlderThan)
+		var recent tsdb.ShardInfos
+		for _, si := range convertible {
+			if !si.MaxTime.IsZero() && si.MaxTime.Before(stale) {
+				logger.Debugf("Skipping %v, with no points since %v\n", si.FullPath(opts.DataPath), si.MaxTime.Format(time.RFC3339))
+				report.Stale = append(report.Stale, si)
+				continue
+			}
+			recent = append(recent, si)
+		}
+		convertible = recent
+	}
+
+	// Skip any shards converted by a previous run which stopped part way
+	// through. Shards converted in-place are already tsm1.
+	checkpoint, err := OpenCheckpoint(opts.CheckpointFile, checkpointTarget())
+	if err != nil {
+		logger.Warnf("Ignoring unreadable checkpoint %v: %v\n", opts.CheckpointFile, err)
+		checkpoint = nil
+	}
+	// Shards converted to the target directory are still to be swapped in.
+	var resumed int
+	var unswapped tsdb.ShardInfos
+	if checkpoint.Completed() > 0 {
+		var remaining tsdb.ShardInfos
+		for _, si := range convertible {
+			if checkpoint.IsCompleted(si) {
+				resumed++
+				if opts.TargetDir != "" {
+					unswapped = append(unswapped, si)
+				}
+				continue
+			}
+			remaining = append(remaining, si)
+		}
+		convertible = remaining
+	}
+
+	// Shards which can't be read are skipped with -skip-errors, rather than
+	// stopping the run, and fail it once the rest are converted. Corrupt
+	// shards are always skipped, unless salvaged with -salvage.
+	// Files which are not shards are listed, and moved to the trash, in a
+	// batch of their own, with -rename-invalid.
+	// The copies of shards converted by a run interrupted before swapping
+	// them in are not shards either, but are kept to be swapped in.
+	var corrupt tsdb.ShardInfos
+	var invalid, unfinished int
+	invalidTrash := NewTrash(opts.DataPath)
+	for _, e := range skipped {
+		si := &tsdb.ShardInfo{Database: e.Database, RetentionPolicy: e.RetentionPolicy, Path: e.Path}
+		if _, ok := e.Err.(*tsdb.InvalidShardNameError); ok {
+			if u, ok := unfinishedShard(e); ok {
+				if convertible.Contains(u) {
+					logger.Infof("Found the converted copy of %v left by an interrupted run, it will be verified and swapped in\n", u.FullPath(opts.DataPath))
+					unfinished++
+				}
+				continue
+			}
+			invalid++
+			if !opts.RenameInvalid || opts.DryRun || opts.Estimate {
+				logger.Warnf("Ignoring %v\n", e.Err)
+				continue
+			}
+			if err := invalidTrash.Move(filepath.Join(e.Database, e.RetentionPolicy, e.Path)); err != nil {
+				fatalf("Failed to move %v to %v: %v\n", si.FullPath(opts.DataPath), invalidTrash.Path(), err)
+			}
+			logger.Infof("Moved %v, which is not a shard, to %v\n", si.FullPath(opts.DataPath), invalidTrash.Path())
+			continue
+		}
+		if len(opts.Select(tsdb.ShardInfos{si})) == 0 {
+			continue
+		}
+		if _, ok := e.Err.(*tsdb.CorruptShardError); ok && opts.Salvage {
+			logger.Warnf("%v, and will be salvaged\n", e.Err)
+			corrupt = append(corrupt, si)
+			continue
+		}
+		skipShard(si, e.Err)
+	}
+
+	// Anything to convert?
+	fmt.Fprintf(stdout, "\n%d shard(s) detected, %d non-TSM shards detected.\n", len(shards), len(convertible)+resumed)
+	if resumed > 0 {
+		fmt.Fprintf(stdout, "Resuming a previous run, %d shard(s) already converted.\n", resumed)
+	}
+	if len(report.Failed) > 0 {
+		fmt.Fprintf(stdout, "%d shard(s) can't be read, and are skipped.\n", len(report.Failed))
+	}
+	if len(report.Stale) > 0 {
+		fmt.Fprintf(stdout, "%d shard(s) with no points since %v are left unconverted.\n", len(report.Stale), stale.Format(time.RFC3339))
+	}
+	if len(corrupt) > 0 {
+		fmt.Fprintf(stdout, "%d corrupt shard(s) will be salvaged.\n", len(corrupt))
+	}
+	if unfinished > 0 {
+		fmt.Fprintf(stdout, "%d shard(s) were converted by an interrupted run, and will be swapped in once verified.\n", unfinished)
+	}
+	if invalid > 0 && opts.RenameInvalid && !opts.DryRun && !opts.Estimate {
+		fmt.Fprintf(stdout, "%d file(s) with names which are not shard IDs were moved to the trash.\n", invalid)
+	} else if invalid > 0 {
+		fmt.Fprintf(stdout, "%d file(s) with names which are not shard IDs are ignored, use -rename-invalid to move them to the trash.\n", invalid)
+	}
+	if len(convertible) == 0 && (len(corrupt) == 0 || opts.DryRun || opts.Estimate) {
+		fmt.Fprintf(stdout, "Nothing to do.\n")
+		if !opts.DryRun && len(unswapped) > 0 {
+			refuseIfRunning(unswapped)
+			report.Failed = append(report.Failed, swapShards(unswapped, NewTrash(opts.DataPath))...)
+		}
+		if !opts.DryRun && len(report.Failed) == 0 {
+			if err := checkpoint.Remove(); err != nil {
+				logger.Warnf("Failed to remove checkpoint %v: %v\n", opts.CheckpointFile, err)
+			}
+		}
+		exitIfFailed()
+		printResult()
+		return nil
+	}
+	loaded := shards
+	shards = convertible
+
+	if opts.Estimate {
+		fmt.Fprintln(stdout)
+		if !printEstimates(stdout, shards) {
+			osExit(1)
+		}
+		return nil
+	}
+
+	// Fields typed differently across the shards of a database are resolved
+	// by -type-conflict, skipping the shards it can't resolve.
+	shards = applyTypeConflicts(shards, loaded)
+	if len(shards) == 0 && len(corrupt) == 0 {
+		exitIfFailed()
+	}
+
+	// Shards held open by influxd must not be converted.
+	refuseIfRunning(shards)
+
+	// Display list of convertible shards, by shard group.
+	fmt.Fprintln(stdout)
+	printShards(stdout, shards)
+
+	if opts.DryRun {
+		fmt.Fprintf(stdout, "\nDry run, %d shard(s) would be converted, across %d database(s).\n\n", len(shards), len(shards.Databases()))
+		if !printPlan(shards, checkpoint) {
+			osExit(1)
+		}
+		return nil
+	}
+
+	// Check every filesystem written to has space for the whole conversion,
+	// rather than running out part way through.
+	if vols := requiredSpace(shards, checkpoint); !enoughSpace(vols) {
+		fmt.Fprintln(stdout, "\nInsufficient disk space to convert, nothing has been changed:")
+		printVolumes(stdout, vols)
+		fmt.Fprintln(stdout, "\nFree space, back up elsewhere with -backup-dir, or write elsewhere with -out or -sink-cmd and TMPDIR.")
+		report.Error = "insufficient disk space"
+		exit(1)
+	}
+
+	// Get confirmation from user.
+	if !opts.Yes {
+		fmt.Fprintf(stdout, "\n%d shard(s), totalling %d bytes, will be converted.\n", len(shards), shards.Size())
+		switch {
+		case opts.Out != "":
+			fmt.Fprintf(stdout, "Converted shards will be written to %v.\n", opts.Out)
+		case opts.TargetDir != "":
+			fmt.Fprintf(stdout, "Converted shards will be written to %v, and swapped in once all are converted.\n", opts.TargetDir)
+			fmt.Fprintf(stdout, "Databases will be backed up to %v.\n", opts.BackupPath("<database>"))
+		case opts.SinkCmd != "":
+			fmt.Fprintf(stdout, "Converted shards will be streamed to: %v\n", opts.SinkCmd)
+		case opts.NoBackup:
+			fmt.Fprintln(stdout, "Databases will NOT be backed up.")
+		default:
+			fmt.Fprintf(stdout, "Databases will be backed up to %v.\n", opts.BackupPath("<database>"))
+		}
+		fmt.Fprintf(stdout, "Proceed? y/N: ")
+
+		yn, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("failed to read response: %v", err)
+		}
+		if strings.TrimSpace(strings.ToLower(yn)) != "y" {
+			fmt.Fprintln(stdout, "Conversion aborted.")
+			osExit(1)
+		}
+	}
+
+	// Output goes to the data directory, unless another directory or a
+	// sink command is given.
+	var sink Sink = NewDirSink(opts.DataPath)
+	if opts.Out != "" {
+		sink = NewDirSink(opts.Out)
+	} else if opts.TargetDir != "" {
+		sink = NewDirSink(opts.TargetDir)
+	} else if opts.SinkCmd != "" {
+		cs, err := NewCmdSink(opts.SinkCmd, os.TempDir())
+		if err != nil {
+			fatalf("Failed to start sink command: %v\n", err)
+		}
+		sink = cs
+	}
+
+	// Original shards are moved to the trash once converted, after removing
+	// any which have expired.
+	trash := NewTrash(opts.DataPath)
+	if opts.InPlace() && opts.TrashRetention > 0 {
+		if err := trash.Empty(time.Now().Add(-opts.TrashRetention)); err != nil {
+			fatalf("Failed to remove expired files from %v: %v\n", trash.Path(), err)
+		}
+	}
+
+	// Salvage corrupt shards, to be converted along with the rest. Their
+	// originals are trashed in a batch of their own, as the salvaged shards
+	// are trashed once converted.
+	if len(corrupt) > 0 {
+		salvageTrash := NewTrash(opts.DataPath)
+		var salvaged tsdb.ShardInfos
+		for _, si := range corrupt {
+			s, err := salvageShard(si, salvageTrash)
+			if err != nil {
+				skipShard(si, err)
+				continue
+			}
+			salvaged = append(salvaged, s)
+		}
+		shards = append(shards, applyTypeConflicts(salvaged, append(loaded, shards...))...)
+		sort.Sort(shards)
+	}
+
+	opts.Order.Sort(shards)
+
+	conversionStart := time.Now()
+	report.Start = conversionStart
+	metrics = NewMetrics(shards)
+	sink = metrics.Sink(sink)
+	if opts.RateLimit > 0 {
+		limiter = NewRateLimiter(opts.RateLimit)
+		sink = limiter.Sink(sink)
+	}
+	if opts.MetricsAddr != "" {
+		ln, err := metrics.Serve(opts.MetricsAddr)
+		if err != nil {
+			fatalf("Failed to serve metrics: %v\n", err)
+		}
+		defer ln.Close()
+		logger.Infof("Serving metrics on http://%v/metrics\n", ln.Addr())
+	}
+	databases := shards.Databases()
+	fmt.Fprintf(stdout, "Conversion will be performed on %d shard(s), across %d database(s).\n\n", len(shards), len(databases))
+
+	// Backup each directory. Shards written elsewhere are left untouched,
+	// so they need no backup. The bytes read and written by each phase are
+	// totalled, as the sizes of the files, for the summary.
+	meter := &usageMeter{}
+	if opts.Backup() {
+		backupStart := time.Now()
+		backupRoot := opts.BackupDir
+		if opts.BackupS3 != "" {
+			backupRoot = s3Scheme + strings.TrimPrefix(opts.BackupS3, s3Scheme)
+		} else if backupRoot == "" {
+			backupRoot = opts.DataPath
+		}
+		var backedUpSize int64
+
+		if opts.BackupDir != "" {
+			if err := os.MkdirAll(opts.BackupDir, 0777); err != nil {
+				fatalf("Failed to create backup directory %v: %v\n", opts.BackupDir, err)
+			}
+		}
+		backup := backupDatabase
+		saveManifest := func(m *BackupManifest, dest string) error { return m.Save(dest + "." + manifestExt) }
+		if opts.BackupS3 != "" {
+			client, err := NewS3ClientFromEnv(opts.S3Endpoint)
+			if err != nil {
+				fatalf("Failed to back up to S3: %v\n", err)
+			}
+			backup = s3Backup(client)
+			saveManifest = s3SaveManifest(client)
+		} else if opts.BackupCompress {
+			backup = archiveDatabase
+		} else if opts.BackupHardlink {
+			backup = linkDatabase
+		}
+		for _, db := range databases {
+			dest := opts.BackupPath(db)
+			if backedUp(db, checkpoint) {
+				logger.Infof("Database %v already backed up to %v\n", db, dest)
+				continue
+			}
+
+			logger.Debugf("Backing up database %v to %v\n", db, dest)
+			size, _ := dirSize(filepath.Join(opts.DataPath, db))
+			m := NewBackupManifest(defaultChunkSize, runtime.GOMAXPROCS(0))
+			if err := backup(filepath.Join(opts.DataPath, db), dest, m); err != nil && opts.SkipErrors {
+				// Remove the partial backup, so the next run backs up the database
+				// again. A failed upload leaves no object.
+				if opts.BackupS3 == "" {
+					os.RemoveAll(dest)
+				}
+				err = fmt.Errorf("backup of database '%v' failed: %v", db, err)
+				var remaining tsdb.ShardInfos
+				for _, si := range shards {
+					if si.Database != db {
+						remaining = append(remaining, si)
+						continue
+					}
+					metrics.Finish(si, err)
+					skipShard(si, err)
+				}
+				shards = remaining
+				continue
+			} else if err != nil {
+				fatalf("Backup of database '%v' failed: %v\n", db, err)
+			}
+			if err := saveManifest(m, dest); err != nil {
+				fatalf("Failed to write manifest of backup %v: %v\n", dest, err)
+			}
+			logger.Infof("Database %v backed up to %v\n", db, dest)
+			if err := checkpoint.BackedUp(db); err != nil {
+				logger.Warnf("Failed to update checkpoint %v: %v\n", opts.CheckpointFile, err)
+			}
+
+			backedUpSize += size
+			meter.Read(opts.DataPath, size)
+			if !opts.BackupHardlink {
+				// Hard links copy nothing.
+				meter.Wrote(backupRoot, m.Size())
+			}
+		}
+		meter.Phase("backup", backupStart, backedUpSize)
+	}
+
+	// Convert each shard. A failed shard is left unconverted, and does not
+	// stop the conversion of the others.
+	history := NewHistory(opts.HistoryFile)
+	var progressOut io.Writer = os.Stderr
+	if opts.Quiet {
+		progressOut = ioutil.Discard
+	}
+	progress := NewProgress(progressOut, shards)
+	log.SetOutput(progress.Writer(os.Stderr))
+	convertStart := time.Now()
+	failed := convertShards(shards, sink, trash, history, checkpoint, progress, opts.Parallel)
+	progress.Close()
+	log.SetOutput(os.Stderr)
+
+	if err := sink.Close(); err != nil {
+		fatalf("Failed to close output: %v\n", err)
+	}
+
+	// Shards which failed are counted as far as they were read, which is
+	// not known, so only converted shards are counted.
+	var convertedSize int64
+	for _, sr := range report.Shards {
+		if sr.Error == "" {
+			convertedSize += sr.InputSize
+			meter.Read(opts.DataPath, sr.InputSize)
+			meter.Wrote(outputPath(), sr.OutputSize)
+		}
+	}
+	meter.Phase("convert", convertStart, convertedSize)
+
+	// Swap the shards converted to the target directory into the data
+	// directory, now that none are being written.
+	if opts.TargetDir != "" {
+		for _, si := range shards {
+			if !slicesContainsShard(failed, si) {
+				unswapped = append(unswapped, si)
+			}
+		}
+		swapStart := time.Now()
+		failed = append(failed, swapShards(unswapped, trash)...)
+		meter.Phase("swap", swapStart, 0)
+	}
+
+	report.End = time.Now()
+	report.Usage = meter.Usage()
+	if err := history.AppendRun(&RunRecord{
+		Time:     report.End.UTC(),
+		DataPath: opts.DataPath,
+		Shards:   len(shards),
+		Usage:    report.Usage,
+	}); err != nil {
+		logger.Warnf("Failed to record the run in history %v: %v\n", opts.HistoryFile, err)
+	}
+	report.Failed = append(report.Failed, failed...)
+	for _, si := range shards {
+		if !slicesContainsShard(failed, si) {
+			report.Converted = append(report.Converted, si)
+		}
+	}
+	if err := mailReport(report); err != nil {
+		logger.Warnf("Failed to mail report: %v\n", err)
+	}
+
+	if err := updateConversionManifest(opts.ConversionManifest, report); err != nil {
+		logger.Warnf("Failed to update conversion manifest %v: %v\n", opts.ConversionManifest, err)
+	}
+
+	fmt.Fprintln(stdout, "\nSummary:")
+	report.WriteSummary(stdout)
+	if opts.SummaryJSON != "" {
+		if err := report.WriteJSON(opts.SummaryJSON); err != nil {
+			logger.Warnf("Failed to write summary %v: %v\n", opts.SummaryJSON, err)
+		}
+	}
+
+	// Failed shards are retried by the next run, along with the backups.
+	if len(report.Failed) == 0 {
+		if err := checkpoint.Remove(); err != nil {
+			logger.Warnf("Failed to remove checkpoint %v: %v\n", opts.CheckpointFile, err)
+		}
+	}
+	exitIfFailed()
+
+	fmt.Fprintf(stdout, "\nConversion of %d shard(s) completed in %v.\n", len(shards), time.Now().Sub(conversionStart))
+	printResult()
+	return nil
+}
+
+// skipShard records the shard as failed with err, without converting it.
+func skipShard(si *tsdb.ShardInfo, err error) {
+	logger.Errorf("Skipping %v: %v\n", si.FullPath(opts.DataPath), err)
+	report.Shards = append(report.Shards, &ShardResult{Shard: si, InputSize: si.Size, Error: err.Error()})
+	report.Failed = append(report.Failed, si)
+}
+
+// exitIfFailed lists the shards which failed to convert, and why, and exits,
+// if any did.
+func exitIfFailed() {
+	if len(report.Failed) == 0 {
+		return
+	}
+
+	fmt.Fprintf(stdout, "\nConversion of %d shard(s) failed, these shards are unchanged:\n", len(report.Failed))
+	for _, sr := range report.Shards {
+		if sr.Error != "" {
+			fmt.Fprintf(stdout, "%v: %v\n", sr.Shard.FullPath(opts.DataPath), sr.Error)
+		}
+	}
+	exit(1)
+}
+
+func slicesContainsShard(a tsdb.ShardInfos, si *tsdb.ShardInfo) bool {
+	for _, v := range a {
+		if v == si {
+			return true
+		}
+	}
+	return false
+}
+
+// convertShards converts shards using n concurrent workers, recording the
+// data of each converted shard in history, its completion in checkpoint,
+// and the progress of each in progress. It returns the shards which failed
+// to convert.
+func convertShards(shards tsdb.ShardInfos, sink Sink, trash *Trash, history *History, checkpoint *Checkpoint, progress *Progress, n int) tsdb.ShardInfos {
+	queue := newShardQueue(shards, opts.DatabaseParallel)
+
+	var mu sync.Mutex
+	var failed tsdb.ShardInfos
+	guard := newSpaceGuard()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for si := queue.Next(); si != nil; si = queue.Next() {
+				waitForDiskUsage(guard.path)
+				start := time.Now()
+				result, counter, err := tryConvertShard(si, sink, trash, guard, progress)
+				for retry := 1; err != nil && retry <= opts.Retries; retry++ {
+					d := retryDelay(opts.RetryBackoff, retry)
+					logger.Warnf("Failed to convert %v, retry %d of %d in %v: %v\n", si.FullPath(opts.DataPath), retry, opts.Retries, d, err)
+					time.Sleep(d)
+					result, counter, err = tryConvertShard(si, sink, trash, guard, progress)
+					result.Retries = retry
+				}
+				queue.Done(si)
+				metrics.Finish(si, err)
+
+				result.Duration = time.Now().Sub(start)
+				if err != nil {
+					result.Error = err.Error()
+				}
+				mu.Lock()
+				report.Shards = append(report.Shards, result)
+				if err != nil {
+					failed = append(failed, si)
+				}
+				mu.Unlock()
+
+				if err != nil {
+					logger.Errorf("Failed to convert %v: %v\n", si.FullPath(opts.DataPath), err)
+					continue
+				}
+				logger.Infof("Conversion of %v successful (%v)\n", si.FullPath(opts.DataPath), time.Now().Sub(start))
+				logger.Debugf("Recording %v as converted in checkpoint %v\n", si.FullPath(opts.DataPath), opts.CheckpointFile)
+				if err := checkpoint.Complete(si); err != nil {
+					logger.Warnf("Failed to update checkpoint %v: %v\n", opts.CheckpointFile, err)
+				}
+
+				// The shard is converted, so a failure to record it is not fatal.
+				if err := history.Append(&ShardRecord{
+					Time:            time.Now().UTC(),
+					Database:        si.Database,
+					RetentionPolicy: si.RetentionPolicy,
+					Path:            si.Path,
+					MinTime:         si.MinTime,
+					MaxTime:         si.MaxTime,
+					Counts:          counter.counts,
+				}); err != nil {
+					logger.Warnf("Failed to record %v in history %v: %v\n", si.FullPath(opts.DataPath), opts.HistoryFile, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Sort(failed)
+	return failed
+}
+
+// loadShards returns the shards of every database under the data path of o,
+// reading unchanged shards from, and saving them to, its cache. With
+// -skip-errors, the shards which can't be read are returned separately.
+func loadShards(o *options) (tsdb.ShardInfos, []*tsdb.ShardError, error) {
+	// Shard metadata is cached between runs, as reading large shards is slow.
+	cache, err := tsdb.OpenCache(o.CacheFile)
+	if err != nil {
+		logger.Warnf("Ignoring unreadable shard cache %v: %v\n", o.CacheFile, err)
+		cache = nil
+	}
+
+	shards, skipped, err := collectShards(o.DataPath, cache, o.SkipErrors)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Runs which only describe the conversion leave the data directory as
+	// it is.
+	if cache != nil && !o.DryRun && !o.Estimate {
+		if err := cache.Save(); err != nil {
+			logger.Warnf("Failed to save shard cache %v: %v\n", o.CacheFile, err)
+		}
+	}
+	return shards, skipped, nil
+}
+
+// printShards prints a table of the shards, by shard group.
+func printShards(w io.Writer, shards tsdb.ShardInfos) {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "Shard Group\tDatabase\tRetention\tPath\tEngine\tEarliest\tLatest\tSeries\tSize")
+	for _, g := range shards.Groups(opts.GroupDuration) {
+		group := "-"
+		if !g.Start.IsZero() {
+			group = g.Start.Format(time.RFC3339)
+		}
+		for _, si := range g.Shards {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%d\t%d\n", group, si.Database, si.RetentionPolicy, si.FullPath(opts.DataPath), si.FormatAsString(),
+				formatShardTime(si.MinTime), formatShardTime(si.MaxTime), si.SeriesN, si.Size)
+		}
+	}
+	tw.Flush()
+}
+
+// formatShardTime formats the time of a shard's earliest or latest point,
+// or "-" if it is unknown, as for tsm1 and empty shards.
+func formatShardTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// printShardsJSON prints the shards as a JSON array.
+func printShardsJSON(w io.Writer, shards tsdb.ShardInfos) error {
+	if shards == nil {
+		shards = tsdb.ShardInfos{}
+	}
+	if err := json.NewEncoder(w).Encode(shards); err != nil {
+		return fmt.Errorf("failed to encode shards: %v", err)
+	}
+	return nil
+}
+
+// collectShards returns the shards of every database under the data path,
+// reading unchanged shards from cache, if not nil. With skipErrors, shards
+// which can't be read are returned separately, rather than failing.
+func collectShards(dataPath string, cache *tsdb.Cache, skipErrors bool) (tsdb.ShardInfos, []*tsdb.ShardError, error) {
+	fis, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var shards tsdb.ShardInfos
+	var skipped []*tsdb.ShardError
+	for _, fi := range fis {
+		// Skip anything that isn't a database, including previous backups
+		// the trash, and shards being restored.
+		if !fi.IsDir() || strings.HasSuffix(fi.Name(), "."+backupExt) || fi.Name() == trashDir || fi.Name() == restoreDir {
+			continue
+		}
+
+		db := tsdb.NewDatabase(filepath.Join(dataPath, fi.Name()))
+		db.Cache = cache
+		db.SkipErrors = skipErrors
+		dbShards, err := db.Shards()
+		if err != nil {
+			return nil, nil, err
+		}
+		shards = append(shards, dbShards...)
+		skipped = append(skipped, db.Skipped...)
+	}
+	return shards, skipped, nil
+}
+
+// backupDatabase backs up the database at src to dest, adding the copied
+// files to the manifest m.
+func backupDatabase(src, dest string, m *BackupManifest) error {
+	return walkBackup(src, dest, m, copyFile)
+}
+
+// linkDatabase backs up the database at src to dest by hard-linking its
+// files, adding them to the manifest m. Shard files are never modified once
+// conversion starts, so the links keep their contents, while using no more
+// space.
+func linkDatabase(src, dest string, m *BackupManifest) error {
+	return walkBackup(src, dest, m, linkFile)
+}
+
+// walkBackup backs up each file of the database at src to dest with backup,
+// which also writes the file's contents to w, for the manifest m.
+func walkBackup(src, dest string, m *BackupManifest, backup func(src, dest string, perm os.FileMode, w io.Writer) error) error {
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("backup of %v already exists at %v", src, dest)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		if fi.IsDir() {
+			return os.MkdirAll(target, fi.Mode().Perm())
+		}
+
+		w := m.Writer(filepath.Join(filepath.Base(dest), rel))
+		if err := backup(path, target, fi.Mode().Perm(), w); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// copyFile copies the file at src to dest, and to w, syncing dest to disk.
+func copyFile(src, dest string, perm os.FileMode, w io.Writer) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(io.MultiWriter(out, w), limiter.Reader(in)); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// linkFile hard-links dest to src, and reads the file to w. perm is unused,
+// as the link shares the permissions of src.
+func linkFile(src, dest string, perm os.FileMode, w io.Writer) error {
+	if err := os.Link(src, dest); err != nil {
+		return err
+	}
+
+	f, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, limiter.Reader(f))
+	return err
+}
+
+// ShardReader reads the data of a b1 or bz1 shard for conversion.
+type ShardReader interface {
+	KeyIterator
+	Open() error
+	Close() error
+
+	// Measurements returns the sorted names of the measurements in the shard.
+	Measurements() []string
+
+	// KeyN returns the number of keys in the shard.
+	KeyN() int
+
+	// FieldTypes returns the type of each field of each measurement in the
+	// shard, and may be called without opening the reader.
+	FieldTypes() (map[string]map[string]influxql.DataType, error)
+
+	// MeasurementIterator returns an iterator over the data of a single
+	// measurement, which may be read concurrently with other iterators.
+	MeasurementIterator(name string) (MeasurementIterator, error)
+}
+
+// MeasurementIterator reads the data of a single measurement of a shard.
+type MeasurementIterator interface {
+	KeyIterator
+	Close() error
+}
+
+// newShardReader returns a reader of the b1 or bz1 shard, which must be opened.
+func newShardReader(si *tsdb.ShardInfo) (ShardReader, error) {
+	switch si.Format {
+	case tsdb.B1:
+		return &b1Reader{b1.NewReader(si.FullPath(opts.DataPath))}, nil
+	case tsdb.BZ1:
+		return &bz1Reader{bz1.NewReader(si.FullPath(opts.DataPath))}, nil
+	default:
+		return nil, fmt.Errorf("unsupported shard format: %v", si.FormatAsString())
+	}
+}
+
+// b1Reader is a ShardReader of a b1 shard.
+type b1Reader struct {
+	*b1.Reader
+}
+
+func (r *b1Reader) MeasurementIterator(name string) (MeasurementIterator, error) {
+	itr, err := r.Reader.MeasurementIterator(name)
+	if err != nil {
+		return nil, err
+	}
+	return itr, nil
+}
+
+// bz1Reader is a ShardReader of a bz1 shard.
+type bz1Reader struct {
+	*bz1.Reader
+}
+
+func (r *bz1Reader) MeasurementIterator(name string) (MeasurementIterator, error) {
+	itr, err := r.Reader.MeasurementIterator(name)
+	if err != nil {
+		return nil, err
+	}
+	return itr, nil
+}
+
+// tryConvertShard makes a single attempt at converting the shard, within
+// the disk space reserved by guard, returning its result and the values read.
+func tryConvertShard(si *tsdb.ShardInfo, sink Sink, trash *Trash, guard *spaceGuard, progress *Progress) (*ShardResult, *valueCounter, error) {
+	counter := newValueCounter()
+	out := &checksumSink{Sink: sink}
+	result := &ShardResult{Shard: si, InputSize: si.Size}
+
+	if err := guard.reserve(si); err != nil {
+		return result, counter, err
+	}
+	defer guard.release(si)
+
+	if opts.ConversionManifest != "" {
+		logger.Debugf("Computing the checksum of %v\n", si.FullPath(opts.DataPath))
+		source, err := checksumFile(si.FullPath(opts.DataPath))
+		if err != nil {
+			return result, counter, err
+		}
+		result.Source = source
+	}
+
+	// A copy converted by an interrupted run is swapped in, once verified,
+	// rather than converting the shard again.
+	var finished bool
+	var err error
+	if opts.InPlace() && outputDir() == "" {
+		finished, err = finishShard(si, trash, out, counter)
+	}
+	if !finished {
+		logger.Debugf("Converting %v shard %v (%d bytes)\n", si.FormatAsString(), si.FullPath(opts.DataPath), si.Size)
+		sp := progress.Start(si)
+		err = convertShard(si, out, trash, counter, sp)
+		progress.Finish(sp)
+	}
+
+	result.OutputSize = out.Size()
+	result.Points = counter.total()
+	result.Files = out.Files()
+	return result, counter, err
+}
+
+// retryDelay returns the delay before the given retry of a shard, doubling
+// from backoff for each retry, up to maxRetryBackoff.
+func retryDelay(backoff time.Duration, retry int) time.Duration {
+	d := backoff
+	for i := 1; i < retry && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d
+}
+
+// convertShard converts the shard, writing the TSM files to sink. When
+// converting in-place, the original shard is then moved to the trash and
+// replaced by the converted one. Shards converted locally are first checked
+// by the verifiers given by -verify. Values read are counted by counter, and
+// the keys read recorded by sp.
+func convertShard(si *tsdb.ShardInfo, sink Sink, trash *Trash, counter *valueCounter, sp *ShardProgress) error {
+	rel := filepath.Join(si.Database, si.RetentionPolicy, si.Path)
+	if opts.SinkCmd != "" {
+		logger.Debugf("Writing TSM files of %v to command %q\n", si.FullPath(opts.DataPath), opts.SinkCmd)
+		return writeShard(si, rel, sink, counter, sp)
+	} else if dir := outputDir(); dir != "" {
+		// Create the shard directory, even if the shard holds no data,
+		// removing any partial output left behind by a previous attempt.
+		dst := filepath.Join(dir, rel)
+		logger.Debugf("Writing TSM files of %v to %v\n", si.FullPath(opts.DataPath), dst)
+		if err := os.RemoveAll(dst); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dst, 0777); err != nil {
+			return err
+		}
+		if err := writeShard(si, rel, sink, counter, sp); err != nil {
+			os.RemoveAll(dst)
+			return err
+		}
+		if err := verifyShard(si, dst, opts.Verify); err != nil {
+			os.RemoveAll(dst)
+			return err
+		}
+		return nil
+	}
+
+	src := si.FullPath(opts.DataPath)
+	dst := fmt.Sprintf("%v.%v", src, tsmExt)
+
+	// Remove any partial output left behind by a previous attempt.
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0777); err != nil {
+		return err
+	}
+
+	logger.Debugf("Writing TSM files of %v to %v\n", src, dst)
+	if err := writeShard(si, fmt.Sprintf("%v.%v", rel, tsmExt), sink, counter, sp); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	if err := verifyShard(si, dst, opts.Verify); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+
+	// Replace the original shard with the converted one. The converted
+	// shard is kept if the original can't be put back.
+	logger.Debugf("Replacing %v with the converted shard\n", src)
+	if err := replaceShard(trash, rel, dst); err != nil {
+		if _, e := os.Stat(src); e == nil {
+			os.RemoveAll(dst)
+		}
+		return err
+	}
+	return nil
+}
+
+// renameShard renames a shard into place, replaced by tests to inject
+// failures.
+var renameShard = os.Rename
+
+// replaceShard moves the shard at rel, within the data directory, to the
+// trash, and renames path to take its place. If path can't be renamed, the
+// shard is moved back from the trash.
+func replaceShard(trash *Trash, rel, path string) error {
+	src := filepath.Join(opts.DataPath, rel)
+	if err := trash.Move(rel); err != nil {
+		return err
+	}
+	if err := renameShard(path, src); err != nil {
+		if e := trash.Unmove(rel); e != nil {
+			return fmt.Errorf("replace %v: %v, and moving it back from %v failed: %v", src, err, trash.Path(), e)
+		}
+		return fmt.Errorf("replace %v: %v", src, err)
+	}
+	return nil
+}
+
+// writeShard reads the shard and writes its data as TSM files to the
+// directory at path within sink, counting the values read with counter and
+// recording the keys read with sp.
+func writeShard(si *tsdb.ShardInfo, path string, sink Sink, counter *valueCounter, sp *ShardProgress) error {
+	src := si.FullPath(opts.DataPath)
+
+	reader, err := newShardReader(si)
+	if err != nil {
+		return err
+	}
+	if err := reader.Open(); err != nil {
+		return fmt.Errorf("open %v shard: %v", si.FormatAsString(), err)
+	}
+	defer reader.Close()
+	sp.SetKeyN(reader.KeyN())
+	logger.Debugf("Reading %d keys of %d measurements from %v\n", reader.KeyN(), len(reader.Measurements()), src)
+
+	// Each key is taken to read its share of the shard, for the rate limit.
+	var keySize int64
+	if n := reader.KeyN(); n > 0 {
+		keySize = si.Size / int64(n)
+	}
+
+	// Values are counted, keys recorded as progress, and series added to the
+	// bloom filter, as they are read.
+	var filter *BloomFilter
+	if opts.Bloom {
+		filter = NewBloomFilter(si.SeriesN, bloomFalsePositiveRate)
+	}
+	wrap := func(itr KeyIterator) KeyIterator {
+		itr = limiter.Iterator(metrics.Iterator(sp.Iterator(counter.Iterator(typeConflicts[si].Iterator(itr)))), keySize)
+		if filter != nil {
+			itr = filter.Iterator(itr)
+		}
+		return itr
+	}
+
+	converter := NewConverter(path, uint32(opts.TSMSize), sink)
+	converter.MaxIndexMemory = opts.IndexMemory()
+	if opts.MeasurementParallel == 1 {
+		if err := converter.Process(wrap(reader)); err != nil {
+			return fmt.Errorf("conversion of %v failed: %v", src, err)
+		}
+		return writeBloomFilter(filter, path, sink)
+	}
+
+	// Split the shard by measurement, with each worker converting the
+	// measurements it takes into its own TSM files.
+	measurements := reader.Measurements()
+	ch := make(chan string, len(measurements))
+	for _, name := range measurements {
+		ch <- name
+	}
+	close(ch)
+
+	errs := make(chan error, opts.MeasurementParallel)
+	for i := 0; i < opts.MeasurementParallel; i++ {
+		go func() {
+			itr := &chainIterator{ch: ch, open: reader.MeasurementIterator}
+			err := converter.Process(wrap(itr))
+			itr.Close()
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < opts.MeasurementParallel; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = fmt.Errorf("conversion of %v failed: %v", src, e)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return writeBloomFilter(filter, path, sink)
+}
+
+// chainIterator reads the measurements received from ch, one after another.
+type chainIterator struct {
+	ch   <-chan string
+	open func(name string) (MeasurementIterator, error)
+	curr MeasurementIterator
+	err  error
+}
+
+func (itr *chainIterator) Next() bool {
+	for itr.err == nil {
+		if itr.curr == nil {
+			name, ok := <-itr.ch
+			if !ok {
+				return false
+			}
+			if itr.curr, itr.err = itr.open(name); itr.err != nil {
+				return true
+			}
+		}
+
+		if itr.curr.Next() {
+			return true
+		}
+		itr.err = itr.curr.Close()
+		itr.curr = nil
+	}
+	// Surface the error through Read().
+	return true
+}
+
+func (itr *chainIterator) Read() (string, []tsm1.Value, error) {
+	if itr.err != nil {
+		return "", nil, itr.err
+	}
+	return itr.curr.Read()
+}
+
+// Close closes the measurement currently being read, if any.
+func (itr *chainIterator) Close() error {
+	if itr.curr != nil {
+		return itr.curr.Close()
+	}
+	return nil
+}
+
+// listOrAll returns a list of names for display, or "all" if it is empty.
+func listOrAll(a []string) string {
+	if a == nil {
+		return "all"
+	}
+	return strings.Join(a, ", ")
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/models"
+	influxtsdb "github.com/influxdb/influxdb/tsdb"
+	ebz1 "github.com/influxdb/influxdb/tsdb/engine/bz1"
+	"github.com/influxdb/influxdb/tsdb/engine/wal"
+)
+
+// Ensure the delay between retries doubles, up to the maximum.
+func TestRetryDelay(t *testing.T) {
+	for _, tt := range []struct {
+		backoff time.Duration
+		retry   int
+		exp     time.Duration
+	}{
+		{backoff: time.Second, retry: 1, exp: time.Second},
+		{backoff: time.Second, retry: 2, exp: 2 * time.Second},
+		{backoff: time.Second, retry: 4, exp: 8 * time.Second},
+		{backoff: time.Second, retry: 7, exp: maxRetryBackoff},
+		{backoff: time.Second, retry: 1000, exp: maxRetryBackoff},
+		{backoff: 2 * time.Minute, retry: 1, exp: maxRetryBackoff},
+		{backoff: 0, retry: 3, exp: 0},
+	} {
+		if d := retryDelay(tt.backoff, tt.retry); d != tt.exp {
+			t.Errorf("retryDelay(%v, %d): exp %v, got %v", tt.backoff, tt.retry, tt.exp, d)
+		}
+	}
+}
+
+// Ensure converting to -out leaves the data directory unmodified, keeping the
+// files the run keeps between runs in the output directory.
+func TestConvert_Out(t *testing.T) {
+	dataPath, out := MustTempDir(), MustTempDir()
+	defer os.RemoveAll(dataPath)
+	defer os.RemoveAll(out)
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db0", "default", "1"), "cpu value=1 1000000000", "cpu value=2 2000000000")
+
+	before := MustSnapshotDir(dataPath)
+	if output, code := RunConvert("", "-y", "-out", out, dataPath); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	}
+	if after := MustSnapshotDir(dataPath); !reflect.DeepEqual(after, before) {
+		t.Fatalf("data directory modified:\n\nbefore=%v\n\nafter=%v", before, after)
+	}
+
+	if m := MustReadTSMShard(filepath.Join(out, "db0", "default", "1")); !reflect.DeepEqual(m, map[string][]interface{}{"cpu#!~#value": {1.0, 2.0}}) {
+		t.Fatalf("unexpected values: %v", m)
+	}
+	for _, name := range []string{cacheFile, historyFile, conversionManifestFile} {
+		if _, err := os.Stat(filepath.Join(out, name)); err != nil {
+			t.Fatalf("expected %v in the output directory: %v", name, err)
+		}
+	}
+}
+
+// Ensure files whose names are not shard IDs are ignored, or moved to the
+// trash with -rename-invalid, while the shards are converted.
+func TestConvert_RenameInvalid(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db0", "default", "1"), "cpu value=1 1000000000")
+	MustWriteFile(filepath.Join(dataPath, "db0", "default", "1~"), "backup")
+
+	output, code := RunConvert("", "-y", "-dry-run", dataPath)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	} else if !strings.Contains(output, "1 file(s) with names which are not shard IDs are ignored") {
+		t.Fatalf("invalid name not reported: %s", output)
+	}
+
+	if output, code := RunConvert("", "-y", "-nobackup", "-rename-invalid", dataPath); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	}
+	if _, err := os.Stat(filepath.Join(dataPath, "db0", "default", "1~")); !os.IsNotExist(err) {
+		t.Fatalf("invalid file not moved: %v", err)
+	}
+	if m := MustReadTSMShard(filepath.Join(dataPath, "db0", "default", "1")); !reflect.DeepEqual(m, map[string][]interface{}{"cpu#!~#value": {1.0}}) {
+		t.Fatalf("unexpected values: %v", m)
+	}
+
+	var paths []string
+	batches, err := NewTrash(dataPath).Batches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range batches {
+		paths = append(paths, b.Paths...)
+	}
+	if !reflect.DeepEqual(paths, []string{filepath.Join("db0", "default", "1~"), filepath.Join("db0", "default", "1")}) &&
+		!reflect.DeepEqual(paths, []string{filepath.Join("db0", "default", "1"), filepath.Join("db0", "default", "1~")}) {
+		t.Fatalf("unexpected trash: %v", paths)
+	}
+}
+
+// Ensure shards converted concurrently with -parallel each hold their own
+// values once converted.
+func TestConvert_Parallel(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+
+	exp := make(map[string]map[string][]interface{})
+	for i := 1; i <= 6; i++ {
+		path := filepath.Join(fmt.Sprintf("db%d", i%2), "default", fmt.Sprint(i))
+		MustCreateBZ1Shard(filepath.Join(dataPath, path), fmt.Sprintf("cpu value=%d 1000000000", i), fmt.Sprintf("mem value=%d 2000000000", i*10))
+		exp[path] = map[string][]interface{}{"cpu#!~#value": {float64(i)}, "mem#!~#value": {float64(i * 10)}}
+	}
+
+	if output, code := RunConvert("", "-y", "-parallel", "4", dataPath); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	}
+	for path, values := range exp {
+		if m := MustReadTSMShard(filepath.Join(dataPath, path)); !reflect.DeepEqual(m, values) {
+			t.Fatalf("%v: unexpected values: %v", path, m)
+		}
+	}
+}
+
+// Ensure -dry-run describes the conversion without changing anything, and
+// the shards it describes then convert.
+func TestConvert_DryRun(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	shard := filepath.Join(dataPath, "db0", "default", "1")
+	MustCreateBZ1Shard(shard, "cpu value=1 1000000000", "cpu value=2 2000000000")
+
+	before := MustSnapshotDir(dataPath)
+	output, code := RunConvert("", "-dry-run", dataPath)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	} else if !strings.Contains(output, "Dry run, 1 shard(s) would be converted, across 1 database(s).") {
+		t.Fatalf("conversion not described: %s", output)
+	}
+	if after := MustSnapshotDir(dataPath); !reflect.DeepEqual(after, before) {
+		t.Fatalf("data directory modified:\n\nbefore=%v\n\nafter=%v", before, after)
+	}
+
+	if output, code := RunConvert("", "-y", dataPath); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	}
+	if m := MustReadTSMShard(shard); !reflect.DeepEqual(m, map[string][]interface{}{"cpu#!~#value": {1.0, 2.0}}) {
+		t.Fatalf("unexpected values: %v", m)
+	}
+}
+
+// Ensure the conversion only proceeds once confirmed, or with -y.
+func TestConvert_Confirm(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	shards := []string{filepath.Join(dataPath, "db0", "default", "1"), filepath.Join(dataPath, "db1", "default", "2")}
+	MustCreateBZ1Shard(shards[0], "cpu value=1 1000000000")
+	MustCreateBZ1Shard(shards[1], "cpu value=2 2000000000")
+
+	// Declining leaves the shards as they are.
+	before := MustSnapshotShards(filepath.Join(dataPath, "db0"))
+	output, code := RunConvert("n\n", "-dbs", "db0", dataPath)
+	if code != 1 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	} else if !strings.Contains(output, "Proceed? y/N: ") || !strings.Contains(output, "Conversion aborted.") {
+		t.Fatalf("unexpected output: %s", output)
+	}
+	if after := MustSnapshotShards(filepath.Join(dataPath, "db0")); !reflect.DeepEqual(after, before) {
+		t.Fatalf("shards modified:\n\nbefore=%v\n\nafter=%v", before, after)
+	}
+
+	// Confirming converts.
+	if output, code := RunConvert("y\n", "-dbs", "db0", dataPath); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	}
+	if m := MustReadTSMShard(shards[0]); !reflect.DeepEqual(m, map[string][]interface{}{"cpu#!~#value": {1.0}}) {
+		t.Fatalf("unexpected values: %v", m)
+	}
+
+	// As does -y, without asking.
+	output, code = RunConvert("", "-y", "-dbs", "db1", dataPath)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	} else if strings.Contains(output, "Proceed?") {
+		t.Fatalf("confirmation asked with -y: %s", output)
+	}
+	if m := MustReadTSMShard(shards[1]); !reflect.DeepEqual(m, map[string][]interface{}{"cpu#!~#value": {2.0}}) {
+		t.Fatalf("unexpected values: %v", m)
+	}
+}
+
+// Ensure databases are backed up to -backup-dir, from which the original
+// shards can be read back, and not to the data directory.
+func TestConvert_BackupDir(t *testing.T) {
+	dataPath, backupDir := MustTempDir(), MustTempDir()
+	defer os.RemoveAll(dataPath)
+	defer os.RemoveAll(backupDir)
+	shard := filepath.Join(dataPath, "db0", "default", "1")
+	MustCreateBZ1Shard(shard, "cpu value=1 1000000000", "cpu value=2 2000000000")
+	orig, err := ioutil.ReadFile(shard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if output, code := RunConvert("", "-y", "-backup-dir", backupDir, dataPath); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	}
+	if m := MustReadTSMShard(shard); !reflect.DeepEqual(m, map[string][]interface{}{"cpu#!~#value": {1.0, 2.0}}) {
+		t.Fatalf("unexpected values: %v", m)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(backupDir, "db0.bak", "default", "1")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, orig) {
+		t.Fatal("backup differs from the original shard")
+	}
+	if _, err := os.Stat(filepath.Join(backupDir, "db0.bak."+manifestExt)); err != nil {
+		t.Fatalf("backup manifest not written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataPath, "db0.bak")); !os.IsNotExist(err) {
+		t.Fatalf("backup written to the data directory: %v", err)
+	}
+}
+
+// Ensure -nobackup converts without backing up, keeping the original shard
+// in the trash only.
+func TestConvert_NoBackup(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	shard := filepath.Join(dataPath, "db0", "default", "1")
+	MustCreateBZ1Shard(shard, "cpu value=1 1000000000", "cpu value=2 2000000000")
+
+	output, code := RunConvert("", "-y", "-nobackup", dataPath)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	} else if !strings.Contains(output, "Backups:                  NONE") {
+		t.Fatalf("missing backups not reported: %s", output)
+	}
+	if m := MustReadTSMShard(shard); !reflect.DeepEqual(m, map[string][]interface{}{"cpu#!~#value": {1.0, 2.0}}) {
+		t.Fatalf("unexpected values: %v", m)
+	}
+
+	if backups, err := findBackups(dataPath); err != nil {
+		t.Fatal(err)
+	} else if len(backups) != 0 {
+		t.Fatalf("unexpected backups: %+v", backups)
+	}
+	batches, err := NewTrash(dataPath).Batches()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(batches) != 1 || !reflect.DeepEqual(batches[0].Paths, []string{filepath.Join("db0", "default", "1")}) {
+		t.Fatalf("unexpected trash batches: %+v", batches)
+	}
+}
+
+// Ensure the original shard is moved back from the trash if the converted
+// shard can't be renamed into its place.
+func TestConvert_RenameFailure(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	shard := filepath.Join(dataPath, "db0", "default", "1")
+	MustCreateBZ1Shard(shard, "cpu value=1 1000000000")
+	before := MustSnapshotShards(filepath.Join(dataPath, "db0"))
+
+	defer func(fn func(string, string) error) { renameShard = fn }(renameShard)
+	renameShard = func(oldpath, newpath string) error { return errors.New("injected failure") }
+
+	output, code := RunConvert("", "-y", "-nobackup", dataPath)
+	if code != 1 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	} else if !strings.Contains(output, "injected failure") {
+		t.Fatalf("failure not reported: %s", output)
+	}
+	if after := MustSnapshotShards(filepath.Join(dataPath, "db0")); !reflect.DeepEqual(after, before) {
+		t.Fatalf("shard not restored:\n\nbefore=%v\n\nafter=%v", before, after)
+	}
+	if _, err := os.Stat(shard + "." + tsmExt); !os.IsNotExist(err) {
+		t.Fatalf("converted shard left behind: %v", err)
+	}
+}
+
+// exitCode is panicked with by osExit while a command is run by RunConvert,
+// to stop it where it would exit.
+type exitCode int
+
+// RunConvert runs the convert command in-process with args, reading input as
+// its confirmation, and returns its output and exit code. The globals set
+// by the command are restored once it returns.
+func RunConvert(input string, args ...string) (output string, code int) {
+	defer func(o options, r *Report, w io.Writer, in io.Reader, l *Logger, m *Metrics, rl *RateLimiter, tc map[*tsdb.ShardInfo]fieldActions) {
+		opts, report, stdout, stdin, logger, metrics, limiter, typeConflicts = o, r, w, in, l, m, rl, tc
+		osExit = os.Exit
+	}(opts, report, stdout, stdin, logger, metrics, limiter, typeConflicts)
+
+	var buf bytes.Buffer
+	opts, report, stdout, stdin = options{}, &Report{}, &buf, strings.NewReader(input)
+	metrics, limiter, typeConflicts = nil, nil, nil
+	osExit = func(code int) { panic(exitCode(code)) }
+
+	defer func() {
+		if r := recover(); r != nil {
+			c, ok := r.(exitCode)
+			if !ok {
+				panic(r)
+			}
+			code = int(c)
+		}
+		output = buf.String()
+	}()
+	if err := runConvert(args); err != nil {
+		fmt.Fprintln(&buf, err)
+		code = 1
+	}
+	return
+}
+
+// MustSnapshotDir returns the mode, modification time and checksum of each
+// file and directory below dir. Panic on error.
+func MustSnapshotDir(dir string) map[string]string {
+	m := make(map[string]string)
+	if err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		e := fmt.Sprintf("%v %v", fi.Mode(), fi.ModTime().UnixNano())
+		if !fi.IsDir() {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			e += fmt.Sprintf(" %x", sha1.Sum(b))
+		}
+		m[path] = e
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// MustCreateBZ1Shard creates a bz1 shard at path holding the points, given in
+// line protocol with nanosecond timestamps. Each field has the type of its
+// first value. Panic on error.
+func MustCreateBZ1Shard(path string, lines ...string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		panic(err)
+	}
+	walDir, err := ioutil.TempDir("", "influx_tsm-wal-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(walDir)
+
+	e := ebz1.NewEngine(path, walDir, influxtsdb.NewEngineOptions()).(*ebz1.Engine)
+	if l, ok := e.WAL.(*wal.Log); ok {
+		l.LoggingEnabled = false
+	}
+	if err := e.Open(); err != nil {
+		panic(err)
+	} else if err := e.WAL.Open(); err != nil {
+		panic(err)
+	}
+	defer e.Close()
+
+	points, err := models.ParsePointsString(strings.Join(lines, "\n"))
+	if err != nil {
+		panic(err)
+	}
+
+	fields := make(map[string]*influxtsdb.MeasurementFields)
+	values := make(map[string][][]byte)
+	var series []*influxtsdb.SeriesCreate
+	for _, p := range points {
+		mf := fields[p.Name()]
+		if mf == nil {
+			mf = &influxtsdb.MeasurementFields{Fields: make(map[string]*influxtsdb.Field)}
+			fields[p.Name()] = mf
+		}
+		for name, v := range p.Fields() {
+			if err := mf.CreateFieldIfNotExists(name, influxql.InspectDataType(v), false); err != nil {
+				panic(err)
+			}
+		}
+		mf.Codec = influxtsdb.NewFieldCodec(mf.Fields)
+
+		data, err := mf.Codec.EncodeFields(p.Fields())
+		if err != nil {
+			panic(err)
+		}
+		key := string(p.Key())
+		if values[key] == nil {
+			series = append(series, &influxtsdb.SeriesCreate{Measurement: p.Name(), Series: influxtsdb.NewSeries(key, p.Tags())})
+		}
+		values[key] = append(values[key], append(u64tob(uint64(p.UnixNano())), data...))
+	}
+
+	if err := e.WriteIndex(values, fields, series); err != nil {
+		panic(err)
+	}
+}
+
+// MustReadTSMShard returns the values of each key of the converted shard in
+// the directory dir. Panic on error.
+func MustReadTSMShard(dir string) map[string][]interface{} {
+	s, err := OpenTSMShard(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	m := make(map[string][]interface{})
+	for _, k := range s.Keys() {
+		values, err := s.ReadAll(k)
+		if err != nil {
+			panic(err)
+		}
+		for _, v := range values {
+			m[k] = append(m[k], v.Value())
+		}
+	}
+	return m
+}
+
+// u64tob converts a uint64 into an 8-byte slice.
+func u64tob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// Ensure shards with no recent points are left unconverted with -skip-older-than.
+func TestConvert_SkipOlderThan(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	old := filepath.Join(dataPath, "db0", "default", "1")
+	MustCreateBZ1Shard(old, "cpu value=1 1000000000")
+	recent := filepath.Join(dataPath, "db0", "default", "2")
+	MustCreateBZ1Shard(recent, fmt.Sprintf("cpu value=2 %d", time.Now().Add(-time.Hour).UnixNano()))
+	before := MustSnapshotDir(old)
+
+	output, code := RunConvert("", "-y", "-nobackup", "-skip-older-than", "2y", dataPath)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	} else if !strings.Contains(output, "1 shard(s) with no points since") {
+		t.Fatalf("skipped shard not reported: %s", output)
+	}
+	if after := MustSnapshotDir(old); !reflect.DeepEqual(after, before) {
+		t.Fatalf("old shard changed:\n\nbefore=%v\n\nafter=%v", before, after)
+	}
+	if m := MustReadTSMShard(recent); !reflect.DeepEqual(m, map[string][]interface{}{"cpu#!~#value": {2.0}}) {
+		t.Fatalf("unexpected values: %v", m)
+	}
+}
+
+// Ensure ages are parsed with units of days, weeks and years.
+func TestParseAge(t *testing.T) {
+	for _, tt := range []struct {
+		s   string
+		d   time.Duration
+		err bool
+	}{
+		{s: "2y", d: 2 * 365 * 24 * time.Hour},
+		{s: "3w", d: 21 * 24 * time.Hour},
+		{s: "1.5d", d: 36 * time.Hour},
+		{s: "90m", d: 90 * time.Minute},
+		{s: "0d", err: true},
+		{s: "-1y", err: true},
+		{s: "old", err: true},
+	} {
+		d, err := parseAge(tt.s)
+		if tt.err && err == nil {
+			t.Errorf("%q: expected error", tt.s)
+		} else if !tt.err && (err != nil || d != tt.d) {
+			t.Errorf("%q: unexpected duration: %v, %v", tt.s, d, err)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// manifestExt is the extension of a backup's manifest, following the name of the backup.
+const manifestExt = "manifest"
+
+// defaultChunkSize is the size of the chunks of backed up files which are checksummed.
+const defaultChunkSize = 16 * 1024 * 1024
+
+// BackupManifest holds the SHA-256 digest of each fixed-size chunk of every
+// file in a backup, and of each whole file. Chunks are digested concurrently
+// as the backup is written, and can be verified concurrently, and
+// independently, later. Whole files can be checked by other tools.
+type BackupManifest struct {
+	mu  sync.Mutex
+	sem chan struct{} // limits the chunks being digested at once
+
+	ChunkSize int             `json:"chunkSize"`
+	Files     []*ManifestFile `json:"files"`
+}
+
+// ManifestFile holds the digests of a backed up file.
+type ManifestFile struct {
+	// Path is the path of the file, relative to the directory of the manifest.
+	Path   string   `json:"path"`
+	Size   int64    `json:"size"`
+	SHA256 string   `json:"sha256,omitempty"` // hex-encoded SHA-256 of the whole file
+	Chunks []string `json:"chunks"`           // hex-encoded SHA-256, by chunk
+}
+
+// NewBackupManifest returns an empty manifest, digesting up to n chunks concurrently.
+func NewBackupManifest(chunkSize, n int) *BackupManifest {
+	return &BackupManifest{
+		sem:       make(chan struct{}, n),
+		ChunkSize: chunkSize,
+	}
+}
+
+// Writer returns a writer digesting the data written to the file at path.
+// The file is added to the manifest when the writer is closed.
+func (m *BackupManifest) Writer(path string) io.WriteCloser {
+	d := &chunkDigester{
+		m:      m,
+		f:      &ManifestFile{Path: filepath.ToSlash(path)},
+		sum:    sha256.New(),
+		chunks: make(chan []byte, cap(m.sem)),
+		done:   make(chan struct{}),
+	}
+	go d.digestFile()
+	return d
+}
+
+// add adds f to the manifest.
+func (m *BackupManifest) add(f *ManifestFile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Files = append(m.Files, f)
+}
+
+// Size returns the total size of the files in the manifest.
+func (m *BackupManifest) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for _, f := range m.Files {
+		n += f.Size
+	}
+	return n
+}
+
+// Save writes the manifest to path, replacing any existing file atomically.
+func (m *BackupManifest) Save(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadBackupManifest reads the manifest at path.
+func ReadBackupManifest(path string) (*BackupManifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &BackupManifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("read manifest %v: %v", path, err)
+	} else if m.ChunkSize <= 0 {
+		return nil, fmt.Errorf("read manifest %v: bad chunk size %d", path, m.ChunkSize)
+	}
+	return m, nil
+}
+
+// Verify checks every file of the manifest, relative to root, using n
+// concurrent workers, and returns an error for each file which is missing,
+// truncated, or has a chunk whose digest differs.
+func (m *BackupManifest) Verify(root string, n int) []error {
+	type chunk struct {
+		f *ManifestFile
+		i int
+	}
+
+	var mu sync.Mutex
+	var errs []error
+	fail := func(f *ManifestFile, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, fmt.Errorf("%v: %v", f.Path, err))
+	}
+
+	// Check sizes first, so that only intact files have their chunks read.
+	ch := make(chan chunk)
+	go func() {
+		defer close(ch)
+		for _, f := range m.Files {
+			fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(f.Path)))
+			if err != nil {
+				fail(f, err)
+				continue
+			} else if fi.Size() != f.Size {
+				fail(f, fmt.Errorf("size is %d, expected %d", fi.Size(), f.Size))
+				continue
+			}
+			for i := range f.Chunks {
+				ch <- chunk{f: f, i: i}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, m.ChunkSize)
+			for c := range ch {
+				sum, err := digestChunk(filepath.Join(root, filepath.FromSlash(c.f.Path)), int64(c.i)*int64(m.ChunkSize), buf)
+				if err != nil {
+					fail(c.f, err)
+				} else if sum != c.f.Chunks[c.i] {
+					fail(c.f, fmt.Errorf("chunk %d does not match its digest", c.i))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// digestChunk returns the digest of the chunk at offset within the file at
+// path, reading up to len(buf) bytes.
+func digestChunk(path string, offset int64, buf []byte) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	sum := sha256.Sum256(buf[:n])
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// chunkDigester digests each chunk written to it in its own goroutine, so
+// that digesting keeps up with copying. The whole file is digested by
+// another goroutine, as chunks are completed.
+type chunkDigester struct {
+	m   *BackupManifest
+	f   *ManifestFile
+	buf []byte
+	wg  sync.WaitGroup
+	mu  sync.Mutex // protects f.Chunks
+
+	sum    hash.Hash
+	chunks chan []byte // completed chunks, in order, to add to sum
+	done   chan struct{}
+}
+
+// digestFile adds each completed chunk to the digest of the whole file.
+func (d *chunkDigester) digestFile() {
+	defer close(d.done)
+	for buf := range d.chunks {
+		d.sum.Write(buf)
+	}
+}
+
+func (d *chunkDigester) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if d.buf == nil {
+			d.buf = make([]byte, 0, d.m.ChunkSize)
+		}
+		k := cap(d.buf) - len(d.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		d.buf = append(d.buf, p[:k]...)
+		p = p[k:]
+
+		if len(d.buf) == cap(d.buf) {
+			d.flush()
+		}
+	}
+	d.f.Size += int64(n)
+	return n, nil
+}
+
+// flush digests the buffered chunk in the background.
+func (d *chunkDigester) flush() {
+	d.mu.Lock()
+	i := len(d.f.Chunks)
+	d.f.Chunks = append(d.f.Chunks, "")
+	d.mu.Unlock()
+
+	buf := d.buf
+	d.buf = nil
+	d.chunks <- buf
+
+	d.m.sem <- struct{}{}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer func() { <-d.m.sem }()
+
+		sum := sha256.Sum256(buf)
+		d.mu.Lock()
+		d.f.Chunks[i] = hex.EncodeToString(sum[:])
+		d.mu.Unlock()
+	}()
+}
+
+// Close digests the final chunk, waits for every chunk to be digested, and
+// adds the file to the manifest.
+func (d *chunkDigester) Close() error {
+	if len(d.buf) > 0 {
+		d.flush()
+	}
+	close(d.chunks)
+	<-d.done
+	d.wg.Wait()
+
+	d.f.SHA256 = hex.EncodeToString(d.sum.Sum(nil))
+	d.m.add(d.f)
+	return nil
+}
+
+const verifyBackupUsage = `Usage: influx_tsm verify-backup [options] <manifest>
+
+Verify a backup against the manifest written alongside it, '<backup>.manifest',
+by checking the digest of every chunk of every backed up file.
+
+Options:`
+
+func runVerifyBackup(args []string) error {
+	fs := flag.NewFlagSet("verify-backup", flag.ExitOnError)
+	parallel := fs.Int("parallel", runtime.GOMAXPROCS(0), "Number of chunks to verify concurrently.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, verifyBackupUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) < 1 {
+		return fmt.Errorf("no manifest specified")
+	} else if *parallel < 1 {
+		return fmt.Errorf("bad parallelism %d, at least 1 chunk must be verified at a time", *parallel)
+	}
+
+	path := fs.Args()[0]
+	m, err := ReadBackupManifest(path)
+	if err != nil {
+		return err
+	}
+
+	errs := m.Verify(filepath.Dir(path), *parallel)
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("backup verification failed, %d error(s)", len(errs))
+	}
+	fmt.Printf("Verified %d file(s) of backup.\n", len(m.Files))
+	return nil
+}
+
+const verifyUsage = `Usage: influx_tsm verify [options] <data-path>
+
+Verify every backup of the data directory, or those of the databases given,
+against the manifest written alongside it. Each file which is missing,
+truncated, or has a chunk which does not match is listed.
+
+Options:`
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dbs := fs.String("dbs", "", "Comma-delimited list of databases whose backups to verify. Default is every database with a backup.")
+	backupDir := fs.String("backup-dir", "", "Directory the backups were written to. Default is the data directory.")
+	parallel := fs.Int("parallel", runtime.GOMAXPROCS(0), "Number of chunks to verify concurrently.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, verifyUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) < 1 {
+		return fmt.Errorf("no data directory specified")
+	} else if *parallel < 1 {
+		return fmt.Errorf("bad parallelism %d, at least 1 chunk must be verified at a time", *parallel)
+	}
+	if *backupDir == "" {
+		*backupDir = fs.Args()[0]
+	}
+
+	backups, err := selectBackups(*backupDir, *dbs)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, b := range backups {
+		path := b.path + "." + manifestExt
+		m, err := ReadBackupManifest(path)
+		if err != nil {
+			fmt.Printf("%v: cannot read manifest: %v\n", b.path, err)
+			failed++
+			continue
+		}
+
+		errs := m.Verify(filepath.Dir(path), *parallel)
+		for _, err := range errs {
+			fmt.Printf("%v: %v\n", b.path, err)
+		}
+		if len(errs) > 0 {
+			failed++
+			continue
+		}
+		fmt.Printf("%v: verified %d file(s).\n", b.path, len(m.Files))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("verification of %d of %d backup(s) failed", failed, len(backups))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Ensure files written through a manifest are digested whole and by chunk,
+// and verified.
+func TestBackupManifest_Verify(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	m := NewBackupManifest(4, 2)
+	for path, data := range map[string]string{
+		"db0.bak/a": "0123456789",
+		"db0.bak/b": "",
+	} {
+		MustWriteFile(filepath.Join(dir, path), data)
+		// Write in parts which don't align with chunks.
+		w := m.Writer(path)
+		i := len(data) / 3
+		if _, err := w.Write([]byte(data[:i])); err != nil {
+			t.Fatal(err)
+		} else if _, err := w.Write([]byte(data[i:])); err != nil {
+			t.Fatal(err)
+		} else if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Save(filepath.Join(dir, "db0.bak.manifest")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ReadBackupManifest(filepath.Join(dir, "db0.bak.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range m.Files {
+		if f.Path == "db0.bak/a" && (len(f.Chunks) != 3 || f.Size != 10 || f.SHA256 != sha256Hex("0123456789")) {
+			t.Fatalf("unexpected file: %+v", f)
+		} else if f.Path == "db0.bak/b" && (len(f.Chunks) != 0 || f.SHA256 != sha256Hex("")) {
+			t.Fatalf("unexpected file: %+v", f)
+		}
+	}
+	if errs := m.Verify(dir, 2); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// Corrupt the second chunk.
+	MustWriteFile(filepath.Join(dir, "db0.bak", "a"), "0123x56789")
+	if errs := m.Verify(dir, 2); len(errs) != 1 || !strings.Contains(errs[0].Error(), "chunk 1") {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
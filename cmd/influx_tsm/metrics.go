@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// Metrics counts the progress of a conversion, for monitoring. It is served
+// in the Prometheus text format. A nil Metrics counts nothing.
+type Metrics struct {
+	// Updated atomically, so must be 64-bit aligned.
+	shardsConverted int64
+	shardsFailed    int64
+	bytesRead       int64
+	bytesWritten    int64
+	values          int64
+
+	shards int64
+	start  time.Time
+}
+
+// metrics are the metrics of the current conversion, if any.
+var metrics *Metrics
+
+// NewMetrics returns metrics for the conversion of shards, starting now.
+func NewMetrics(shards tsdb.ShardInfos) *Metrics {
+	return &Metrics{shards: int64(len(shards)), start: time.Now()}
+}
+
+// Finish records that the shard has been converted, or failed to convert if
+// err is not nil. Every byte of a shard is read, whether or not it fails.
+func (m *Metrics) Finish(si *tsdb.ShardInfo, err error) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.bytesRead, si.Size)
+	if err != nil {
+		atomic.AddInt64(&m.shardsFailed, 1)
+		return
+	}
+	atomic.AddInt64(&m.shardsConverted, 1)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	converted := atomic.LoadInt64(&m.shardsConverted)
+	failed := atomic.LoadInt64(&m.shardsFailed)
+	values := atomic.LoadInt64(&m.values)
+
+	var rate float64
+	if d := time.Since(m.start).Seconds(); d > 0 {
+		rate = float64(values) / d
+	}
+
+	var n int64
+	for _, mt := range []struct {
+		name, typ, help string
+		value           interface{}
+	}{
+		{"influx_tsm_shards", "gauge", "Number of shards being converted.", m.shards},
+		{"influx_tsm_shards_converted_total", "counter", "Number of shards converted.", converted},
+		{"influx_tsm_shards_remaining", "gauge", "Number of shards yet to be converted, or to fail.", m.shards - converted - failed},
+		{"influx_tsm_errors_total", "counter", "Number of shards which failed to convert.", failed},
+		{"influx_tsm_bytes_read_total", "counter", "Bytes of source shards read, once each shard is finished.", atomic.LoadInt64(&m.bytesRead)},
+		{"influx_tsm_bytes_written_total", "counter", "Bytes of TSM files written.", atomic.LoadInt64(&m.bytesWritten)},
+		{"influx_tsm_points_total", "counter", "Number of field values converted.", values},
+		{"influx_tsm_points_per_second", "gauge", "Average number of field values converted per second since the conversion started.", rate},
+		{"influx_tsm_start_time_seconds", "gauge", "Unix time the conversion started.", m.start.Unix()},
+	} {
+		c, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", mt.name, mt.help, mt.name, mt.typ, mt.name, mt.value)
+		n += int64(c)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ServeHTTP serves the metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// Serve serves the metrics at /metrics on addr, in the background. The
+// listener is opened before returning, so an address in use is reported.
+func (m *Metrics) Serve(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go http.Serve(ln, mux)
+	return ln, nil
+}
+
+// Sink returns a sink counting the bytes written to s.
+func (m *Metrics) Sink(s Sink) Sink {
+	if m == nil {
+		return s
+	}
+	return &metricsSink{Sink: s, m: m}
+}
+
+// metricsSink is a Sink counting the bytes written to its files.
+type metricsSink struct {
+	Sink
+	m *Metrics
+}
+
+func (s *metricsSink) Create(path string) (io.WriteCloser, error) {
+	w, err := s.Sink.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsWriter{WriteCloser: w, m: s.m}, nil
+}
+
+// metricsWriter counts the bytes written through it.
+type metricsWriter struct {
+	io.WriteCloser
+	m *Metrics
+}
+
+func (w *metricsWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	atomic.AddInt64(&w.m.bytesWritten, int64(n))
+	return n, err
+}
+
+// Iterator returns an iterator counting the values read from itr.
+func (m *Metrics) Iterator(itr KeyIterator) KeyIterator {
+	if m == nil {
+		return itr
+	}
+	return &metricsIterator{KeyIterator: itr, m: m}
+}
+
+// metricsIterator is a KeyIterator counting the values read through it.
+type metricsIterator struct {
+	KeyIterator
+	m *Metrics
+}
+
+func (itr *metricsIterator) Read() (string, []tsm1.Value, error) {
+	k, v, err := itr.KeyIterator.Read()
+	if err == nil {
+		atomic.AddInt64(&itr.m.values, int64(len(v)))
+	}
+	return k, v, err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// Ensure metrics count the shards, bytes and values of a conversion.
+func TestMetrics(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	shards := tsdb.ShardInfos{{Path: "1", Size: 100}, {Path: "2", Size: 200}, {Path: "3", Size: 300}}
+	m := NewMetrics(shards)
+
+	itr := m.Iterator(&sliceIterator{
+		keys:   []string{"cpu#!~#value"},
+		values: [][]tsm1.Value{{tsm1.NewValue(time.Unix(0, 1), 1.0), tsm1.NewValue(time.Unix(0, 2), 2.0)}},
+	})
+	for itr.Next() {
+		if _, _, err := itr.Read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := m.Sink(NewDirSink(dir)).Create("000001.tsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Finish(shards[0], nil)
+	m.Finish(shards[1], errors.New("marker"))
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, nil)
+	body, _ := ioutil.ReadAll(rec.Body)
+	for _, exp := range []string{
+		"# TYPE influx_tsm_shards_converted_total counter\n",
+		"\ninflux_tsm_shards 3\n",
+		"\ninflux_tsm_shards_converted_total 1\n",
+		"\ninflux_tsm_shards_remaining 1\n",
+		"\ninflux_tsm_errors_total 1\n",
+		"\ninflux_tsm_bytes_read_total 300\n",
+		"\ninflux_tsm_bytes_written_total 5\n",
+		"\ninflux_tsm_points_total 2\n",
+	} {
+		if !strings.Contains(string(body), exp) {
+			t.Fatalf("missing %q in:\n%s", exp, body)
+		}
+	}
+}
+
+// Ensure nil metrics count nothing.
+func TestMetrics_Nil(t *testing.T) {
+	var m *Metrics
+	m.Finish(&tsdb.ShardInfo{}, nil)
+	itr := &sliceIterator{}
+	if m.Iterator(itr) != KeyIterator(itr) {
+		t.Fatal("expected iterator to be unwrapped")
+	}
+}
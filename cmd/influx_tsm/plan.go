@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// printPlan describes the conversion of shards, and the disk space it
+// requires, without changing anything on disk. It returns false if the
+// conversion is expected to fail.
+func printPlan(shards tsdb.ShardInfos, checkpoint *Checkpoint) bool {
+	ok := true
+
+	// Each database is backed up in full, unless the source is left untouched.
+	if opts.Backup() {
+		fmt.Println("Backups:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+		fmt.Fprintln(w, "Database\tBackup\tSize\tStatus")
+		for _, db := range shards.Databases() {
+			src := filepath.Join(opts.DataPath, db)
+			dest := opts.BackupPath(db)
+
+			sz, err := dirSize(src)
+			if err != nil {
+				fmt.Fprintf(w, "%v\t%v\t-\tcannot read database: %v\n", db, dest, err)
+				ok = false
+				continue
+			}
+
+			status := "ok"
+			if backedUp(db, checkpoint) {
+				status = "already backed up"
+			} else if _, err := os.Stat(dest); err == nil {
+				status = "backup already exists"
+				ok = false
+			}
+			fmt.Fprintf(w, "%v\t%v\t%d\t%v\n", db, dest, sz, status)
+		}
+		w.Flush()
+		fmt.Println()
+	}
+
+	fmt.Println("Disk space:")
+	if !printVolumes(os.Stdout, requiredSpace(shards, checkpoint)) {
+		ok = false
+	}
+
+	return ok
+}
+
+// backedUp returns whether the database was backed up by a previous run
+// which stopped part way through.
+func backedUp(db string, checkpoint *Checkpoint) bool {
+	if !checkpoint.IsBackedUp(db) {
+		return false
+	} else if opts.BackupS3 != "" {
+		// Only completed uploads are checkpointed.
+		return true
+	}
+	_, err := os.Stat(opts.BackupPath(db))
+	return err == nil
+}
+
+// volume is the disk space a conversion requires of a single filesystem.
+type volume struct {
+	id       string   // identifies the filesystem
+	path     string   // the first path checked on the filesystem
+	uses     []string // what the space is required for
+	required uint64
+
+	free uint64
+	err  error // why the free space is unknown, if it is
+}
+
+// enough returns whether the filesystem has the space required, assuming
+// so if its free space is unknown.
+func (v *volume) enough() bool {
+	return v.err != nil || v.free >= v.required
+}
+
+// requiredSpace returns the disk space required to convert the shards, for
+// each filesystem written to, so that a conversion which can't complete is
+// stopped before it starts. Databases already backed up are excluded.
+func requiredSpace(shards tsdb.ShardInfos, checkpoint *Checkpoint) []*volume {
+	var vols []*volume
+	add := func(path, use string, n uint64) {
+		path = existingParent(path)
+		id, err := volumeID(path)
+		if err != nil {
+			id = path
+		}
+
+		for _, v := range vols {
+			if v.id == id {
+				v.uses = append(v.uses, use)
+				v.required += n
+				return
+			}
+		}
+		v := &volume{id: id, path: path, uses: []string{use}, required: n}
+		v.free, v.err = diskFree(path)
+		vols = append(vols, v)
+	}
+
+	// Compressed backups are smaller, but by how much can't be known in
+	// advance, so their full size is required. Hard-linked backups, and
+	// those uploaded to S3, need no space.
+	if opts.Backup() && !opts.BackupHardlink && opts.BackupS3 == "" {
+		var sz int64
+		for _, db := range shards.Databases() {
+			if backedUp(db, checkpoint) {
+				continue
+			}
+			n, _ := dirSize(filepath.Join(opts.DataPath, db))
+			sz += n
+		}
+		dir := opts.BackupDir
+		if dir == "" {
+			dir = opts.DataPath
+		}
+		add(dir, "backups", uint64(sz))
+	}
+
+	// Original shards are kept in the trash, so converting in-place, or to
+	// another directory, needs up to the size of every shard again, as tsm1
+	// is never larger than the original. Streamed TSM files are only staged
+	// until they are sent, so the largest shards being converted at once
+	// bound the space required.
+	conversionSize := shards.Size()
+	if opts.SinkCmd != "" {
+		var sizes []int64
+		for _, si := range shards {
+			sizes = append(sizes, int64(workingSet(si)))
+		}
+		conversionSize = 0
+		for i := 0; i < opts.Parallel && len(sizes) > 0; i++ {
+			j := largest(sizes)
+			conversionSize += sizes[j]
+			sizes = append(sizes[:j], sizes[j+1:]...)
+		}
+		add(outputPath(), "staged TSM files", uint64(conversionSize))
+	} else {
+		add(outputPath(), "converted shards", uint64(conversionSize))
+	}
+
+	return vols
+}
+
+// enoughSpace returns whether every filesystem has the space required.
+func enoughSpace(vols []*volume) bool {
+	for _, v := range vols {
+		if !v.enough() {
+			return false
+		}
+	}
+	return true
+}
+
+// printVolumes prints the disk space required and available on each
+// filesystem, and returns false if any is known to have too little.
+func printVolumes(w io.Writer, vols []*volume) bool {
+	ok := true
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "Filesystem of\tFor\tRequired\tAvailable\tStatus")
+	for _, v := range vols {
+		free, status := fmt.Sprint(v.free), "ok"
+		if v.err != nil {
+			free, status = "unknown", v.err.Error()
+		} else if !v.enough() {
+			status = fmt.Sprintf("INSUFFICIENT, %d bytes short", v.required-v.free)
+			ok = false
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%d\t%v\t%v\n", v.path, strings.Join(v.uses, ", "), v.required, free, status)
+	}
+	tw.Flush()
+	return ok
+}
+
+// existingParent returns path, or its nearest parent which exists, so that
+// the disk of a path yet to be created can be checked.
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); !os.IsNotExist(err) || filepath.Dir(path) == path {
+			return path
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// sameVolume returns whether the paths, or their closest existing parents,
+// are on the same volume.
+func sameVolume(a, b string) bool {
+	ida, err := volumeID(existingParent(a))
+	if err != nil {
+		return false
+	}
+	idb, err := volumeID(existingParent(b))
+	if err != nil {
+		return false
+	}
+	return ida == idb
+}
+
+// largest returns the index of the largest value in a.
+func largest(a []int64) int {
+	var j int
+	for i := range a {
+		if a[i] > a[j] {
+			j = i
+		}
+	}
+	return j
+}
+
+// dirSize returns the total size of the files below path.
+func dirSize(path string) (int64, error) {
+	var sz int64
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			sz += fi.Size()
+		}
+		return nil
+	})
+	return sz, err
+}
+
+// spaceGuard reserves disk space for the shards being converted, so that a
+// shard which can't fit is skipped before it is started, rather than failing
+// once the disk fills.
+type spaceGuard struct {
+	mu       sync.Mutex
+	path     string
+	reserved uint64
+}
+
+// newSpaceGuard returns a guard for the disk where converted shards are written.
+func newSpaceGuard() *spaceGuard {
+	return &spaceGuard{path: outputPath()}
+}
+
+// outputPath returns the directory converted shards are written to, or
+// staged in when streamed.
+func outputPath() string {
+	if dir := outputDir(); dir != "" {
+		return dir
+	} else if opts.SinkCmd != "" {
+		return os.TempDir()
+	}
+	return opts.DataPath
+}
+
+// workingSet returns the most disk space converting the shard may use. tsm1
+// is never larger than the original, and streamed TSM files are only staged
+// until they are sent.
+func workingSet(si *tsdb.ShardInfo) uint64 {
+	n := uint64(si.Size)
+	if opts.SinkCmd != "" {
+		if staged := opts.TSMSize * uint64(opts.MeasurementParallel); staged < n {
+			n = staged
+		}
+	}
+	return n
+}
+
+// reserve reserves space to convert the shard, or returns an error if there
+// is not enough. The space must be released once the shard is converted.
+func (g *spaceGuard) reserve(si *tsdb.ShardInfo) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	free, err := diskFree(g.path)
+	if err != nil {
+		// Space can't be checked, so don't prevent the conversion.
+		return nil
+	}
+
+	n := workingSet(si)
+	if g.reserved+n > free {
+		var available uint64
+		if free > g.reserved {
+			available = free - g.reserved
+		}
+		return fmt.Errorf("insufficient space in %v, shard needs up to %d bytes but %d are available: "+
+			"free space, write elsewhere with -out or -sink-cmd and TMPDIR, or lower -parallel", g.path, n, available)
+	}
+	g.reserved += n
+	return nil
+}
+
+// release releases the space reserved for the shard.
+func (g *spaceGuard) release(si *tsdb.ShardInfo) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.reserved -= workingSet(si)
+}
+
+// diskUsed returns the fraction of the filesystem holding path in use. It
+// is a variable so that tests can fill the disk.
+var diskUsed = diskUsage
+
+// diskUsagePoll is how often disk usage is checked while the conversion is
+// paused by -stop-at-disk-usage.
+var diskUsagePoll = 10 * time.Second
+
+// waitForDiskUsage blocks while the disk holding path is used at or above
+// opts.StopAtDiskUsage, such as while another process fills it, so that
+// shards aren't started until space is freed.
+func waitForDiskUsage(path string) {
+	if opts.StopAtDiskUsage <= 0 {
+		return
+	}
+
+	var paused bool
+	for {
+		used, err := diskUsed(path)
+		if err != nil || used < opts.StopAtDiskUsage {
+			// Usage can't be checked, so don't prevent the conversion.
+			break
+		}
+		if !paused {
+			logger.Warnf("Pausing, %v is %.0f%% full, at or above -stop-at-disk-usage of %.0f%%: free space to resume\n",
+				path, used*100, opts.StopAtDiskUsage*100)
+			paused = true
+		}
+		time.Sleep(diskUsagePoll)
+	}
+	if paused {
+		logger.Infof("Resuming, disk usage of %v is below %.0f%%\n", path, opts.StopAtDiskUsage*100)
+	}
+}
+
+// parsePercent parses a percentage above 0 and at most 100, such as "90%",
+// as a fraction.
+func parsePercent(s string) (float64, error) {
+	n, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || n <= 0 || n > 100 {
+		return 0, fmt.Errorf("bad percentage %q, must be above 0 and at most 100, such as 90%%", s)
+	}
+	return n / 100, nil
+}
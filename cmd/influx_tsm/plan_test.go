@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Ensure the space required on a filesystem is totalled across its uses.
+func TestRequiredSpace(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	MustWriteFile(filepath.Join(dir, "data", "db0", "default", "1"), "0123456789")
+	MustWriteFile(filepath.Join(dir, "data", "db1", "default", "2"), "01234")
+
+	defer func(o options) { opts = o }(opts)
+	opts = options{DataPath: filepath.Join(dir, "data"), BackupDir: filepath.Join(dir, "backups", "new"), Parallel: 1}
+	shards := tsdb.ShardInfos{
+		{Database: "db0", RetentionPolicy: "default", Path: "1", Size: 10},
+		{Database: "db1", RetentionPolicy: "default", Path: "2", Size: 5},
+	}
+
+	vols := requiredSpace(shards, nil)
+	if len(vols) != 1 {
+		t.Fatalf("unexpected volumes: %d", len(vols))
+	}
+	v := vols[0]
+	if v.path != dir {
+		t.Fatalf("unexpected path: %v", v.path)
+	} else if !reflect.DeepEqual(v.uses, []string{"backups", "converted shards"}) {
+		t.Fatalf("unexpected uses: %v", v.uses)
+	} else if v.required != 30 {
+		t.Fatalf("unexpected required space: %d", v.required)
+	}
+
+	// Databases already backed up need no more space.
+	checkpoint, err := OpenCheckpoint(filepath.Join(dir, checkpointFile), "in-place")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkpoint.BackedUp("db0"); err != nil {
+		t.Fatal(err)
+	}
+	MustWriteFile(opts.BackupPath("db0"), "")
+	if vols := requiredSpace(shards, checkpoint); vols[0].required != 20 {
+		t.Fatalf("unexpected required space: %d", vols[0].required)
+	}
+
+	if !enoughSpace([]*volume{{required: 10, free: 10}}) {
+		t.Fatal("expected enough space")
+	} else if enoughSpace([]*volume{{required: 10, free: 10}, {required: 11, free: 10}}) {
+		t.Fatal("expected insufficient space")
+	}
+}
+
+// Ensure shards aren't started while the disk is too full, until space is freed.
+func TestWaitForDiskUsage(t *testing.T) {
+	defer func(o options) { opts = o }(opts)
+	opts.StopAtDiskUsage = 0.9
+
+	defer func(f func(string) (float64, error), d time.Duration) { diskUsed, diskUsagePoll = f, d }(diskUsed, diskUsagePoll)
+	diskUsagePoll = time.Millisecond
+	usage := []float64{0.95, 0.9, 0.5}
+	var polls int
+	diskUsed = func(path string) (float64, error) {
+		if path != "data" {
+			t.Fatalf("unexpected path: %v", path)
+		}
+		polls++
+		return usage[polls-1], nil
+	}
+
+	waitForDiskUsage("data")
+	if polls != 3 {
+		t.Fatalf("unexpected polls: %d", polls)
+	}
+
+	// Usage is only checked with -stop-at-disk-usage.
+	polls = 0
+	opts.StopAtDiskUsage = 0
+	waitForDiskUsage("data")
+	if polls != 0 {
+		t.Fatalf("unexpected polls: %d", polls)
+	}
+}
+
+// Ensure disk usage percentages are parsed as fractions.
+func TestParsePercent(t *testing.T) {
+	for _, tt := range []struct {
+		s   string
+		v   float64
+		err bool
+	}{
+		{s: "90%", v: 0.9},
+		{s: " 50 ", v: 0.5},
+		{s: "100%", v: 1},
+		{s: "0%", err: true},
+		{s: "101%", err: true},
+		{s: "ninety", err: true},
+	} {
+		v, err := parsePercent(tt.s)
+		if tt.err && err == nil {
+			t.Errorf("%q: expected error", tt.s)
+		} else if !tt.err && (err != nil || v != tt.v) {
+			t.Errorf("%q: unexpected value: %v, %v", tt.s, v, err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/influxdb/influxdb/client"
+	"github.com/influxdb/influxdb/influxql"
+)
+
+const postCheckUsage = `Usage: influx_tsm post-check [options] <data-path>
+
+Check the data served by influxd, once restarted on the converted shards,
+against the data recorded when each shard was converted. The databases and
+measurements of converted shards must exist, and a sample of fields must
+have as many values within each shard's time range as were converted.
+
+Options:`
+
+// defaultPostCheckSamples is the default number of fields whose values are counted.
+const defaultPostCheckSamples = 10
+
+func runPostCheck(args []string) error {
+	fs := flag.NewFlagSet("post-check", flag.ExitOnError)
+	rawURL := fs.String("url", "http://localhost:8086", "URL of the influxd HTTP API.")
+	username := fs.String("username", "", "Username to authenticate with.")
+	password := fs.String("password", "", "Password to authenticate with.")
+	samples := fs.Int("samples", defaultPostCheckSamples, "Number of fields whose values are counted.")
+	path := fs.String("history-file", "", "File recording the data of converted shards. Default is '"+historyFile+"' in the data directory, if writable.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, postCheckUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *path == "" {
+		if len(fs.Args()) < 1 {
+			return fmt.Errorf("no data directory specified")
+		}
+		*path = defaultHistoryFile(fs.Args()[0])
+	}
+
+	records, err := NewHistory(*path).Records()
+	if err != nil {
+		return fmt.Errorf("read history %v: %v", *path, err)
+	} else if len(records) == 0 {
+		return fmt.Errorf("no converted shards recorded in %v", *path)
+	}
+
+	u, err := url.Parse(*rawURL)
+	if err != nil {
+		return fmt.Errorf("bad url %v: %v", *rawURL, err)
+	}
+	c, err := client.NewClient(client.Config{URL: *u, Username: *username, Password: *password, UserAgent: "influx_tsm"})
+	if err != nil {
+		return err
+	}
+
+	n, err := postCheck(c, records, *samples, os.Stdout)
+	if err != nil {
+		return err
+	} else if n > 0 {
+		return fmt.Errorf("post-check failed, %d check(s) did not match", n)
+	}
+	return nil
+}
+
+// postCheck runs the checks of the recorded shards against the server,
+// writing the result of each to w, and returns the number which failed.
+func postCheck(c *client.Client, records []*ShardRecord, samples int, w io.Writer) (int, error) {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "Check\tExpected\tActual\tStatus")
+
+	var failed int
+	check := func(name string, exp, got interface{}) {
+		status := "ok"
+		if exp != got {
+			status = "MISMATCH"
+			failed++
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", name, exp, got, status)
+	}
+
+	// Group the recorded measurements by database.
+	var dbs []string
+	measurements := make(map[string]map[string]bool)
+	for _, r := range records {
+		if measurements[r.Database] == nil {
+			measurements[r.Database] = make(map[string]bool)
+			dbs = append(dbs, r.Database)
+		}
+		for m := range r.Counts {
+			measurements[r.Database][m] = true
+		}
+	}
+
+	databases, err := queryNames(c, "", "SHOW DATABASES")
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(dbs)
+	for _, db := range dbs {
+		check("database "+db, "present", presence(databases[db]))
+		if !databases[db] {
+			continue
+		}
+
+		names, err := queryNames(c, db, "SHOW MEASUREMENTS")
+		if err != nil {
+			return 0, err
+		}
+		for _, m := range sortedKeys(measurements[db]) {
+			check("measurement "+db+"."+m, "present", presence(names[m]))
+		}
+	}
+
+	for _, s := range sampleCounts(records, samples) {
+		got, err := queryCount(c, s)
+		if err != nil {
+			return 0, err
+		}
+		check(fmt.Sprintf("count %v.%v.%v.%v in shard %v", s.record.Database, s.record.RetentionPolicy, s.measurement, s.field, s.record.Path), s.count, got)
+	}
+
+	return failed, tw.Flush()
+}
+
+func presence(ok bool) string {
+	if ok {
+		return "present"
+	}
+	return "missing"
+}
+
+// countSample is the number of values of a field converted in a shard.
+type countSample struct {
+	record      *ShardRecord
+	measurement string
+	field       string
+	count       int64
+}
+
+// sampleCounts returns up to n field counts, spread evenly across the
+// records. Shards without points are skipped, as they have no time range.
+func sampleCounts(records []*ShardRecord, n int) []countSample {
+	var a []countSample
+	for _, r := range records {
+		if r.MinTime.IsZero() {
+			continue
+		}
+		names := make([]string, 0, len(r.Counts))
+		for m := range r.Counts {
+			names = append(names, m)
+		}
+		sort.Strings(names)
+		for _, m := range names {
+			fields := make([]string, 0, len(r.Counts[m]))
+			for f := range r.Counts[m] {
+				fields = append(fields, f)
+			}
+			sort.Strings(fields)
+			for _, f := range fields {
+				a = append(a, countSample{record: r, measurement: m, field: f, count: r.Counts[m][f]})
+			}
+		}
+	}
+	if n <= 0 {
+		return nil
+	} else if len(a) <= n {
+		return a
+	}
+
+	samples := make([]countSample, n)
+	for i := range samples {
+		samples[i] = a[i*len(a)/n]
+	}
+	return samples
+}
+
+// queryCount returns the number of values of the sampled field within the
+// time range of its shard.
+func queryCount(c *client.Client, s countSample) (int64, error) {
+	cmd := fmt.Sprintf("SELECT count(%v) FROM %v WHERE time >= %v AND time <= %v",
+		influxql.QuoteIdent(s.field),
+		influxql.QuoteIdent(s.record.RetentionPolicy, s.measurement),
+		influxql.QuoteString(s.record.MinTime.UTC().Format(time.RFC3339Nano)),
+		influxql.QuoteString(s.record.MaxTime.UTC().Format(time.RFC3339Nano)))
+
+	resp, err := query(c, s.record.Database, cmd)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range resp.Results {
+		for _, row := range r.Series {
+			if len(row.Values) > 0 && len(row.Values[0]) > 1 {
+				return toInt64(row.Values[0][1])
+			}
+		}
+	}
+	return 0, nil
+}
+
+// queryNames returns the set of values of the first column returned by a SHOW query.
+func queryNames(c *client.Client, db, cmd string) (map[string]bool, error) {
+	resp, err := query(c, db, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, r := range resp.Results {
+		for _, row := range r.Series {
+			for _, v := range row.Values {
+				if len(v) > 0 {
+					if s, ok := v[0].(string); ok {
+						names[s] = true
+					}
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// query runs cmd against db, returning any error of the response.
+func query(c *client.Client, db, cmd string) (*client.Response, error) {
+	resp, err := c.Query(client.Query{Command: cmd, Database: db})
+	if err != nil {
+		return nil, fmt.Errorf("query %q: %v", cmd, err)
+	} else if err := resp.Error(); err != nil {
+		return nil, fmt.Errorf("query %q: %v", cmd, err)
+	}
+	return resp, nil
+}
+
+// toInt64 converts a numeric value decoded from a query response.
+func toInt64(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return v.Int64()
+	case float64:
+		return int64(v), nil
+	default:
+		return 0, fmt.Errorf("unexpected count %v", v)
+	}
+}
+
+// sortedKeys returns the sorted keys of the set.
+func sortedKeys(m map[string]bool) []string {
+	a := make([]string, 0, len(m))
+	for k := range m {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	return a
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/client"
+)
+
+// Ensure post-check compares the recorded shards with the data served.
+func TestPostCheck(t *testing.T) {
+	responses := map[string]string{
+		"SHOW DATABASES":    `{"results":[{"series":[{"name":"databases","columns":["name"],"values":[["db0"]]}]}]}`,
+		"SHOW MEASUREMENTS": `{"results":[{"series":[{"name":"measurements","columns":["name"],"values":[["cpu"]]}]}]}`,
+		`SELECT count(value) FROM "default".cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:02Z'`: `{"results":[{"series":[{"name":"cpu","columns":["time","count"],"values":[["1970-01-01T00:00:01Z",3]]}]}]}`,
+		`SELECT count(value) FROM "default".mem WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:02Z'`: `{"results":[{}]}`,
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := responses[r.URL.Query().Get("q")]
+		if !ok {
+			t.Errorf("unexpected query: %s", r.URL.Query().Get("q"))
+		}
+		fmt.Fprint(w, resp)
+	}))
+	defer s.Close()
+
+	u, _ := url.Parse(s.URL)
+	c, err := client.NewClient(client.Config{URL: *u})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*ShardRecord{{
+		Database:        "db0",
+		RetentionPolicy: "default",
+		Path:            "1",
+		MinTime:         time.Unix(1, 0),
+		MaxTime:         time.Unix(2, 0),
+		Counts:          map[string]map[string]int64{"cpu": {"value": 3}, "mem": {"value": 1}},
+	}}
+
+	var buf bytes.Buffer
+	if n, err := postCheck(c, records, 10, &buf); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected failed check count: %d\n%s", n, buf.String())
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// profile is a named set of concurrency settings, scaled to the host. Only
+// the concurrency is set, as the memory and I/O to allow depend on what else
+// the host runs.
+type profile struct {
+	Parallel            int
+	MeasurementParallel int
+}
+
+// profiles returns the settings of each profile for a host with cpus CPUs.
+func profiles(cpus int) map[string]profile {
+	half := cpus / 2
+	if half < 1 {
+		half = 1
+	}
+	return map[string]profile{
+		// One shard at a time, as when no profile is given.
+		"conservative": {Parallel: 1, MeasurementParallel: 1},
+
+		// Leave half of the host for anything else it runs.
+		"balanced": {Parallel: half, MeasurementParallel: 1},
+
+		// Use the whole host, splitting shards so large ones don't
+		// leave CPUs idle at the end of the run.
+		"aggressive": {Parallel: cpus, MeasurementParallel: 2},
+	}
+}
+
+// lookupProfile returns the named profile for a host with cpus CPUs.
+func lookupProfile(name string, cpus int) (profile, error) {
+	a := profiles(cpus)
+	if p, ok := a[name]; ok {
+		return p, nil
+	}
+
+	var names []string
+	for k := range a {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return profile{}, fmt.Errorf("unknown profile %q, must be one of %v", name, strings.Join(names, ", "))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+// Ensure profiles scale with the host, and unknown profiles are rejected.
+func TestLookupProfile(t *testing.T) {
+	if p, err := lookupProfile("balanced", 8); err != nil {
+		t.Fatal(err)
+	} else if p.Parallel != 4 || p.MeasurementParallel != 1 {
+		t.Fatalf("unexpected profile: %+v", p)
+	}
+
+	if p, err := lookupProfile("balanced", 1); err != nil {
+		t.Fatal(err)
+	} else if p.Parallel != 1 {
+		t.Fatalf("unexpected profile: %+v", p)
+	}
+
+	if _, err := lookupProfile("fast", 8); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure a profile sets only the concurrency options not given explicitly.
+func TestOptions_Parse_Profile(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	var o options
+	if err := o.Parse([]string{"-profile", "aggressive", "-parallel", "3", dir}); err != nil {
+		t.Fatal(err)
+	} else if o.Parallel != 3 || o.MeasurementParallel != 2 {
+		t.Fatalf("unexpected concurrency: %d, %d", o.Parallel, o.MeasurementParallel)
+	} else if o.DatabaseParallel != 0 || o.MaxMemory != 0 || o.RateLimit != 0 {
+		t.Fatalf("unexpected limits: %d, %d, %v", o.DatabaseParallel, o.MaxMemory, o.RateLimit)
+	}
+
+	o = options{}
+	if err := o.Parse([]string{"-profile", "aggressive", dir}); err != nil {
+		t.Fatal(err)
+	} else if o.Parallel != runtime.NumCPU() {
+		t.Fatalf("unexpected parallelism: %d", o.Parallel)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// Progress reports the progress of the shards being converted, and of the
+// whole run, with an estimate of the time remaining. On a terminal the
+// report is redrawn in place every second, otherwise it is written as a
+// line every progressLogInterval.
+type Progress struct {
+	mu     sync.Mutex
+	w      io.Writer
+	tty    bool
+	start  time.Time
+	total  int64 // bytes of every shard
+	done   int64 // bytes of finished shards
+	shards []*ShardProgress
+	drawn  bool // whether a progress line is displayed
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// progressLogInterval is the interval progress is reported at when not on a terminal.
+const progressLogInterval = 30 * time.Second
+
+// NewProgress returns progress for converting shards, written to w, which
+// is redrawn in place if it is a terminal.
+func NewProgress(w io.Writer, shards tsdb.ShardInfos) *Progress {
+	p := &Progress{
+		w:       w,
+		tty:     isTerminal(w),
+		start:   time.Now(),
+		total:   shards.Size(),
+		closing: make(chan struct{}),
+	}
+
+	interval := progressLogInterval
+	if p.tty {
+		interval = time.Second
+	}
+	p.wg.Add(1)
+	go p.run(interval)
+	return p
+}
+
+// isTerminal returns whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *Progress) run(interval time.Duration) {
+	defer p.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.closing:
+			return
+		case <-t.C:
+			p.draw()
+		}
+	}
+}
+
+// Start returns the progress of a shard, as its conversion starts.
+func (p *Progress) Start(si *tsdb.ShardInfo) *ShardProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sp := &ShardProgress{si: si, start: time.Now()}
+	p.shards = append(p.shards, sp)
+	return sp
+}
+
+// Finish records the shard as finished, whether it converted or failed.
+func (p *Progress) Finish(sp *ShardProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, v := range p.shards {
+		if v == sp {
+			p.shards = append(p.shards[:i], p.shards[i+1:]...)
+			break
+		}
+	}
+	p.done += sp.si.Size
+}
+
+// Close stops reporting, and clears any progress displayed.
+func (p *Progress) Close() error {
+	close(p.closing)
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	return nil
+}
+
+// draw writes the progress of the run, and of each shard being converted.
+func (p *Progress) draw() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Shards in progress count by the fraction of their keys read.
+	done := float64(p.done)
+	for _, sp := range p.shards {
+		done += sp.fraction() * float64(sp.si.Size)
+	}
+	var f float64
+	if p.total > 0 {
+		f = done / float64(p.total)
+	}
+
+	a := []string{fmt.Sprintf("%.1f%% of %d bytes, ETA %v", f*100, p.total, eta(p.start, f))}
+	for _, sp := range p.shards {
+		a = append(a, sp.String())
+	}
+	line := strings.Join(a, "; ")
+
+	if p.tty {
+		p.clear()
+		fmt.Fprint(p.w, line)
+		p.drawn = true
+		return
+	}
+	fmt.Fprintf(p.w, "%v Progress: %v\n", time.Now().Format("2006/01/02 15:04:05"), line)
+}
+
+// clear erases the progress line from a terminal.
+func (p *Progress) clear() {
+	if p.drawn {
+		fmt.Fprint(p.w, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// Writer returns a writer which clears any progress displayed before
+// writing to w, so that logged lines aren't mixed with the progress line.
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	return progressWriter{p: p, w: w}
+}
+
+type progressWriter struct {
+	p *Progress
+	w io.Writer
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	pw.p.mu.Lock()
+	defer pw.p.mu.Unlock()
+	pw.p.clear()
+	return pw.w.Write(b)
+}
+
+// eta returns the estimated time remaining for work started at start
+// which is fraction f done.
+func eta(start time.Time, f float64) string {
+	if f <= 0 {
+		return "unknown"
+	} else if f >= 1 {
+		return "0s"
+	}
+	elapsed := time.Since(start)
+	return (time.Duration(float64(elapsed)*(1-f)/f) / time.Second * time.Second).String()
+}
+
+// ShardProgress is the progress of converting a single shard. It is safe for
+// concurrent use, and a nil ShardProgress records nothing.
+type ShardProgress struct {
+	keyN int64 // keys in the shard
+	keys int64 // keys read
+
+	si    *tsdb.ShardInfo
+	start time.Time
+}
+
+// SetKeyN sets the number of keys in the shard.
+func (sp *ShardProgress) SetKeyN(n int) {
+	if sp != nil {
+		atomic.StoreInt64(&sp.keyN, int64(n))
+	}
+}
+
+// fraction returns the fraction of the keys in the shard read.
+func (sp *ShardProgress) fraction() float64 {
+	keyN := atomic.LoadInt64(&sp.keyN)
+	if keyN == 0 {
+		return 0
+	}
+	f := float64(atomic.LoadInt64(&sp.keys)) / float64(keyN)
+	if f > 1 {
+		f = 1
+	}
+	return f
+}
+
+// String returns the progress of the shard, as its keys, bytes and time remaining.
+func (sp *ShardProgress) String() string {
+	f := sp.fraction()
+	return fmt.Sprintf("%v/%v/%v: %d/%d keys, %d/%d bytes, ETA %v",
+		sp.si.Database, sp.si.RetentionPolicy, sp.si.Path,
+		atomic.LoadInt64(&sp.keys), atomic.LoadInt64(&sp.keyN),
+		int64(f*float64(sp.si.Size)), sp.si.Size, eta(sp.start, f))
+}
+
+// Iterator returns a KeyIterator recording the keys read from itr.
+func (sp *ShardProgress) Iterator(itr KeyIterator) KeyIterator {
+	if sp == nil {
+		return itr
+	}
+	return &progressIterator{KeyIterator: itr, sp: sp}
+}
+
+// progressIterator is a KeyIterator recording the keys read through it.
+type progressIterator struct {
+	KeyIterator
+	sp   *ShardProgress
+	prev string
+}
+
+func (itr *progressIterator) Read() (string, []tsm1.Value, error) {
+	k, v, err := itr.KeyIterator.Read()
+	if err == nil {
+		// A key's values may be read in several chunks.
+		if k != itr.prev {
+			atomic.AddInt64(&itr.sp.keys, 1)
+			itr.prev = k
+		}
+	}
+	return k, v, err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// Ensure progress is reported by the keys read of each shard, and for the run.
+func TestProgress(t *testing.T) {
+	shards := tsdb.ShardInfos{
+		{Database: "db0", RetentionPolicy: "default", Path: "1", Size: 1000},
+		{Database: "db0", RetentionPolicy: "default", Path: "2", Size: 1000},
+	}
+
+	var buf bytes.Buffer
+	p := NewProgress(&buf, shards)
+	defer p.Close()
+
+	p.Finish(p.Start(shards[0]))
+
+	sp := p.Start(shards[1])
+	sp.SetKeyN(4)
+	v := tsm1.NewValue(time.Unix(1, 0), 1.0)
+	itr := sp.Iterator(&sliceIterator{
+		keys:   []string{"cpu#!~#value", "cpu#!~#value", "mem#!~#value"},
+		values: [][]tsm1.Value{{v}, {v}, {v}},
+	})
+	for itr.Next() {
+		itr.Read()
+	}
+
+	p.draw()
+	if s := buf.String(); !strings.Contains(s, "Progress: 75.0% of 2000 bytes") ||
+		!strings.Contains(s, "db0/default/2: 2/4 keys, 500/1000 bytes") {
+		t.Fatalf("unexpected progress: %s", s)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// shardQueue hands out shards to be converted, in order, limiting how many
+// shards of each database are converted at once. Converting few shards of a
+// database at a time keeps the pages of its shards in the page cache.
+type shardQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	shards tsdb.ShardInfos
+	active map[string]int
+	limit  int
+}
+
+// newShardQueue returns a queue of shards, converting at most limit of each
+// database at once. A limit of 0 is no limit.
+func newShardQueue(shards tsdb.ShardInfos, limit int) *shardQueue {
+	q := &shardQueue{
+		shards: append(tsdb.ShardInfos(nil), shards...),
+		active: make(map[string]int),
+		limit:  limit,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Next returns the first shard whose database is below its limit, waiting
+// until one is, or nil once every shard has been handed out. Done must be
+// called once the shard is converted.
+func (q *shardQueue) Next() *tsdb.ShardInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.shards) > 0 {
+		for i, si := range q.shards {
+			if q.limit == 0 || q.active[si.Database] < q.limit {
+				q.shards = append(q.shards[:i], q.shards[i+1:]...)
+				q.active[si.Database]++
+				return si
+			}
+		}
+		q.cond.Wait()
+	}
+	return nil
+}
+
+// Done records that the conversion of the shard has finished.
+func (q *shardQueue) Done(si *tsdb.ShardInfo) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.active[si.Database]--
+	q.cond.Broadcast()
+}
+
+// Order is the order in which shards are converted.
+type Order int
+
+const (
+	// OrderDB converts the shards of each database in turn, by retention
+	// policy and path.
+	OrderDB Order = iota
+
+	// OrderLargestFirst converts the largest shards first.
+	OrderLargestFirst
+
+	// OrderSmallestFirst converts the smallest shards first.
+	OrderSmallestFirst
+
+	// OrderOldestFirst converts the shards with the earliest points first.
+	OrderOldestFirst
+
+	// OrderNewestFirst converts the shards with the latest points first.
+	OrderNewestFirst
+)
+
+var orderNames = []string{"db-order", "largest-first", "smallest-first", "oldest-first", "newest-first"}
+
+func (o Order) String() string {
+	return orderNames[o]
+}
+
+// ParseOrder returns the order of the given name.
+func ParseOrder(s string) (Order, error) {
+	for i, name := range orderNames {
+		if strings.EqualFold(s, name) {
+			return Order(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown order %q, must be one of %v", s, strings.Join(orderNames, ", "))
+}
+
+// Sort sorts the shards in the order. Shards which are equal in the order
+// are kept in database order.
+func (o Order) Sort(shards tsdb.ShardInfos) {
+	sort.Sort(shards)
+	switch o {
+	case OrderLargestFirst:
+		sort.Stable(shardsBy{shards, func(a, b *tsdb.ShardInfo) bool { return a.Size > b.Size }})
+	case OrderSmallestFirst:
+		sort.Stable(shardsBy{shards, func(a, b *tsdb.ShardInfo) bool { return a.Size < b.Size }})
+	case OrderOldestFirst:
+		sort.Stable(shardsBy{shards, func(a, b *tsdb.ShardInfo) bool { return a.MinTime.Before(b.MinTime) }})
+	case OrderNewestFirst:
+		sort.Stable(shardsBy{shards, func(a, b *tsdb.ShardInfo) bool { return a.MaxTime.After(b.MaxTime) }})
+	}
+}
+
+// shardsBy sorts shards by a less function.
+type shardsBy struct {
+	shards tsdb.ShardInfos
+	less   func(a, b *tsdb.ShardInfo) bool
+}
+
+func (s shardsBy) Len() int           { return len(s.shards) }
+func (s shardsBy) Swap(i, j int)      { s.shards[i], s.shards[j] = s.shards[j], s.shards[i] }
+func (s shardsBy) Less(i, j int) bool { return s.less(s.shards[i], s.shards[j]) }
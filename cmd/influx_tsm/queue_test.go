@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Ensure shards are handed out in order, skipping databases at their limit.
+func TestShardQueue(t *testing.T) {
+	shards := tsdb.ShardInfos{
+		{Database: "db0", Path: "1"},
+		{Database: "db0", Path: "2"},
+		{Database: "db1", Path: "3"},
+		{Database: "db1", Path: "4"},
+	}
+	q := newShardQueue(shards, 1)
+
+	// Fill the limit of db0.
+	if si := q.Next(); si != shards[0] {
+		t.Fatalf("unexpected shard: %+v", si)
+	}
+
+	// Another database is not blocked by db0.
+	if si := nextWithin(q, time.Second); si != shards[2] {
+		t.Fatalf("unexpected shard: %+v", si)
+	}
+
+	// Both databases are at their limit, so the next shard waits until one
+	// is done.
+	ch := make(chan *tsdb.ShardInfo)
+	go func() { ch <- q.Next() }()
+	select {
+	case si := <-ch:
+		t.Fatalf("shard handed out above the limit: %+v", si)
+	case <-time.After(100 * time.Millisecond):
+	}
+	q.Done(shards[0])
+	select {
+	case si := <-ch:
+		if si != shards[1] {
+			t.Fatalf("unexpected shard: %+v", si)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shard not handed out once its database was below its limit")
+	}
+
+	q.Done(shards[2])
+	if si := nextWithin(q, time.Second); si != shards[3] {
+		t.Fatalf("unexpected shard: %+v", si)
+	}
+	if si := nextWithin(q, time.Second); si != nil {
+		t.Fatalf("unexpected shard: %+v", si)
+	}
+}
+
+// nextWithin returns the next shard of q, failing if it blocks for longer
+// than d.
+func nextWithin(q *shardQueue, d time.Duration) *tsdb.ShardInfo {
+	ch := make(chan *tsdb.ShardInfo, 1)
+	go func() { ch <- q.Next() }()
+	select {
+	case si := <-ch:
+		return si
+	case <-time.After(d):
+		panic("queue blocked")
+	}
+}
+
+// Ensure every shard is handed out at once without a limit.
+func TestShardQueue_NoLimit(t *testing.T) {
+	shards := tsdb.ShardInfos{{Database: "db0", Path: "1"}, {Database: "db0", Path: "2"}}
+	q := newShardQueue(shards, 0)
+	for i := range shards {
+		if si := q.Next(); si != shards[i] {
+			t.Fatalf("unexpected shard %d: %+v", i, si)
+		}
+	}
+	if si := q.Next(); si != nil {
+		t.Fatalf("unexpected shard: %+v", si)
+	}
+}
+
+// Ensure shards are sorted in each order, ties kept in database order.
+func TestOrder_Sort(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	shards := func() tsdb.ShardInfos {
+		return tsdb.ShardInfos{
+			{Database: "db1", Path: "3", Size: 20, MinTime: t0.Add(2 * time.Hour), MaxTime: t0.Add(3 * time.Hour)},
+			{Database: "db0", Path: "2", Size: 10, MinTime: t0, MaxTime: t0.Add(time.Hour)},
+			{Database: "db0", Path: "1", Size: 20, MinTime: t0.Add(time.Hour), MaxTime: t0.Add(2 * time.Hour)},
+		}
+	}
+
+	for _, tt := range []struct {
+		order string
+		exp   []string
+	}{
+		{order: "db-order", exp: []string{"1", "2", "3"}},
+		{order: "largest-first", exp: []string{"1", "3", "2"}},
+		{order: "smallest-first", exp: []string{"2", "1", "3"}},
+		{order: "oldest-first", exp: []string{"2", "1", "3"}},
+		{order: "newest-first", exp: []string{"3", "1", "2"}},
+	} {
+		o, err := ParseOrder(tt.order)
+		if err != nil {
+			t.Fatal(err)
+		} else if o.String() != tt.order {
+			t.Fatalf("%v: unexpected name: %v", tt.order, o)
+		}
+
+		a := shards()
+		o.Sort(a)
+		var paths []string
+		for _, si := range a {
+			paths = append(paths, si.Path)
+		}
+		if !reflect.DeepEqual(paths, tt.exp) {
+			t.Fatalf("%v: unexpected order: %v", tt.order, paths)
+		}
+	}
+
+	if _, err := ParseOrder("random"); err == nil {
+		t.Fatal("expected error for unknown order")
+	}
+}
+
+// Ensure -max-parallel-per-db sets the limit of shards per database.
+func TestOptions_Parse_MaxParallelPerDB(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	var o options
+	if err := o.Parse([]string{"-max-parallel-per-db", "2", dir}); err != nil {
+		t.Fatal(err)
+	} else if o.DatabaseParallel != 2 {
+		t.Fatalf("unexpected database parallelism: %d", o.DatabaseParallel)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// limiter limits the disk I/O of the current run, if not nil.
+var limiter *RateLimiter
+
+// RateLimiter is a token bucket limiting the rate of I/O, in bytes per
+// second, shared by every reader and writer it wraps. Up to a second of I/O
+// may burst after a pause. A nil RateLimiter does not limit.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate bytes per second.
+func NewRateLimiter(rate float64) *RateLimiter {
+	return &RateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// Wait blocks until n bytes of I/O are allowed. I/O larger than the bucket
+// is allowed once the bucket has refilled for it.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	// Take the tokens, going into debt if there are too few, so that later
+	// callers wait for this one's I/O too.
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(d)
+}
+
+// Reader returns a reader limiting the rate of reads from r.
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+// limitedReader is a reader waiting for the bytes it has read.
+type limitedReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// Read at most a second's worth at once, so reads are spread evenly.
+	if max := int(r.l.rate); len(p) > max && max > 0 {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	r.l.Wait(n)
+	return n, err
+}
+
+// Sink returns a sink limiting the rate of writes to s.
+func (l *RateLimiter) Sink(s Sink) Sink {
+	if l == nil {
+		return s
+	}
+	return &limitedSink{Sink: s, l: l}
+}
+
+// limitedSink is a Sink whose files wait for the bytes written to them.
+type limitedSink struct {
+	Sink
+	l *RateLimiter
+}
+
+func (s *limitedSink) Create(path string) (io.WriteCloser, error) {
+	w, err := s.Sink.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedWriter{WriteCloser: w, l: s.l}, nil
+}
+
+// limitedWriter waits for the bytes it is about to write.
+type limitedWriter struct {
+	io.WriteCloser
+	l *RateLimiter
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.l.Wait(len(p))
+	return w.WriteCloser.Write(p)
+}
+
+// Iterator returns an iterator limiting the rate keys are read from a shard.
+// Shards are memory-mapped, so their reads can't be counted; each key read is
+// instead taken to read its share, sz, of the shard.
+func (l *RateLimiter) Iterator(itr KeyIterator, sz int64) KeyIterator {
+	if l == nil {
+		return itr
+	}
+	return &limitedIterator{KeyIterator: itr, l: l, sz: int(sz)}
+}
+
+// limitedIterator is a KeyIterator waiting as each key is first read.
+type limitedIterator struct {
+	KeyIterator
+	l    *RateLimiter
+	sz   int
+	last string
+}
+
+func (itr *limitedIterator) Read() (string, []tsm1.Value, error) {
+	k, v, err := itr.KeyIterator.Read()
+	if err == nil && k != itr.last {
+		itr.last = k
+		itr.l.Wait(itr.sz)
+	}
+	return k, v, err
+}
+
+// parseRate parses a rate of bytes per second, such as "50MB/s", with an
+// optional unit of B, KB, MB or GB. Units are powers of 1000.
+func parseRate(s string) (float64, error) {
+	n, err := parseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("bad rate %q, must be positive, such as 50MB/s", s)
+	}
+	return n, nil
+}
+
+// parseSize parses a positive number of bytes, such as "2GB", with an
+// optional unit of B, KB, MB or GB. Units are powers of 1000.
+func parseSize(s string) (float64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+
+	mult := 1.0
+	for _, u := range []struct {
+		suffix string
+		mult   float64
+	}{{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1}} {
+		if strings.HasSuffix(v, u.suffix) {
+			v, mult = strings.TrimSuffix(v, u.suffix), u.mult
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad size %q, must be positive, such as 2GB", s)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Ensure I/O beyond the burst waits for the bucket to refill.
+func TestRateLimiter_Wait(t *testing.T) {
+	l := NewRateLimiter(10000)
+
+	start := time.Now()
+	l.Wait(10000)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("burst waited %v", d)
+	}
+
+	if _, err := ioutil.ReadAll(l.Reader(bytes.NewReader(make([]byte, 2000)))); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("read waited only %v", d)
+	}
+
+	// A nil limiter doesn't wait.
+	var nl *RateLimiter
+	nl.Wait(1 << 30)
+}
+
+func TestParseRate(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		rate float64
+		err  bool
+	}{
+		{s: "50MB/s", rate: 50e6},
+		{s: "1.5gb/s", rate: 1.5e9},
+		{s: "100KB", rate: 100e3},
+		{s: "2048", rate: 2048},
+		{s: "10B/s", rate: 10},
+		{s: "0MB/s", err: true},
+		{s: "fast", err: true},
+	} {
+		rate, err := parseRate(tt.s)
+		if tt.err != (err != nil) {
+			t.Fatalf("%v: unexpected error: %v", tt.s, err)
+		} else if rate != tt.rate {
+			t.Fatalf("%v: unexpected rate: %v", tt.s, rate)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Report summarizes a conversion run.
+type Report struct {
+	Host      string          `json:"host"`
+	DataPath  string          `json:"dataPath"`
+	Start     time.Time       `json:"start"`
+	End       time.Time       `json:"end"`
+	Converted tsdb.ShardInfos `json:"converted"`
+	Failed    tsdb.ShardInfos `json:"failed"`
+	Stale     tsdb.ShardInfos `json:"stale,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Shards    []*ShardResult  `json:"shards"`
+	Usage     *Usage          `json:"usage,omitempty"`
+}
+
+// ShardResult is the outcome of converting a single shard.
+type ShardResult struct {
+	Shard      *tsdb.ShardInfo `json:"shard"`
+	Duration   time.Duration   `json:"duration"`
+	InputSize  int64           `json:"inputSize"`
+	OutputSize int64           `json:"outputSize"`
+	Points     int64           `json:"points"`
+	Retries    int             `json:"retries,omitempty"`
+	Error      string          `json:"error,omitempty"`
+
+	// Source is the checksum of the original shard, and Files of the
+	// files written, for the conversion manifest.
+	Source *FileChecksum   `json:"source,omitempty"`
+	Files  []*FileChecksum `json:"files,omitempty"`
+}
+
+// Ratio returns the size of the converted shard relative to the original.
+func (r *ShardResult) Ratio() float64 {
+	if r.InputSize == 0 {
+		return 0
+	}
+	return float64(r.OutputSize) / float64(r.InputSize)
+}
+
+// Result returns the outcome of the run as a single line of space-separated
+// key=value pairs, for scripts. The status is ok, failed if any shard failed
+// to convert, or error if the run stopped.
+func (r *Report) Result() string {
+	status := "ok"
+	if r.Error != "" {
+		status = "error"
+	} else if len(r.Failed) > 0 {
+		status = "failed"
+	}
+
+	var input, output, points int64
+	for _, sr := range r.Shards {
+		if sr.Error == "" {
+			input += sr.InputSize
+			output += sr.OutputSize
+			points += sr.Points
+		}
+	}
+
+	var d time.Duration
+	if !r.Start.IsZero() && r.End.After(r.Start) {
+		d = r.End.Sub(r.Start)
+	}
+
+	line := fmt.Sprintf("status=%s converted=%d failed=%d input_bytes=%d output_bytes=%d points=%d duration=%.3fs",
+		status, len(r.Converted), len(r.Failed), input, output, points, d.Seconds())
+	if r.Error != "" {
+		line += fmt.Sprintf(" error=%q", r.Error)
+	}
+	return line
+}
+
+// WriteSummary writes a table of the result of each shard, and their totals,
+// followed by the resources used by the run, if known.
+func (r *Report) WriteSummary(w io.Writer) error {
+	total := &ShardResult{}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "Database\tRetention\tPath\tStatus\tDuration\tInput\tOutput\tRatio\tPoints")
+	for _, sr := range r.Shards {
+		status := "ok"
+		if sr.Error != "" {
+			status = "FAILED"
+		} else {
+			total.InputSize += sr.InputSize
+			total.OutputSize += sr.OutputSize
+			total.Points += sr.Points
+		}
+		total.Duration += sr.Duration
+
+		si := sr.Shard
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%d\t%d\t%.1f%%\t%d\n", si.Database, si.RetentionPolicy, si.FullPath(r.DataPath), status,
+			roundDuration(sr.Duration), sr.InputSize, sr.OutputSize, 100*sr.Ratio(), sr.Points)
+	}
+	fmt.Fprintf(tw, "Total\t\t\t%d shard(s)\t%v\t%d\t%d\t%.1f%%\t%d\n", len(r.Shards),
+		roundDuration(total.Duration), total.InputSize, total.OutputSize, 100*total.Ratio(), total.Points)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if r.Usage != nil {
+		fmt.Fprintln(w, "\nResources:")
+		return r.Usage.Write(w)
+	}
+	return nil
+}
+
+// roundDuration rounds d to the millisecond, for display.
+func roundDuration(d time.Duration) time.Duration {
+	return d / time.Millisecond * time.Millisecond
+}
+
+// WriteJSON writes the report as JSON to the file at path.
+func (r *Report) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0666)
+}
+
+// Succeeded returns whether every shard was converted.
+func (r *Report) Succeeded() bool {
+	return r.Error == "" && len(r.Failed) == 0
+}
+
+// String returns a plain-text summary of the run.
+func (r *Report) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Conversion of %v on %v ", r.DataPath, r.Host)
+	if r.Succeeded() {
+		fmt.Fprintln(&buf, "completed.")
+	} else {
+		fmt.Fprintln(&buf, "failed.")
+	}
+	fmt.Fprintln(&buf)
+	fmt.Fprintf(&buf, "Started:   %v\n", r.Start.Format(time.RFC3339))
+	fmt.Fprintf(&buf, "Finished:  %v (%v)\n", r.End.Format(time.RFC3339), r.End.Sub(r.Start))
+	fmt.Fprintf(&buf, "Converted: %d shard(s)\n", len(r.Converted))
+	fmt.Fprintf(&buf, "Failed:    %d shard(s)\n", len(r.Failed))
+	if len(r.Stale) > 0 {
+		fmt.Fprintf(&buf, "Skipped:   %d shard(s), older than -skip-older-than\n", len(r.Stale))
+	}
+
+	if r.Error != "" {
+		fmt.Fprintf(&buf, "\nError: %v\n", r.Error)
+	}
+	if len(r.Failed) > 0 {
+		fmt.Fprintln(&buf, "\nThese shards failed to convert, and are unchanged:")
+		for _, si := range r.Failed {
+			fmt.Fprintln(&buf, si.FullPath(r.DataPath))
+		}
+	}
+	return buf.String()
+}
+
+// report is the report of the current run.
+var report = &Report{}
+
+// fatalf logs the error, mails the report of the failed run, and exits.
+func fatalf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	logger.Errorf("%v", msg)
+
+	report.Error = strings.TrimSpace(msg)
+	report.End = time.Now()
+	if err := mailReport(report); err != nil {
+		logger.Warnf("Failed to mail report: %v\n", err)
+	}
+	exit(1)
+}
+
+// osExit exits the process, replaced by tests running commands in-process.
+var osExit = os.Exit
+
+// exit prints the result of the run, if -q was given, and exits with code.
+func exit(code int) {
+	printResult()
+	osExit(code)
+}
+
+// printResult prints the result of the run as a single line, if -q was given.
+func printResult() {
+	if opts.Quiet {
+		fmt.Println(report.Result())
+	}
+}
+
+// mailReport mails the report to the recipients given by opts, if any.
+func mailReport(r *Report) error {
+	if len(opts.MailTo) == 0 {
+		return nil
+	}
+
+	msg, err := newReportMessage(r, opts.MailFrom, opts.MailTo)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(opts.SMTPServer, nil, opts.MailFrom, opts.MailTo, msg)
+}
+
+// newReportMessage returns an email of the report, with the summary as the
+// body and the full report attached as JSON.
+func newReportMessage(r *Report, from string, to []string) ([]byte, error) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	subject := "influx_tsm: conversion completed on " + r.Host
+	if !r.Succeeded() {
+		subject = "influx_tsm: conversion FAILED on " + r.Host
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	// Summary.
+	w, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.Write([]byte(strings.Replace(r.String(), "\n", "\r\n", -1)))
+
+	// Full report.
+	w, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/json"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {`attachment; filename="report.json"`},
+	})
+	if err != nil {
+		return nil, err
+	}
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		fmt.Fprintf(w, "%s\r\n", enc[:76])
+		enc = enc[76:]
+	}
+	fmt.Fprintf(w, "%s\r\n", enc)
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n", mw.Boundary())
+	fmt.Fprintf(&buf, "\r\n")
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Ensure the report email has a plain-text summary and the JSON report attached.
+func TestNewReportMessage(t *testing.T) {
+	r := &Report{
+		Host:      "host0",
+		DataPath:  "/data",
+		Start:     time.Unix(0, 0).UTC(),
+		End:       time.Unix(10, 0).UTC(),
+		Converted: tsdb.ShardInfos{{Database: "db0", RetentionPolicy: "default", Path: "1"}},
+		Failed:    tsdb.ShardInfos{{Database: "db0", RetentionPolicy: "default", Path: "2"}},
+	}
+
+	b, err := newReportMessage(r, "from@example.com", []string{"a@example.com", "b@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	} else if s := msg.Header.Get("Subject"); s != "influx_tsm: conversion FAILED on host0" {
+		t.Fatalf("unexpected subject: %s", s)
+	} else if s := msg.Header.Get("To"); s != "a@example.com, b@example.com" {
+		t.Fatalf("unexpected recipients: %s", s)
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+
+	// Summary lists the failed shard.
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	} else if body, _ := ioutil.ReadAll(p); !strings.Contains(string(body), "/data/db0/default/2") {
+		t.Fatalf("unexpected summary: %s", body)
+	}
+
+	// Attachment holds the full report.
+	p, err = mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	} else if p.FileName() != "report.json" {
+		t.Fatalf("unexpected attachment: %s", p.FileName())
+	}
+
+	var other Report
+	if err := json.NewDecoder(base64.NewDecoder(base64.StdEncoding, p)).Decode(&other); err != nil {
+		t.Fatal(err)
+	} else if len(other.Converted) != 1 || len(other.Failed) != 1 || other.Host != "host0" {
+		t.Fatalf("unexpected report: %+v", other)
+	}
+}
+
+// Ensure the summary lists each shard, and totals those converted.
+func TestReport_WriteSummary(t *testing.T) {
+	r := &Report{
+		DataPath: "/data",
+		Shards: []*ShardResult{
+			{
+				Shard:      &tsdb.ShardInfo{Database: "db0", RetentionPolicy: "default", Path: "1"},
+				Duration:   1500 * time.Millisecond,
+				InputSize:  1000,
+				OutputSize: 250,
+				Points:     100,
+			},
+			{
+				Shard:     &tsdb.ShardInfo{Database: "db0", RetentionPolicy: "default", Path: "2"},
+				Duration:  500 * time.Millisecond,
+				InputSize: 2000,
+				Error:     "timeout",
+			},
+			{
+				Shard:      &tsdb.ShardInfo{Database: "db1", RetentionPolicy: "default", Path: "3"},
+				Duration:   time.Second,
+				InputSize:  3000,
+				OutputSize: 750,
+				Points:     300,
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteSummary(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	exp := [][]string{
+		{"Database", "Retention", "Path", "Status", "Duration", "Input", "Output", "Ratio", "Points"},
+		{"db0", "default", "/data/db0/default/1", "ok", "1.5s", "1000", "250", "25.0%", "100"},
+		{"db0", "default", "/data/db0/default/2", "FAILED", "500ms", "2000", "0", "0.0%", "0"},
+		{"db1", "default", "/data/db1/default/3", "ok", "1s", "3000", "750", "25.0%", "300"},
+		{"Total", "3", "shard(s)", "3s", "4000", "1000", "25.0%", "400"},
+	}
+	if len(lines) != len(exp) {
+		t.Fatalf("unexpected summary:\n%s", buf.String())
+	}
+	for i, line := range lines {
+		if got := strings.Fields(line); strings.Join(got, " ") != strings.Join(exp[i], " ") {
+			t.Fatalf("line %d: exp %v, got %v", i, exp[i], got)
+		}
+	}
+}
+
+// Ensure the shard results are written to the JSON report.
+func TestReport_WriteJSON(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	r := &Report{
+		Host: "host0",
+		Shards: []*ShardResult{{
+			Shard:      &tsdb.ShardInfo{Database: "db0", RetentionPolicy: "default", Path: "1"},
+			InputSize:  1000,
+			OutputSize: 250,
+			Points:     100,
+		}},
+	}
+
+	path := filepath.Join(dir, "summary.json")
+	if err := r.WriteJSON(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var other Report
+	if b, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(b, &other); err != nil {
+		t.Fatal(err)
+	} else if len(other.Shards) != 1 || other.Shards[0].Points != 100 || other.Shards[0].OutputSize != 250 || other.Shards[0].Shard.Path != "1" {
+		t.Fatalf("unexpected report: %+v", other.Shards)
+	}
+}
+
+// Ensure the result line gives the status and totals of the run.
+func TestReport_Result(t *testing.T) {
+	ok := &ShardResult{Shard: &tsdb.ShardInfo{Path: "1"}, InputSize: 1000, OutputSize: 250, Points: 100}
+	failed := &ShardResult{Shard: &tsdb.ShardInfo{Path: "2"}, InputSize: 2000, Error: "timeout"}
+	start := time.Unix(0, 0)
+
+	for _, tt := range []struct {
+		r   *Report
+		exp string
+	}{
+		{
+			r: &Report{Start: start, End: start.Add(1500 * time.Millisecond),
+				Converted: tsdb.ShardInfos{ok.Shard}, Shards: []*ShardResult{ok}},
+			exp: "status=ok converted=1 failed=0 input_bytes=1000 output_bytes=250 points=100 duration=1.500s",
+		},
+		{
+			r: &Report{Start: start, End: start.Add(2 * time.Second),
+				Converted: tsdb.ShardInfos{ok.Shard}, Failed: tsdb.ShardInfos{failed.Shard}, Shards: []*ShardResult{ok, failed}},
+			exp: "status=failed converted=1 failed=1 input_bytes=1000 output_bytes=250 points=100 duration=2.000s",
+		},
+		{
+			r:   &Report{End: start, Error: `backup of database "db0" failed`},
+			exp: `status=error converted=0 failed=0 input_bytes=0 output_bytes=0 points=0 duration=0.000s error="backup of database \"db0\" failed"`,
+		},
+	} {
+		if got := tt.r.Result(); got != tt.exp {
+			t.Errorf("exp %s, got %s", tt.exp, got)
+		}
+	}
+}
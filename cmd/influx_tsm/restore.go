@@ -0,0 +1,509 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// restoreDir is the directory, within the data directory, shards are staged
+// in while being restored.
+const restoreDir = ".restore"
+
+const restoreUsage = `Usage: influx_tsm restore [options] <data-path>
+
+Restore the shards of databases from the backups taken before conversion.
+influxd must be stopped first. Each shard is copied from its backup before
+any is replaced, and the shard it replaces is moved to the trash. If a
+shard can't be swapped into place, the shards already replaced are moved
+back from the trash. Shards created since the backup are
+left in place. Backups are verified against their manifest first, each
+shard against its checksum in the conversion manifest, if recorded, and the
+restored shards are read once in place.
+
+Options:`
+
+// backup is a backup of a database, taken before conversion.
+type backup struct {
+	db         string
+	path       string
+	compressed bool
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbs := fs.String("dbs", "", "Comma-delimited list of databases to restore. Default is every database with a backup.")
+	shards := fs.String("shards", "", "Comma-delimited list of shard IDs to restore. Default is every shard of the databases restored.")
+	backupDir := fs.String("backup-dir", "", "Directory the backups were written to, or s3://bucket/prefix for backups uploaded with -backup-s3. Default is the directory recorded in the conversion manifest, or the data directory.")
+	s3Endpoint := fs.String("s3-endpoint", "", "URL of the S3 service backups were uploaded to, such as of a compatible store. Default is the S3 endpoint of the region.")
+	force := fs.Bool("force", false, "Restore even if influxd appears to be running.")
+	pidFile := fs.String("pidfile", defaultPIDFile, "PID file of influxd, checked for a running process before restoring.")
+	influxdAddr := fs.String("influxd-addr", defaultInfluxdAddr, "Address of the influxd HTTP API, checked for a running influxd before restoring.")
+	manifestPath := fs.String("conversion-manifest", "", "Conversion manifest recording the backups and checksums of the shards. Default is '"+conversionManifestFile+"' in the data directory.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, restoreUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) < 1 {
+		return fmt.Errorf("no data directory specified")
+	}
+	dataPath := fs.Args()[0]
+	if *manifestPath == "" {
+		*manifestPath = filepath.Join(dataPath, conversionManifestFile)
+	}
+
+	// Shards held open by influxd must not be replaced.
+	if err := refuseRestoreIfRunning(influxdProcess(*pidFile, *influxdAddr), *force); err != nil {
+		return err
+	}
+
+	manifest, err := ReadConversionManifest(*manifestPath)
+	if err != nil {
+		return err
+	}
+	if *backupDir == "" {
+		*backupDir = manifest.BackupDir()
+	}
+	if *backupDir == "" {
+		*backupDir = dataPath
+	}
+
+	staging := filepath.Join(dataPath, restoreDir)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	// Backups in S3 are downloaded to the staging directory, to be restored
+	// as those on disk.
+	var backups []*backup
+	if strings.HasPrefix(*backupDir, s3Scheme) {
+		client, err := NewS3ClientFromEnv(*s3Endpoint)
+		if err != nil {
+			return err
+		}
+		backups, err = downloadS3Backups(client, *backupDir, *dbs, staging)
+		if err != nil {
+			return err
+		}
+	} else {
+		backups, err = selectBackups(*backupDir, *dbs)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Shards are selected by ID, the name of the shard within its retention policy.
+	keep := func(rel string) bool { return true }
+	if *shards != "" {
+		ids := make(map[string]bool)
+		for _, id := range strings.Split(*shards, ",") {
+			ids[id] = true
+		}
+		keep = func(rel string) bool { return ids[path.Base(rel)] }
+	}
+
+	// Stage every shard before replacing any, so that a bad backup changes nothing.
+	var restored []string
+	for _, b := range backups {
+		if err := verifyBackup(b); err != nil {
+			return err
+		}
+
+		rels, err := extractBackup(b, filepath.Join(staging, b.db), keep)
+		if err != nil {
+			return fmt.Errorf("extract backup %v: %v", b.path, err)
+		}
+		for _, rel := range rels {
+			restored = append(restored, filepath.Join(b.db, rel))
+		}
+	}
+	if len(restored) == 0 {
+		return fmt.Errorf("no shards selected to restore")
+	}
+	for _, rel := range restored {
+		if err := verifyRestoredShard(manifest, staging, rel); err != nil {
+			return err
+		}
+	}
+
+	dests := make([]string, len(restored))
+	for i, rel := range restored {
+		dests[i] = filepath.Join(dataPath, rel)
+	}
+	if err := refuseRestoreIfRunning(lockedShards(dests), *force); err != nil {
+		return err
+	}
+
+	// Swap each shard into place, keeping the shard it replaces in the trash.
+	trash := NewTrash(dataPath)
+	if err := swapRestoredShards(restored, dataPath, staging, trash); err != nil {
+		return err
+	}
+
+	// Validate that each restored shard can be read, and is no longer tsm1.
+	set := make(map[string]bool)
+	for _, rel := range restored {
+		set[rel] = true
+	}
+	for _, b := range backups {
+		infos, err := tsdb.NewDatabase(filepath.Join(dataPath, b.db)).Shards()
+		if err != nil {
+			return fmt.Errorf("validate database %v: %v", b.db, err)
+		}
+		for _, si := range infos {
+			rel := filepath.Join(si.Database, si.RetentionPolicy, si.Path)
+			if set[rel] && si.Format == tsdb.TSM1 {
+				return fmt.Errorf("validate shard %v: restored as %v", rel, si.FormatAsString())
+			}
+		}
+	}
+
+	fmt.Printf("Restored %d shard(s). Replaced shards are in %v.\n", len(restored), trash.Path())
+	return nil
+}
+
+// restoreRename moves a restored shard into place, replaced by tests to
+// inject failures.
+var restoreRename = os.Rename
+
+// swapRestoredShards moves each shard at rel, below staging, into place in
+// the data directory, moving the shard it replaces to the trash. If any
+// can't be moved, the shards already swapped are removed, and those they
+// replaced moved back from the trash.
+func swapRestoredShards(restored []string, dataPath, staging string, trash *Trash) error {
+	var swapped, trashed []string
+	rollback := func(err error) error {
+		for _, rel := range swapped {
+			if e := os.RemoveAll(filepath.Join(dataPath, rel)); e != nil {
+				return fmt.Errorf("%v, and rolling back failed: %v", err, e)
+			}
+		}
+		for _, rel := range trashed {
+			if e := os.Rename(filepath.Join(trash.Path(), trash.id, rel), filepath.Join(dataPath, rel)); e != nil {
+				return fmt.Errorf("%v, and moving %v back from %v failed: %v", err, rel, trash.Path(), e)
+			}
+		}
+		return fmt.Errorf("%v, no shards were restored", err)
+	}
+
+	for _, rel := range restored {
+		dest := filepath.Join(dataPath, rel)
+		if _, err := os.Stat(dest); err == nil {
+			if err := trash.Move(rel); err != nil {
+				return rollback(err)
+			}
+			trashed = append(trashed, rel)
+		} else if !os.IsNotExist(err) {
+			return rollback(err)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+			return rollback(err)
+		}
+		if err := restoreRename(filepath.Join(staging, rel), dest); err != nil {
+			return rollback(err)
+		}
+		swapped = append(swapped, rel)
+	}
+
+	for _, rel := range restored {
+		fmt.Println("Restored", filepath.Join(dataPath, rel))
+	}
+	return nil
+}
+
+// refuseRestoreIfRunning returns an error if there are reasons to believe
+// influxd is running, unless forced.
+func refuseRestoreIfRunning(reasons []string, force bool) error {
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	if force {
+		for _, r := range reasons {
+			fmt.Fprintf(os.Stderr, "WARNING: influxd may be running: %v.\n", r)
+		}
+		fmt.Fprintln(os.Stderr, "WARNING: Restoring anyway, as -force was given.")
+		return nil
+	}
+	return fmt.Errorf("influxd appears to be running, and restoring shards it holds open corrupts them: %v. "+
+		"Stop influxd before restoring, or use -force if these belong to another instance", strings.Join(reasons, ", "))
+}
+
+// verifyRestoredShard checks the shard staged at rel, within staging,
+// against the checksum of the original shard in the conversion manifest,
+// if it has one.
+func verifyRestoredShard(m *ConversionManifest, staging, rel string) error {
+	a := strings.Split(filepath.ToSlash(rel), "/")
+	if len(a) != 3 {
+		return nil
+	}
+	s := m.Shard(a[0], a[1], a[2])
+	if s == nil || s.Source == nil {
+		return nil
+	}
+
+	sum, err := checksumFile(filepath.Join(staging, rel))
+	if err != nil {
+		return err
+	} else if sum.Size != s.Source.Size || sum.SHA256 != s.Source.SHA256 {
+		return fmt.Errorf("backup of shard %v does not match the checksum of the original shard", rel)
+	}
+	return nil
+}
+
+// findBackups returns the backups in dir.
+func findBackups(dir string) ([]*backup, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var a []*backup
+	for _, fi := range fis {
+		name := fi.Name()
+		switch {
+		case fi.IsDir() && strings.HasSuffix(name, "."+backupExt):
+			a = append(a, &backup{db: strings.TrimSuffix(name, "."+backupExt), path: filepath.Join(dir, name)})
+		case fi.Mode().IsRegular() && strings.HasSuffix(name, "."+backupExt+"."+backupArchiveExt):
+			a = append(a, &backup{db: strings.TrimSuffix(name, "."+backupExt+"."+backupArchiveExt), path: filepath.Join(dir, name), compressed: true})
+		}
+	}
+	return a, nil
+}
+
+// selectBackups returns the backups in dir of the comma-delimited list of
+// databases, or every backup if dbs is empty. It returns an error if there
+// are none, or a database has no backup.
+func selectBackups(dir, dbs string) ([]*backup, error) {
+	backups, err := findBackups(dir)
+	if err != nil {
+		return nil, err
+	}
+	return filterBackups(backups, dir, dbs)
+}
+
+// filterBackups returns the backups, found in dir, of the comma-delimited
+// list of databases, or every backup if dbs is empty. It returns an error
+// if there are none, or a database has no backup.
+func filterBackups(backups []*backup, dir, dbs string) ([]*backup, error) {
+	if dbs != "" {
+		var selected []*backup
+		for _, db := range strings.Split(dbs, ",") {
+			b := findBackup(backups, db)
+			if b == nil {
+				return nil, fmt.Errorf("no backup of database %v in %v", db, dir)
+			}
+			selected = append(selected, b)
+		}
+		backups = selected
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no backups found in %v", dir)
+	}
+	return backups, nil
+}
+
+// downloadS3Backups downloads the backups at the s3:// URL dir, of the
+// comma-delimited list of databases, or every backup if dbs is empty, and
+// their manifests, to staging. It returns the downloaded backups.
+func downloadS3Backups(c *S3Client, dir, dbs, staging string) ([]*backup, error) {
+	bucket, prefix, err := parseS3Location(dir)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	keys, err := c.List(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Backups are archives directly below the prefix.
+	objects := make(map[string]bool)
+	var backups []*backup
+	for _, key := range keys {
+		objects[key] = true
+		name := strings.TrimPrefix(key, prefix)
+		if !strings.Contains(name, "/") && strings.HasSuffix(name, "."+backupExt+"."+backupArchiveExt) {
+			backups = append(backups, &backup{db: strings.TrimSuffix(name, "."+backupExt+"."+backupArchiveExt), path: key, compressed: true})
+		}
+	}
+	backups, err = filterBackups(backups, dir, dbs)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(staging, 0777); err != nil {
+		return nil, err
+	}
+	for _, b := range backups {
+		key := b.path
+		b.path = filepath.Join(staging, path.Base(key))
+		fmt.Printf("Downloading %v%v/%v\n", s3Scheme, bucket, key)
+		if err := downloadS3Object(c, bucket, key, b.path); err != nil {
+			return nil, err
+		}
+		if objects[key+"."+manifestExt] {
+			if err := downloadS3Object(c, bucket, key+"."+manifestExt, b.path+"."+manifestExt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return backups, nil
+}
+
+// downloadS3Object downloads the object at key in the bucket to the file at path.
+func downloadS3Object(c *S3Client, bucket, key, path string) error {
+	r, err := c.Get(bucket, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("download %v: %v", key, err)
+	}
+	return f.Close()
+}
+
+// findBackup returns the backup of the database, or nil.
+func findBackup(a []*backup, db string) *backup {
+	for _, b := range a {
+		if b.db == db {
+			return b
+		}
+	}
+	return nil
+}
+
+// verifyBackup verifies the backup against its manifest, if it has one.
+func verifyBackup(b *backup) error {
+	path := b.path + "." + manifestExt
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	m, err := ReadBackupManifest(path)
+	if err != nil {
+		return err
+	}
+	if errs := m.Verify(filepath.Dir(path), 1); len(errs) > 0 {
+		return fmt.Errorf("backup %v does not match its manifest: %v", b.path, errs[0])
+	}
+	return nil
+}
+
+// extractBackup copies the shards of the backup whose path, relative to the
+// database, is kept by keep, to below dest. It returns the paths of the
+// shards copied, relative to dest.
+func extractBackup(b *backup, dest string, keep func(rel string) bool) ([]string, error) {
+	if b.compressed {
+		return extractArchive(b.path, dest, keep)
+	}
+
+	var rels []string
+	err := filepath.Walk(b.path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(b.path, path)
+		if err != nil {
+			return err
+		} else if !keep(filepath.ToSlash(rel)) {
+			return nil
+		}
+
+		target := filepath.Join(dest, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+			return err
+		}
+		if err := copyFile(path, target, fi.Mode().Perm(), ioutil.Discard); err != nil {
+			return err
+		}
+		rels = append(rels, rel)
+		return nil
+	})
+	return rels, err
+}
+
+// extractArchive extracts the shards kept by keep from a compressed backup.
+// Files are archived below the name of the database, which is removed.
+func extractArchive(name, dest string, keep func(rel string) bool) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+
+	var rels []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return rels, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		// Remove the database name, refusing any path escaping dest.
+		clean := path.Clean(hdr.Name)
+		i := strings.Index(clean, "/")
+		if i == -1 || strings.HasPrefix(clean, "../") {
+			continue
+		}
+		rel := clean[i+1:]
+		if !keep(rel) {
+			continue
+		}
+
+		target := filepath.Join(dest, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+			return nil, err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			return nil, err
+		}
+		if err := out.Sync(); err != nil {
+			out.Close()
+			return nil, err
+		}
+		if err := out.Close(); err != nil {
+			return nil, err
+		}
+		rels = append(rels, filepath.FromSlash(rel))
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Ensure backups, copied or archived, are found by database.
+func TestFindBackups(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	MustWriteFile(filepath.Join(dir, "db0.bak", "default", "1"), "data")
+	MustWriteFile(filepath.Join(dir, "db1.bak.tar.gz"), "data")
+	MustWriteFile(filepath.Join(dir, "db1.bak.tar.gz.manifest"), "{}")
+	MustWriteFile(filepath.Join(dir, "db2", "default", "2"), "data")
+
+	a, err := findBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []*backup{
+		{db: "db0", path: filepath.Join(dir, "db0.bak")},
+		{db: "db1", path: filepath.Join(dir, "db1.bak.tar.gz"), compressed: true},
+	}
+	if !reflect.DeepEqual(a, exp) {
+		t.Fatalf("unexpected backups: %+v", a)
+	}
+}
+
+// Ensure the selected shards of a backup are extracted, whether copied or archived.
+func TestExtractBackup(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	MustWriteFile(filepath.Join(dir, "db0", "default", "1"), "data1")
+	MustWriteFile(filepath.Join(dir, "db0", "default", "2"), "data2")
+	if err := os.Rename(filepath.Join(dir, "db0"), filepath.Join(dir, "db0.bak")); err != nil {
+		t.Fatal(err)
+	}
+	MustWriteFile(filepath.Join(dir, "db1", "default", "1"), "data1")
+	MustWriteFile(filepath.Join(dir, "db1", "default", "2"), "data2")
+	if err := archiveDatabase(filepath.Join(dir, "db1"), filepath.Join(dir, "db1.bak.tar.gz"), NewBackupManifest(defaultChunkSize, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	keep := func(rel string) bool { return rel == "default/2" }
+	for _, b := range []*backup{
+		{db: "db0", path: filepath.Join(dir, "db0.bak")},
+		{db: "db1", path: filepath.Join(dir, "db1.bak.tar.gz"), compressed: true},
+	} {
+		dest := filepath.Join(dir, restoreDir, b.db)
+		rels, err := extractBackup(b, dest, keep)
+		if err != nil {
+			t.Fatalf("%v: %v", b.db, err)
+		}
+		sort.Strings(rels)
+		if exp := []string{filepath.Join("default", "2")}; !reflect.DeepEqual(rels, exp) {
+			t.Fatalf("%v: unexpected shards: %v", b.db, rels)
+		}
+
+		if buf, err := ioutil.ReadFile(filepath.Join(dest, "default", "2")); err != nil {
+			t.Fatalf("%v: %v", b.db, err)
+		} else if string(buf) != "data2" {
+			t.Fatalf("%v: unexpected data: %q", b.db, buf)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "default", "1")); !os.IsNotExist(err) {
+			t.Fatalf("%v: unexpected shard 1: %v", b.db, err)
+		}
+	}
+}
+
+// Ensure shards are restored from backups uploaded to S3, at the location
+// recorded in the conversion manifest.
+func TestRunRestore_S3(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	shard := filepath.Join(dataPath, "db0", "default", "1")
+	MustCreateBZ1Shard(shard, "cpu value=1 1000000000")
+	orig, err := ioutil.ReadFile(shard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewS3Server()
+	defer s.Close()
+	c := &S3Client{Endpoint: s.URL, Region: "us-east-1", AccessKeyID: "id", SecretAccessKey: "secret",
+		PartSize: defaultS3PartSize, HTTPClient: newS3HTTPClient(), now: time.Now}
+	dest := "s3://bucket/backups/db0.bak.tar.gz"
+	m := NewBackupManifest(defaultChunkSize, 1)
+	if err := s3Backup(c)(filepath.Join(dataPath, "db0"), dest, m); err != nil {
+		t.Fatal(err)
+	} else if err := s3SaveManifest(c)(m, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the shard, as a conversion would, recording where it was backed up.
+	if err := os.Remove(shard); err != nil {
+		t.Fatal(err)
+	}
+	MustCreateBZ1Shard(shard, "cpu value=2 2000000000")
+	cm := &ConversionManifest{}
+	cm.Update([]*ManifestShard{{Database: "db0", RetentionPolicy: "default", Path: "1", Outcome: "converted", Backup: dest}})
+	if err := cm.Save(filepath.Join(dataPath, conversionManifestFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]string{"AWS_ACCESS_KEY_ID": "id", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_REGION": "us-east-1"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	if err := runRestore([]string{"-s3-endpoint", s.URL, dataPath}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(shard); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(b, orig) {
+		t.Fatal("shard not restored from its backup")
+	}
+}
+
+// Ensure the shards replaced by a restore are moved back if a later shard
+// can't be swapped into place.
+func TestRunRestore_RenameFailure(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	shards := []string{filepath.Join(dataPath, "db0", "default", "1"), filepath.Join(dataPath, "db0", "default", "2")}
+	for _, path := range shards {
+		MustCreateBZ1Shard(path, "cpu value=1 1000000000")
+	}
+	if err := backupDatabase(filepath.Join(dataPath, "db0"), filepath.Join(dataPath, "db0.bak"), NewBackupManifest(defaultChunkSize, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the shards, as a conversion would.
+	for _, path := range shards {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+		MustCreateBZ1Shard(path, "cpu value=2 2000000000")
+	}
+	converted := MustSnapshotShards(filepath.Join(dataPath, "db0"))
+
+	defer func(fn func(string, string) error) { restoreRename = fn }(restoreRename)
+	n := 0
+	restoreRename = func(oldpath, newpath string) error {
+		if n++; n == 2 {
+			return errors.New("injected failure")
+		}
+		return os.Rename(oldpath, newpath)
+	}
+
+	if err := runRestore([]string{dataPath}); err == nil || !strings.Contains(err.Error(), "injected failure") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a := MustSnapshotShards(filepath.Join(dataPath, "db0")); !reflect.DeepEqual(a, converted) {
+		t.Fatalf("shards not rolled back:\ngot %v\nexp %v", a, converted)
+	}
+}
+
+// Ensure shards aren't restored while influxd is running, unless forced.
+func TestRunRestore_Running(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	shard := filepath.Join(dataPath, "db0", "default", "1")
+	MustCreateBZ1Shard(shard, "cpu value=1 1000000000")
+	if err := backupDatabase(filepath.Join(dataPath, "db0"), filepath.Join(dataPath, "db0.bak"), NewBackupManifest(defaultChunkSize, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(shard); err != nil {
+		t.Fatal(err)
+	}
+	MustCreateBZ1Shard(shard, "cpu value=2 2000000000")
+	converted := MustSnapshotDir(filepath.Join(dataPath, "db0"))
+
+	pidFile := filepath.Join(dataPath, "influxd.pid")
+	MustWriteFile(pidFile, strconv.Itoa(os.Getpid()))
+
+	if err := runRestore([]string{"-pidfile", pidFile, "-influxd-addr", "", dataPath}); err == nil || !strings.Contains(err.Error(), "influxd appears to be running") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a := MustSnapshotDir(filepath.Join(dataPath, "db0")); !reflect.DeepEqual(a, converted) {
+		t.Fatal("shards restored while influxd is running")
+	}
+
+	if err := runRestore([]string{"-force", "-pidfile", pidFile, "-influxd-addr", "", dataPath}); err != nil {
+		t.Fatal(err)
+	}
+	if a := MustSnapshotDir(filepath.Join(dataPath, "db0")); reflect.DeepEqual(a, converted) {
+		t.Fatal("shards not restored with -force")
+	}
+}
+
+// MustSnapshotShards returns the snapshot of the files below dir, leaving out
+// directories, whose modification times change as shards are moved.
+func MustSnapshotShards(dir string) map[string]string {
+	m := MustSnapshotDir(dir)
+	for k, v := range m {
+		if strings.HasPrefix(v, "d") {
+			delete(m, k)
+		}
+	}
+	return m
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// defaultPIDFile is the file the init script has influxd write its process ID to.
+const defaultPIDFile = "/var/run/influxdb/influxd.pid"
+
+// defaultInfluxdAddr is the default address of the influxd HTTP API.
+const defaultInfluxdAddr = "localhost:8086"
+
+// detectInfluxd returns the reasons to believe influxd is running, and so
+// holds shards open which must not be converted. Any shard being locked by
+// another process is a reason. Converting in-place, a live process in the
+// PID file, or influxd answering at addr, is also a reason. Shards
+// converted from a copy, such as a snapshot, may be converted while influxd
+// runs on the live data directory.
+func detectInfluxd(shards tsdb.ShardInfos, pidFile, addr string) []string {
+	paths := make([]string, len(shards))
+	for i, si := range shards {
+		paths[i] = si.FullPath(opts.DataPath)
+	}
+	reasons := lockedShards(paths)
+	if !opts.InPlace() {
+		return reasons
+	}
+	return append(reasons, influxdProcess(pidFile, addr)...)
+}
+
+// lockedShards returns a reason if any of the shards at paths is locked by
+// another process.
+func lockedShards(paths []string) []string {
+	for _, path := range paths {
+		if locked, err := fileLocked(path); err == nil && locked {
+			return []string{fmt.Sprintf("shard %v is locked by another process", path)}
+		}
+	}
+	return nil
+}
+
+// influxdProcess returns the reasons to believe influxd is running: a live
+// process in the PID file, or influxd answering at addr.
+func influxdProcess(pidFile, addr string) []string {
+	var reasons []string
+	if pidFile != "" {
+		if b, err := ioutil.ReadFile(pidFile); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && processAlive(pid) {
+				reasons = append(reasons, fmt.Sprintf("process %d, in PID file %v, is running", pid, pidFile))
+			}
+		}
+	}
+
+	if addr != "" {
+		c := &http.Client{Timeout: time.Second}
+		if resp, err := c.Get("http://" + addr + "/ping"); err == nil {
+			resp.Body.Close()
+			if v := resp.Header.Get("X-Influxdb-Version"); v != "" {
+				reasons = append(reasons, fmt.Sprintf("influxd %v is answering at %v", v, addr))
+			}
+		}
+	}
+	return reasons
+}
+
+// refuseIfRunning exits if influxd appears to be running, unless forced.
+func refuseIfRunning(shards tsdb.ShardInfos) {
+	reasons := detectInfluxd(shards, opts.PIDFile, opts.InfluxdAddr)
+	if len(reasons) == 0 {
+		return
+	}
+
+	if opts.Force {
+		for _, r := range reasons {
+			fmt.Fprintf(os.Stderr, "WARNING: influxd may be running: %v.\n", r)
+		}
+		fmt.Fprintln(os.Stderr, "WARNING: Converting anyway, as -force was given.")
+		fmt.Fprintln(os.Stderr)
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "influxd appears to be running, and converting shards it holds open corrupts them:")
+	for _, r := range reasons {
+		fmt.Fprintf(os.Stderr, "  %v\n", r)
+	}
+	fmt.Fprintln(os.Stderr, "Stop influxd before converting, or use -force if these belong to another instance.")
+	report.Error = "influxd appears to be running"
+	exit(1)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Ensure a live process in the PID file, or influxd answering, is detected.
+func TestDetectInfluxd(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	defer func(o options) { opts = o }(opts)
+	opts = options{DataPath: dir}
+
+	pidFile := filepath.Join(dir, "influxd.pid")
+	if reasons := detectInfluxd(nil, pidFile, ""); len(reasons) != 0 {
+		t.Fatalf("unexpected reasons: %v", reasons)
+	}
+
+	MustWriteFile(pidFile, strconv.Itoa(os.Getpid())+"\n")
+	if reasons := detectInfluxd(nil, pidFile, ""); len(reasons) != 1 || !strings.Contains(reasons[0], "is running") {
+		t.Fatalf("unexpected reasons: %v", reasons)
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Influxdb-Version", "0.9.6")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+	addr := strings.TrimPrefix(s.URL, "http://")
+	if reasons := detectInfluxd(nil, "", addr); len(reasons) != 1 || !strings.Contains(reasons[0], "influxd 0.9.6") {
+		t.Fatalf("unexpected reasons: %v", reasons)
+	}
+
+	// Only locked shards matter when the source is left untouched.
+	opts.Out = filepath.Join(dir, "out")
+	if reasons := detectInfluxd(nil, pidFile, addr); len(reasons) != 0 {
+		t.Fatalf("unexpected reasons: %v", reasons)
+	}
+}
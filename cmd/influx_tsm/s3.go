@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultS3PartSize is the size of the parts of an object uploaded to S3,
+// each of which is held in memory until it is sent.
+const defaultS3PartSize = 16 * 1024 * 1024
+
+// s3Scheme prefixes the location of objects in S3.
+const s3Scheme = "s3://"
+
+const (
+	// s3DialTimeout is the time allowed to connect to the service.
+	s3DialTimeout = 30 * time.Second
+
+	// s3IdleTimeout is the time allowed without sending or receiving any
+	// data, such as while waiting for a response. Requests aren't limited
+	// as a whole, as an archive may take any time to transfer.
+	s3IdleTimeout = 2 * time.Minute
+)
+
+// S3Client uploads objects to S3, or a compatible service, signing each
+// request with AWS Signature Version 4.
+type S3Client struct {
+	// Endpoint is the URL of the service, such as
+	// https://s3.us-west-2.amazonaws.com. Buckets are addressed by path.
+	Endpoint string
+	Region   string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// PartSize is the size of each part of a multipart upload.
+	PartSize int
+
+	HTTPClient *http.Client
+	now        func() time.Time
+}
+
+// NewS3ClientFromEnv returns a client of the endpoint, or of the S3 endpoint
+// of the region if empty, with the region and credentials given by the
+// standard AWS environment variables.
+func NewS3ClientFromEnv(endpoint string) (*S3Client, error) {
+	c := &S3Client{
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		PartSize:        defaultS3PartSize,
+		HTTPClient:      newS3HTTPClient(),
+		now:             time.Now,
+	}
+	if c.Region == "" {
+		c.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to use S3")
+	}
+
+	c.Endpoint = strings.TrimSuffix(endpoint, "/")
+	if c.Endpoint == "" {
+		c.Endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+	return c, nil
+}
+
+// newS3HTTPClient returns a client whose requests fail once they stall for
+// s3IdleTimeout.
+func newS3HTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: s3DialTimeout, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: func(network, addr string) (net.Conn, error) {
+				conn, err := dialer.Dial(network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &idleTimeoutConn{Conn: conn, timeout: s3IdleTimeout}, nil
+			},
+			TLSHandshakeTimeout: s3DialTimeout,
+		},
+	}
+}
+
+// idleTimeoutConn is a connection whose reads and writes fail once no data
+// has been sent or received for its timeout.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// parseS3Location splits a location, given as bucket/prefix, into the bucket
+// and the prefix of the keys of objects within it.
+func parseS3Location(s string) (bucket, prefix string, err error) {
+	s = strings.TrimPrefix(s, s3Scheme)
+	if i := strings.Index(s, "/"); i != -1 {
+		bucket, prefix = s[:i], strings.Trim(s[i+1:], "/")
+	} else {
+		bucket = s
+	}
+	if bucket == "" {
+		return "", "", fmt.Errorf("bad S3 location %q, must be bucket/prefix", s)
+	}
+	return bucket, prefix, nil
+}
+
+// splitS3URL splits an s3:// URL into its bucket and key.
+func splitS3URL(s string) (bucket, key string) {
+	s = strings.TrimPrefix(s, s3Scheme)
+	if i := strings.Index(s, "/"); i != -1 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// Put uploads data as the object at key in the bucket.
+func (c *S3Client) Put(bucket, key string, data []byte) error {
+	resp, err := c.do("PUT", bucket, key, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Create returns a writer uploading the data written to it as the object at
+// key in the bucket, one part at a time. The object is only created once the
+// writer is closed. A writer which fails must be aborted.
+func (c *S3Client) Create(bucket, key string) (*S3Writer, error) {
+	resp, err := c.do("POST", bucket, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("create upload of %v: %v", key, err)
+	} else if result.UploadID == "" {
+		return nil, fmt.Errorf("create upload of %v: no upload ID", key)
+	}
+
+	return &S3Writer{
+		c:        c,
+		bucket:   bucket,
+		key:      key,
+		uploadID: result.UploadID,
+		buf:      make([]byte, 0, c.PartSize),
+	}, nil
+}
+
+// Get returns the data of the object at key in the bucket, which must be
+// closed once read.
+func (c *S3Client) Get(bucket, key string) (io.ReadCloser, error) {
+	resp, err := c.do("GET", bucket, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns the keys of the objects in the bucket beginning with prefix.
+func (c *S3Client) List(bucket, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := c.do("GET", bucket, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Keys                  []string `xml:"Contents>Key"`
+			IsTruncated           bool     `xml:"IsTruncated"`
+			NextContinuationToken string   `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %v/%v: %v", bucket, prefix, err)
+		}
+
+		keys = append(keys, result.Keys...)
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// objectURL returns the URL of the object at key in the bucket, or of the
+// bucket if key is empty. Each segment of the path is escaped as required
+// for signing, and the path is sent as escaped.
+func (c *S3Client) objectURL(bucket, key string) (*url.URL, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []string{bucket}
+	if key != "" {
+		segments = append(segments, strings.Split(key, "/")...)
+	}
+	escaped := make([]string, len(segments))
+	for i, s := range segments {
+		escaped[i] = escapeS3(s)
+	}
+
+	base := strings.TrimSuffix(u.Path, "/")
+	u.Path = base + "/" + strings.Join(segments, "/")
+	u.RawPath = (&url.URL{Path: base}).EscapedPath() + "/" + strings.Join(escaped, "/")
+	return u, nil
+}
+
+// do sends the signed request for the object, returning an error if it fails.
+func (c *S3Client) do(method, bucket, key string, query url.Values, body []byte) (*http.Response, error) {
+	u, err := c.objectURL(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// The path is sent as signed, rather than as reparsed from the string.
+	req.URL = u
+	req.ContentLength = int64(len(body))
+	sum := sha256.Sum256(body)
+	c.sign(req, hex.EncodeToString(sum[:]))
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%v %v: %v: %s", method, u.Path, resp.Status, bytes.TrimSpace(b))
+	}
+	return resp, nil
+}
+
+// sign adds the headers signing the request, whose payload has the
+// hex-encoded SHA-256 digest payloadHash. Every header already set on the
+// request is signed.
+func (c *S3Client) sign(req *http.Request, payloadHash string) {
+	t := c.now().UTC()
+	date := t.Format("20060102")
+	req.Header.Set("x-amz-date", t.Format("20060102T150405Z"))
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.SessionToken)
+	}
+
+	// Canonical headers, including the host, sorted by name.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	crSum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(crSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery returns the query of u, sorted and encoded for signing.
+func canonicalQuery(u *url.URL) string {
+	q := u.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var a []string
+	for _, k := range keys {
+		vs := q[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			a = append(a, escapeS3(k)+"="+escapeS3(v))
+		}
+	}
+	return strings.Join(a, "&")
+}
+
+// escapeS3 percent-encodes s as required for signing, leaving only
+// unreserved characters.
+func escapeS3(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// S3Writer uploads the data written to it as an object, in parts.
+type S3Writer struct {
+	c        *S3Client
+	bucket   string
+	key      string
+	uploadID string
+
+	buf   []byte
+	parts []s3Part
+}
+
+// s3Part is an uploaded part of an object, as completed.
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// Write buffers p, uploading each part once it is full.
+func (w *S3Writer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := cap(w.buf) - len(w.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		w.buf = append(w.buf, p[:k]...)
+		p = p[k:]
+
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush uploads the buffered part.
+func (w *S3Writer) flush() error {
+	number := len(w.parts) + 1
+	resp, err := w.c.do("PUT", w.bucket, w.key, url.Values{
+		"partNumber": {fmt.Sprint(number)},
+		"uploadId":   {w.uploadID},
+	}, w.buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	w.parts = append(w.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close uploads the final part, and completes the object.
+func (w *S3Writer) Close() error {
+	if len(w.buf) > 0 || len(w.parts) == 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.c.do("POST", w.bucket, w.key, url.Values{"uploadId": {w.uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// A failure to complete may be reported after the response has begun.
+	var result struct {
+		XMLName xml.Name
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("complete upload of %v: %v", w.key, err)
+	} else if result.XMLName.Local == "Error" {
+		return fmt.Errorf("complete upload of %v: %v", w.key, result.Message)
+	}
+	return nil
+}
+
+// Abort discards the parts uploaded so far.
+func (w *S3Writer) Abort() error {
+	resp, err := w.c.do("DELETE", w.bucket, w.key, url.Values{"uploadId": {w.uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Backup returns a function backing up a database as a gzipped tar archive
+// uploaded to the s3:// URL dest, and its manifest alongside it.
+func s3Backup(c *S3Client) func(src, dest string, m *BackupManifest) error {
+	return func(src, dest string, m *BackupManifest) error {
+		bucket, key := splitS3URL(dest)
+		w, err := c.Create(bucket, key)
+		if err != nil {
+			return err
+		}
+
+		// The manifest writer digests in the background until closed.
+		mw := m.Writer(path.Base(key))
+		closed := false
+		defer func() {
+			if !closed {
+				mw.Close()
+			}
+		}()
+
+		if err := writeArchive(io.MultiWriter(w, mw), src); err != nil {
+			w.Abort()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			w.Abort()
+			return err
+		}
+		closed = true
+		return mw.Close()
+	}
+}
+
+// s3SaveManifest returns a function uploading the manifest of the backup at
+// the s3:// URL dest alongside it.
+func s3SaveManifest(c *S3Client) func(m *BackupManifest, dest string) error {
+	return func(m *BackupManifest, dest string) error {
+		m.mu.Lock()
+		b, err := json.MarshalIndent(m, "", "\t")
+		m.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		bucket, key := splitS3URL(dest)
+		return c.Put(bucket, key+"."+manifestExt, b)
+	}
+}
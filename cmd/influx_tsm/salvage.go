@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// salvageShard replaces the corrupt shard with a copy of what can still be
+// read of it, moving the original to the trash batch, and returns the
+// salvaged shard. The copy is written in the trash until complete, so that an
+// interrupted salvage is never mistaken for a shard. If the copy can't take
+// the shard's place, the original is moved back, and the copy is kept if it
+// can't be.
+func salvageShard(si *tsdb.ShardInfo, trash *Trash) (*tsdb.ShardInfo, error) {
+	rel := filepath.Join(si.Database, si.RetentionPolicy, si.Path)
+	src := si.FullPath(opts.DataPath)
+
+	if err := os.MkdirAll(trash.Path(), 0777); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(trash.Path(), "salvage-")
+	if err != nil {
+		return nil, err
+	}
+	tmp := f.Name()
+	f.Close()
+	os.Remove(tmp)
+	keep := false
+	defer func() {
+		if !keep {
+			os.Remove(tmp)
+		}
+	}()
+
+	logger.Debugf("Salvaging %v to %v\n", src, tmp)
+	r, err := tsdb.Salvage(src, tmp)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Lost) > 0 {
+		logger.Warnf("Salvaged %d key(s) in %d bucket(s) of %v, lost: %v\n", r.Keys, r.Buckets, src, strings.Join(r.Lost, "; "))
+	} else {
+		logger.Infof("Salvaged %d key(s) in %d bucket(s) of %v\n", r.Keys, r.Buckets, src)
+	}
+
+	logger.Debugf("Replacing %v with the salvaged copy\n", src)
+	if err := replaceShard(trash, rel, tmp); err != nil {
+		if _, e := os.Stat(src); e != nil {
+			keep = true
+			return nil, fmt.Errorf("%v, the salvaged copy is kept at %v", err, tmp)
+		}
+		return nil, err
+	}
+	return tsdb.NewDatabase(filepath.Join(opts.DataPath, si.Database)).Shard(si.RetentionPolicy, si.Path)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// Ensure a corrupt bz1 shard is salvaged with -salvage, converting the series
+// which can still be read, with the original kept in the trash.
+func TestConvert_Salvage(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	shard := filepath.Join(dataPath, "db0", "default", "1")
+	MustCreateCorruptBZ1Shard(shard)
+
+	output, code := RunConvert("", "-y", "-nobackup", "-salvage", dataPath)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	} else if !strings.Contains(output, "1 corrupt shard(s) will be salvaged.") {
+		t.Fatalf("salvage not reported: %s", output)
+	}
+	if m := MustReadTSMShard(shard); !reflect.DeepEqual(m, map[string][]interface{}{"cpu#!~#value": {1.0, 2.0}}) {
+		t.Fatalf("unexpected values: %v", m)
+	}
+
+	var paths []string
+	batches, err := NewTrash(dataPath).Batches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range batches {
+		paths = append(paths, b.Paths...)
+	}
+	if len(paths) != 2 || paths[0] != filepath.Join("db0", "default", "1") || paths[1] != paths[0] {
+		t.Fatalf("unexpected trash: %v", paths)
+	}
+}
+
+// Ensure the corrupt original is moved back, and the salvaged copy removed,
+// if the copy can't take its place.
+func TestConvert_SalvageRenameFailure(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	shard := filepath.Join(dataPath, "db0", "default", "1")
+	MustCreateCorruptBZ1Shard(shard)
+	before := MustSnapshotShards(filepath.Join(dataPath, "db0"))
+
+	defer func(fn func(string, string) error) { renameShard = fn }(renameShard)
+	renameShard = func(oldpath, newpath string) error { return errors.New("injected failure") }
+
+	output, code := RunConvert("", "-y", "-nobackup", "-salvage", dataPath)
+	if code != 1 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	} else if !strings.Contains(output, "injected failure") {
+		t.Fatalf("failure not reported: %s", output)
+	}
+	if after := MustSnapshotShards(filepath.Join(dataPath, "db0")); !reflect.DeepEqual(after, before) {
+		t.Fatalf("shard not restored:\n\nbefore=%v\n\nafter=%v", before, after)
+	}
+	if a := MustSnapshotShards(filepath.Join(dataPath, trashDir)); len(a) != 0 {
+		t.Fatalf("unexpected files in the trash: %v", a)
+	}
+}
+
+// MustCreateCorruptBZ1Shard creates a bz1 shard at path with a cpu series
+// which can be read, and a mem series whose bucket is corrupt.
+func MustCreateCorruptBZ1Shard(path string) {
+	lines := []string{"cpu value=1 1000000000", "cpu value=2 2000000000"}
+	for i := 0; i < 5000; i++ {
+		lines = append(lines, fmt.Sprintf("mem value=%d.%d %d", i*7919, i, (i+1)*1000000000))
+	}
+	MustCreateBZ1Shard(path, lines...)
+
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		panic(err)
+	}
+	var root int64
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = int64(tx.Bucket([]byte("points")).Bucket([]byte("mem")).Root())
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	pageSize := db.Info().PageSize
+	db.Close()
+	if root == 0 {
+		panic("mem bucket is inline")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	// Page header: id, flags, count and overflow, then a branch element:
+	// position, key size and child page beyond the end of the file.
+	buf := make([]byte, pageSize)
+	binary.LittleEndian.PutUint16(buf[8:], 0x01)
+	binary.LittleEndian.PutUint16(buf[10:], 1)
+	binary.LittleEndian.PutUint64(buf[24:], 1<<50)
+	if _, err := f.WriteAt(buf, root*int64(pageSize)); err != nil {
+		panic(err)
+	}
+}
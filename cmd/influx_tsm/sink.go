@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Sink is the destination of converted TSM files.
+type Sink interface {
+	// Create returns a writer for the file at path, relative to the root of
+	// the sink. The file is complete once the writer is closed.
+	Create(path string) (io.WriteCloser, error)
+
+	// Close flushes and releases the sink.
+	Close() error
+}
+
+// DirSink writes TSM files below a local directory.
+type DirSink struct {
+	root string
+}
+
+// NewDirSink returns a sink writing below root.
+func NewDirSink(root string) *DirSink {
+	return &DirSink{root: root}
+}
+
+// Create creates the file at path, and any missing parent directories.
+func (s *DirSink) Create(path string) (io.WriteCloser, error) {
+	path = filepath.Join(s.root, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &syncFile{f}, nil
+}
+
+// Close is a no-op.
+func (s *DirSink) Close() error { return nil }
+
+// syncFile is a file which is synced to disk before it is closed.
+type syncFile struct {
+	*os.File
+}
+
+func (f *syncFile) Close() error {
+	if err := f.File.Sync(); err != nil {
+		f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
+
+// TarSink streams TSM files as a tar archive. Files are staged in a temporary
+// directory until complete, since their size must be known to be archived.
+type TarSink struct {
+	mu sync.Mutex
+	tw *tar.Writer
+	w  io.Writer
+
+	tmpDir string
+}
+
+// NewTarSink returns a sink archiving to w, staging files in tmpDir.
+func NewTarSink(w io.Writer, tmpDir string) *TarSink {
+	return &TarSink{
+		tw:     tar.NewWriter(w),
+		w:      w,
+		tmpDir: tmpDir,
+	}
+}
+
+// Create returns a writer which adds the file at path to the archive once closed.
+func (s *TarSink) Create(path string) (io.WriteCloser, error) {
+	f, err := ioutil.TempFile(s.tmpDir, "influx_tsm-")
+	if err != nil {
+		return nil, err
+	}
+	return &tarFile{File: f, sink: s, path: filepath.ToSlash(path)}, nil
+}
+
+// Close writes the end of the archive.
+func (s *TarSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tw.Close()
+}
+
+// add appends the staged file f to the archive under path.
+func (s *TarSink) add(path string, f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.tw.WriteHeader(&tar.Header{
+		Name:    path,
+		Mode:    0666,
+		Size:    fi.Size(),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(s.tw, f); err != nil {
+		return err
+	}
+	return s.tw.Flush()
+}
+
+// tarFile is a file staged for a TarSink.
+type tarFile struct {
+	*os.File
+	sink *TarSink
+	path string
+}
+
+func (f *tarFile) Close() error {
+	defer os.Remove(f.File.Name())
+	defer f.File.Close()
+	return f.sink.add(f.path, f.File)
+}
+
+// CmdSink streams TSM files as a tar archive to the standard input of a
+// command, such as "ssh host tar -x -C /var/lib/influxdb/data" or
+// "aws s3 cp - s3://bucket/shards.tar".
+type CmdSink struct {
+	*TarSink
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// NewCmdSink starts the shell command and returns a sink writing to it.
+func NewCmdSink(command, tmpDir string) (*CmdSink, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start sink command: %v", err)
+	}
+
+	return &CmdSink{
+		TarSink: NewTarSink(stdin, tmpDir),
+		cmd:     cmd,
+		stdin:   stdin,
+	}, nil
+}
+
+// Close ends the archive and waits for the command to exit.
+func (s *CmdSink) Close() error {
+	if err := s.TarSink.Close(); err != nil {
+		s.stdin.Close()
+		s.cmd.Wait()
+		return err
+	}
+	if err := s.stdin.Close(); err != nil {
+		s.cmd.Wait()
+		return err
+	}
+	if err := s.cmd.Wait(); err != nil {
+		return fmt.Errorf("sink command: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Ensure the tar sink archives each file once it is closed.
+func TestTarSink_Create(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	s := NewTarSink(&buf, dir)
+
+	f, err := s.Create("db/rp/1/000000001-000000001.tsm")
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	} else if err := f.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	} else if hdr.Name != "db/rp/1/000000001-000000001.tsm" {
+		t.Fatalf("unexpected name: %s", hdr.Name)
+	}
+
+	if b, err := ioutil.ReadAll(tr); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "data" {
+		t.Fatalf("unexpected data: %q", b)
+	}
+
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+
+	// Staged files are removed once archived.
+	if files, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Fatalf("unexpected staged files: %d", len(files))
+	}
+}
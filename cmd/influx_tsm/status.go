@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+const statusUsage = `Usage: influx_tsm status [options] <data-path>
+
+Summarize the progress of converting the data directory: for each database
+and retention policy, the number of shards of each format, the bytes still
+to be converted, and when a shard of it was last converted, as recorded in
+the history.
+
+Options:`
+
+// Status is the progress of converting the shards of a retention policy.
+type Status struct {
+	Database        string `json:"database"`
+	RetentionPolicy string `json:"retentionPolicy"`
+	TSM1            int    `json:"tsm1"`
+	B1              int    `json:"b1"`
+	BZ1             int    `json:"bz1"`
+
+	// Remaining is the size of the shards not yet converted.
+	Remaining int64 `json:"remaining"`
+
+	// LastConverted is when a shard was last converted, or zero if none
+	// is recorded in the history.
+	LastConverted time.Time `json:"lastConverted"`
+}
+
+// Converted returns the fraction of the shards converted.
+func (s *Status) Converted() float64 {
+	n := s.TSM1 + s.B1 + s.BZ1
+	if n == 0 {
+		return 1
+	}
+	return float64(s.TSM1) / float64(n)
+}
+
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	var sel selection
+	opts.selectionFlags(fs, &sel)
+	fs.StringVar(&opts.HistoryFile, "history-file", "", "File recording the converted shards. Default is '"+historyFile+"' in the data directory, if writable.")
+	fs.BoolVar(&opts.JSON, "json", false, "Print the status of each retention policy as a JSON array.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, statusUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) < 1 {
+		return fmt.Errorf("no data directory specified")
+	}
+	opts.DataPath = fs.Args()[0]
+	if err := opts.parseSelection(&sel); err != nil {
+		return err
+	}
+	if opts.HistoryFile == "" {
+		opts.HistoryFile = defaultHistoryFile(opts.DataPath)
+	}
+
+	shards, skipped, err := loadShards(&opts)
+	if err != nil {
+		return fmt.Errorf("failed to access data directory at %v: %v", opts.DataPath, err)
+	}
+	for _, e := range skipped {
+		logger.Warnf("Skipping %v: %v\n", filepath.Join(opts.DataPath, e.Database, e.RetentionPolicy, e.Path), e.Err)
+	}
+	shards = opts.Select(shards)
+	if !opts.Before.IsZero() {
+		shards = shards.Before(opts.Before, opts.GroupDuration)
+	}
+
+	records, err := NewHistory(opts.HistoryFile).Records()
+	if err != nil {
+		// The shards still tell how far the conversion is.
+		logger.Warnf("Ignoring unreadable history %v: %v\n", opts.HistoryFile, err)
+	}
+
+	a := conversionStatus(shards, records)
+	if opts.JSON {
+		return json.NewEncoder(stdout).Encode(a)
+	}
+	printStatus(stdout, a)
+	return nil
+}
+
+// conversionStatus returns the status of each retention policy holding the
+// shards, sorted by database and retention policy. The last conversion of
+// each is read from the history records.
+func conversionStatus(shards tsdb.ShardInfos, records []*ShardRecord) []*Status {
+	m := make(map[string]*Status)
+	var a []*Status
+	for _, si := range shards {
+		key := si.Database + "/" + si.RetentionPolicy
+		s := m[key]
+		if s == nil {
+			s = &Status{Database: si.Database, RetentionPolicy: si.RetentionPolicy}
+			m[key] = s
+			a = append(a, s)
+		}
+
+		switch si.Format {
+		case tsdb.TSM1:
+			s.TSM1++
+			continue
+		case tsdb.B1:
+			s.B1++
+		case tsdb.BZ1:
+			s.BZ1++
+		}
+		s.Remaining += si.Size
+	}
+
+	for _, r := range records {
+		if s := m[r.Database+"/"+r.RetentionPolicy]; s != nil && r.Time.After(s.LastConverted) {
+			s.LastConverted = r.Time
+		}
+	}
+
+	sort.Sort(statuses(a))
+	return a
+}
+
+// printStatus prints a table of the status of each retention policy, and the
+// progress of the whole conversion.
+func printStatus(w io.Writer, a []*Status) {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "Database\tRetention\ttsm1\tb1\tbz1\tConverted\tRemaining\tLast Converted")
+
+	total := &Status{}
+	for _, s := range a {
+		last := "-"
+		if !s.LastConverted.IsZero() {
+			last = s.LastConverted.Format(time.RFC3339)
+		}
+		if s.LastConverted.After(total.LastConverted) {
+			total.LastConverted = s.LastConverted
+		}
+		total.TSM1, total.B1, total.BZ1 = total.TSM1+s.TSM1, total.B1+s.B1, total.BZ1+s.BZ1
+		total.Remaining += s.Remaining
+		fmt.Fprintf(tw, "%v\t%v\t%d\t%d\t%d\t%.1f%%\t%d\t%v\n", s.Database, s.RetentionPolicy, s.TSM1, s.B1, s.BZ1, 100*s.Converted(), s.Remaining, last)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d of %d shard(s) converted, %d bytes remaining.\n", total.TSM1, total.TSM1+total.B1+total.BZ1, total.Remaining)
+	if !total.LastConverted.IsZero() {
+		fmt.Fprintf(w, "Last shard converted at %v.\n", total.LastConverted.Format(time.RFC3339))
+	}
+}
+
+// statuses sorts statuses by database and retention policy.
+type statuses []*Status
+
+func (a statuses) Len() int      { return len(a) }
+func (a statuses) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a statuses) Less(i, j int) bool {
+	if a[i].Database != a[j].Database {
+		return a[i].Database < a[j].Database
+	}
+	return a[i].RetentionPolicy < a[j].RetentionPolicy
+}
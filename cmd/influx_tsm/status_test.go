@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Ensure shards are counted by format, with the bytes remaining and the last
+// conversion recorded, for each retention policy.
+func TestConversionStatus(t *testing.T) {
+	shards := tsdb.ShardInfos{
+		{Database: "db1", RetentionPolicy: "default", Path: "4", Format: tsdb.B1, Size: 5},
+		{Database: "db0", RetentionPolicy: "default", Path: "1", Format: tsdb.TSM1, Size: 10},
+		{Database: "db0", RetentionPolicy: "default", Path: "2", Format: tsdb.BZ1, Size: 20},
+		{Database: "db0", RetentionPolicy: "default", Path: "3", Format: tsdb.B1, Size: 30},
+	}
+	records := []*ShardRecord{
+		{Time: time.Unix(100, 0).UTC(), Database: "db0", RetentionPolicy: "default", Path: "1"},
+		{Time: time.Unix(50, 0).UTC(), Database: "db0", RetentionPolicy: "default", Path: "5"},
+		{Time: time.Unix(200, 0).UTC(), Database: "db2", RetentionPolicy: "default", Path: "6"},
+	}
+
+	a := conversionStatus(shards, records)
+	exp := []*Status{
+		{Database: "db0", RetentionPolicy: "default", TSM1: 1, B1: 1, BZ1: 1, Remaining: 50, LastConverted: time.Unix(100, 0).UTC()},
+		{Database: "db1", RetentionPolicy: "default", B1: 1, Remaining: 5},
+	}
+	if !reflect.DeepEqual(a, exp) {
+		t.Fatalf("unexpected status:\n\ngot=%+v\n\nexp=%+v", a, exp)
+	}
+
+	var buf bytes.Buffer
+	printStatus(&buf, a)
+	out := strings.Join(strings.Fields(buf.String()), " ")
+	if !strings.Contains(out, "db0 default 1 1 1 33.3% 50 1970-01-01T00:01:40Z") {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	} else if !strings.Contains(out, "db1 default 0 1 0 0.0% 5 -") {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	} else if !strings.Contains(out, "1 of 4 shard(s) converted, 55 bytes remaining.") {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+// Ensure the status command reports shards converted by a run.
+func TestRunStatus(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db0", "default", "1"), "cpu value=1 1000000000")
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db0", "default", "2"), "cpu value=2 2000000000")
+
+	if output, code := RunConvert("", "-y", "-nobackup", "-shards", "1", dataPath); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	}
+
+	defer func(o options, w io.Writer) { opts, stdout = o, w }(opts, stdout)
+	var buf bytes.Buffer
+	opts, stdout = options{}, &buf
+	if err := runStatus([]string{dataPath}); err != nil {
+		t.Fatal(err)
+	}
+	out := strings.Join(strings.Fields(buf.String()), " ")
+	if !strings.Contains(out, "db0 default 1 0 1 50.0%") {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	} else if !strings.Contains(out, "Last shard converted at") {
+		t.Fatalf("last conversion not reported:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// outputDir returns the directory converted shards are written below, if
+// not the data directory or a sink command.
+func outputDir() string {
+	if opts.Out != "" {
+		return opts.Out
+	}
+	return opts.TargetDir
+}
+
+// swapShard replaces the shard in the data directory with a symlink to its
+// converted copy in the target directory, moving the original to the trash.
+// The symlink is created beside the shard first, so that the shard is only
+// missing between two renames.
+func swapShard(si *tsdb.ShardInfo, trash *Trash) error {
+	rel := filepath.Join(si.Database, si.RetentionPolicy, si.Path)
+	src := si.FullPath(opts.DataPath)
+	tmp := fmt.Sprintf("%v.%v", src, tsmExt)
+
+	if _, err := os.Stat(filepath.Join(opts.TargetDir, rel)); err != nil {
+		return fmt.Errorf("converted shard missing from target directory: %v", err)
+	}
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.Symlink(filepath.Join(opts.TargetDir, rel), tmp); err != nil {
+		return err
+	}
+
+	logger.Debugf("Replacing %v with a symlink to %v\n", src, filepath.Join(opts.TargetDir, rel))
+	if err := replaceShard(trash, rel, tmp); err != nil {
+		if _, e := os.Lstat(src); e == nil {
+			os.Remove(tmp)
+		}
+		return err
+	}
+	return nil
+}
+
+// swapShards swaps each converted shard into the data directory, returning
+// those which could not be. A shard which fails to swap is left unchanged in
+// the data directory, and its error recorded in the report, with a result of
+// its own if it was converted by an earlier run.
+func swapShards(shards tsdb.ShardInfos, trash *Trash) tsdb.ShardInfos {
+	var failed tsdb.ShardInfos
+	for _, si := range shards {
+		if err := swapShard(si, trash); err != nil {
+			logger.Errorf("Failed to swap %v into the data directory: %v\n", si.FullPath(opts.DataPath), err)
+			failed = append(failed, si)
+			reported := false
+			for _, sr := range report.Shards {
+				if sr.Shard == si {
+					sr.Error = err.Error()
+					reported = true
+				}
+			}
+			if !reported {
+				report.Shards = append(report.Shards, &ShardResult{Shard: si, InputSize: si.Size, Error: err.Error()})
+			}
+			continue
+		}
+		logger.Infof("Swapped %v into the data directory\n", filepath.Join(opts.TargetDir, si.Database, si.RetentionPolicy, si.Path))
+	}
+	return failed
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Ensure a converted shard is swapped in as a symlink, and the original
+// moved to the trash.
+func TestSwapShards(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	defer func(o options) { opts = o }(opts)
+	opts = options{DataPath: filepath.Join(dir, "data"), TargetDir: filepath.Join(dir, "target")}
+
+	MustWriteFile(filepath.Join(dir, "data", "db0", "default", "1"), "b1")
+	MustWriteFile(filepath.Join(dir, "data", "db0", "default", "2"), "b1")
+	MustWriteFile(filepath.Join(dir, "target", "db0", "default", "1", "000000001-000000001.tsm"), "tsm1")
+
+	shards := tsdb.ShardInfos{
+		{Database: "db0", RetentionPolicy: "default", Path: "1"},
+		{Database: "db0", RetentionPolicy: "default", Path: "2"},
+	}
+	trash := NewTrash(opts.DataPath)
+	failed := swapShards(shards, trash)
+	if len(failed) != 1 || failed[0] != shards[1] {
+		t.Fatalf("unexpected failed shards: %v", failed)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "data", "db0", "default", "1", "000000001-000000001.tsm")); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "tsm1" {
+		t.Fatalf("unexpected shard data: %s", b)
+	}
+	if dest, err := os.Readlink(filepath.Join(dir, "data", "db0", "default", "1")); err != nil {
+		t.Fatal(err)
+	} else if dest != filepath.Join(dir, "target", "db0", "default", "1") {
+		t.Fatalf("unexpected symlink: %v", dest)
+	}
+	if _, err := os.Stat(filepath.Join(trash.Path(), trash.id, "db0", "default", "1")); err != nil {
+		t.Fatalf("original not trashed: %v", err)
+	}
+
+	// A shard missing from the target directory is left unchanged.
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "data", "db0", "default", "2")); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "b1" {
+		t.Fatalf("unexpected shard data: %s", b)
+	}
+}
+
+// Ensure a shard converted by an earlier run, which has no result in this
+// run, is reported as failed if it can't be swapped in.
+func TestSwapShards_Resumed(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	defer func(o options, r *Report) { opts, report = o, r }(opts, report)
+	opts = options{DataPath: filepath.Join(dir, "data"), TargetDir: filepath.Join(dir, "target")}
+	report = &Report{}
+
+	MustWriteFile(filepath.Join(dir, "data", "db0", "default", "1"), "b1")
+	si := &tsdb.ShardInfo{Database: "db0", RetentionPolicy: "default", Path: "1"}
+	if failed := swapShards(tsdb.ShardInfos{si}, NewTrash(opts.DataPath)); len(failed) != 1 {
+		t.Fatalf("unexpected failed shards: %v", failed)
+	}
+	if len(report.Shards) != 1 || report.Shards[0].Shard != si || report.Shards[0].Error == "" {
+		t.Fatalf("unexpected results: %+v", report.Shards)
+	}
+
+	var buf bytes.Buffer
+	report.Failed = tsdb.ShardInfos{si}
+	report.WriteSummary(&buf)
+	if !strings.Contains(buf.String(), "FAILED") {
+		t.Fatalf("failure not in summary: %s", buf.String())
+	}
+}
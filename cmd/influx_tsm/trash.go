@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// trashDir is the directory, within the data directory, holding deleted files.
+const trashDir = ".trash"
+
+// trashIDFormat is the time format of the ID of a trash batch.
+const trashIDFormat = "20060102T150405.000000000Z"
+
+// Trash is a staging area for files deleted during conversion, so they can
+// be restored until they expire or the trash is emptied. Files deleted by a
+// single run are kept together in a batch, below their path relative to the
+// data directory.
+type Trash struct {
+	root string
+	id   string
+}
+
+// NewTrash returns the trash of the data directory at root. Files moved to
+// it are added to a new batch.
+func NewTrash(root string) *Trash {
+	return &Trash{
+		root: root,
+		id:   time.Now().UTC().Format(trashIDFormat),
+	}
+}
+
+// Path returns the path to the trash directory.
+func (t *Trash) Path() string { return filepath.Join(t.root, trashDir) }
+
+// Move moves the file or directory at path, relative to the data directory,
+// into the current batch.
+func (t *Trash) Move(path string) error {
+	dest := filepath.Join(t.Path(), t.id, path)
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(t.root, path), dest)
+}
+
+// Unmove moves the file or directory at path, relative to the data
+// directory, back from the current batch, undoing Move.
+func (t *Trash) Unmove(path string) error {
+	return os.Rename(filepath.Join(t.Path(), t.id, path), filepath.Join(t.root, path))
+}
+
+// TrashBatch describes the files deleted by a single run.
+type TrashBatch struct {
+	ID    string
+	Time  time.Time
+	Paths []string
+	Size  int64
+}
+
+// Batches returns the batches in the trash, oldest first.
+func (t *Trash) Batches() ([]*TrashBatch, error) {
+	fis, err := ioutil.ReadDir(t.Path())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var a []*TrashBatch
+	for _, fi := range fis {
+		tm, err := time.Parse(trashIDFormat, fi.Name())
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+
+		b := &TrashBatch{ID: fi.Name(), Time: tm}
+		if b.Paths, b.Size, err = trashEntries(filepath.Join(t.Path(), b.ID)); err != nil {
+			return nil, err
+		}
+		a = append(a, b)
+	}
+
+	sort.Sort(trashBatches(a))
+	return a, nil
+}
+
+// trashEntries returns the deleted shards and backups below the batch
+// directory at dir, and their total size. Backups deleted by the clean
+// command, and their manifests, are at the top level. Shards are at the
+// third level: database, retention policy, shard.
+func trashEntries(dir string) ([]string, int64, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	var paths []string
+	for _, fi := range fis {
+		if isBackupName(fi.Name()) {
+			paths = append(paths, filepath.Join(dir, fi.Name()))
+			continue
+		}
+		a, err := filepath.Glob(filepath.Join(dir, fi.Name(), "*", "*"))
+		if err != nil {
+			return nil, 0, err
+		}
+		paths = append(paths, a...)
+	}
+
+	var sz int64
+	for i, p := range paths {
+		n, err := dirSize(p)
+		if err != nil {
+			return nil, 0, err
+		}
+		sz += n
+		paths[i], _ = filepath.Rel(dir, p)
+	}
+	return paths, sz, nil
+}
+
+// isBackupName returns whether name is that of a backup of a database, or of
+// its manifest.
+func isBackupName(name string) bool {
+	name = strings.TrimSuffix(name, "."+manifestExt)
+	return strings.HasSuffix(name, "."+backupExt) || strings.HasSuffix(name, "."+backupExt+"."+backupArchiveExt)
+}
+
+// Restore moves the files of the batch back to their original paths. Files
+// are only restored if nothing exists at their original path.
+func (t *Trash) Restore(id string) error {
+	dir := filepath.Join(t.Path(), id)
+	paths, _, err := trashEntries(dir)
+	if err != nil {
+		return err
+	} else if len(paths) == 0 {
+		return fmt.Errorf("no such trash batch: %v", id)
+	}
+
+	// Check every path before moving anything.
+	for _, p := range paths {
+		if _, err := os.Stat(filepath.Join(t.root, p)); err == nil {
+			return fmt.Errorf("cannot restore %v, it already exists", filepath.Join(t.root, p))
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for _, p := range paths {
+		if err := os.Rename(filepath.Join(dir, p), filepath.Join(t.root, p)); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// Empty permanently deletes every batch created before tm.
+func (t *Trash) Empty(tm time.Time) error {
+	batches, err := t.Batches()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range batches {
+		if !b.Time.Before(tm) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(t.Path(), b.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trashBatches sorts batches by time.
+type trashBatches []*TrashBatch
+
+func (a trashBatches) Len() int           { return len(a) }
+func (a trashBatches) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a trashBatches) Less(i, j int) bool { return a[i].Time.Before(a[j].Time) }
+
+const trashUsage = `Usage: influx_tsm trash <command> <data-path> [batch-id]
+
+Manage the files deleted during conversion, which are kept in the '.trash'
+directory of the data directory, and the backups deleted by 'influx_tsm
+clean', kept in the '.trash' directory of the directory holding them.
+
+Commands:
+  list     List the batches in the trash, one per conversion run.
+  restore  Move the files of a batch back to their original paths.
+  empty    Permanently delete every batch.
+`
+
+// runTrash runs the trash command with args.
+func runTrash(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf(trashUsage)
+	}
+	t := NewTrash(args[1])
+
+	switch args[0] {
+	case "list":
+		batches, err := t.Batches()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+		fmt.Fprintln(w, "Batch\tDeleted\tSize\tPaths")
+		for _, b := range batches {
+			fmt.Fprintf(w, "%v\t%v\t%d\t%v\n", b.ID, b.Time.Format(time.RFC3339), b.Size, strings.Join(b.Paths, ", "))
+		}
+		return w.Flush()
+	case "restore":
+		if len(args) < 3 {
+			return fmt.Errorf("no batch specified to restore")
+		}
+		return t.Restore(args[2])
+	case "empty":
+		return t.Empty(time.Now())
+	default:
+		return fmt.Errorf(trashUsage)
+	}
+}
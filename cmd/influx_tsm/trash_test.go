@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Ensure files moved to the trash can be listed and restored.
+func TestTrash_Restore(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	MustWriteFile(filepath.Join(dir, "db0", "default", "1"), "data")
+
+	trash := NewTrash(dir)
+	if err := trash.Move(filepath.Join("db0", "default", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	batches, err := trash.Batches()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(batches) != 1 {
+		t.Fatalf("unexpected batch count: %d", len(batches))
+	} else if b := batches[0]; !reflect.DeepEqual(b.Paths, []string{filepath.Join("db0", "default", "1")}) || b.Size != 4 {
+		t.Fatalf("unexpected batch: %+v", b)
+	}
+
+	// Restoring over an existing file fails.
+	MustWriteFile(filepath.Join(dir, "db0", "default", "1"), "tsm")
+	if err := trash.Restore(batches[0].ID); err == nil {
+		t.Fatal("expected error")
+	}
+
+	os.Remove(filepath.Join(dir, "db0", "default", "1"))
+	if err := trash.Restore(batches[0].ID); err != nil {
+		t.Fatal(err)
+	} else if b, err := ioutil.ReadFile(filepath.Join(dir, "db0", "default", "1")); err != nil || string(b) != "data" {
+		t.Fatalf("unexpected restored file: %q, %v", b, err)
+	} else if batches, _ := trash.Batches(); len(batches) != 0 {
+		t.Fatalf("unexpected batch count: %d", len(batches))
+	}
+}
+
+// Ensure emptying the trash only deletes batches older than the given time.
+func TestTrash_Empty(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	MustWriteFile(filepath.Join(dir, "db0", "default", "1"), "data")
+	trash := NewTrash(dir)
+	if err := trash.Move(filepath.Join("db0", "default", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := trash.Empty(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if batches, _ := trash.Batches(); len(batches) != 1 {
+		t.Fatalf("unexpected batch count: %d", len(batches))
+	}
+
+	if err := trash.Empty(time.Now()); err != nil {
+		t.Fatal(err)
+	} else if batches, _ := trash.Batches(); len(batches) != 0 {
+		t.Fatalf("unexpected batch count: %d", len(batches))
+	}
+}
+
+// MustWriteFile writes data to the file at path, creating its directory. Panic on error.
+func MustWriteFile(path, data string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		panic(err)
+	} else if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,115 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Cache holds the metadata of shards read previously, keyed by path, so that
+// listing unchanged shards does not require reading them again. A shard is
+// read again if its modification time or size has changed.
+type Cache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	dirty   bool
+}
+
+// cacheEntry is the metadata of a single shard.
+type cacheEntry struct {
+	ModTime time.Time  `json:"modTime"`
+	Size    int64      `json:"size"`
+	Info    *ShardInfo `json:"info"`
+}
+
+// OpenCache returns the cache stored in the file at path. A missing file is
+// an empty cache.
+func OpenCache(path string) (*Cache, error) {
+	c := &Cache{path: path, entries: make(map[string]*cacheEntry)}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Save writes the cache to its file, if it has changed.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+
+	// Replace the file atomically, so a failed write never loses the cache.
+	if err := os.MkdirAll(filepath.Dir(c.path), 0777); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// get returns a copy of the metadata of the shard at path, if it is cached
+// and fi shows it is unchanged.
+func (c *Cache) get(path string, fi os.FileInfo) *ShardInfo {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entries[absPath(path)]
+	if e == nil || !e.ModTime.Equal(fi.ModTime()) || e.Size != fi.Size() {
+		return nil
+	}
+	si := *e.Info
+	return &si
+}
+
+// put caches a copy of the metadata of the shard at path.
+func (c *Cache) put(path string, fi os.FileInfo, si *ShardInfo) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	other := *si
+	c.entries[absPath(path)] = &cacheEntry{ModTime: fi.ModTime(), Size: fi.Size(), Info: &other}
+	c.dirty = true
+}
+
+// absPath returns the absolute form of path, or path if it has none.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,102 @@
+package tsdb_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Ensure unchanged shards are read from the cache, and changed shards are read again.
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx_tsm-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db0", "default", "1")
+	MustCreateBZ1Shard(path, 10, 20)
+
+	cache, err := tsdb.OpenCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := tsdb.NewDatabase(filepath.Join(dir, "db0"))
+	db.Cache = cache
+	if shards, err := db.Shards(); err != nil {
+		t.Fatal(err)
+	} else if si := shards[0]; si.Format != tsdb.BZ1 || si.SeriesN != 1 || si.MaxTime.UnixNano() != 20 {
+		t.Fatalf("unexpected shard: %+v", si)
+	} else if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the shard, keeping its size and modification time.
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(path, make([]byte, fi.Size()), 0666); err != nil {
+		t.Fatal(err)
+	} else if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reopened cache still holds the shard.
+	cache, err = tsdb.OpenCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Cache = cache
+	if shards, err := db.Shards(); err != nil {
+		t.Fatal(err)
+	} else if si := shards[0]; si.Database != "db0" || si.Path != "1" || si.SeriesN != 1 {
+		t.Fatalf("unexpected shard: %+v", si)
+	}
+
+	// Once modified, the shard is read again, and found corrupt.
+	if err := os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	} else if shards, err := db.Shards(); err != nil {
+		t.Fatal(err)
+	} else if len(shards) != 0 || len(db.Skipped) != 1 {
+		t.Fatalf("expected corrupt shard to be skipped, got shards %v", shards)
+	}
+}
+
+// MustCreateBZ1Shard creates a bz1 shard at path holding a single block of a
+// single series, covering tmin to tmax. Panic on error.
+func MustCreateBZ1Shard(path string, tmin, tmax int64) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		panic(err)
+	}
+
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		meta, _ := tx.CreateBucket([]byte("meta"))
+		meta.Put([]byte("format"), []byte("bz1"))
+
+		points, _ := tx.CreateBucket([]byte("points"))
+		b, _ := points.CreateBucket([]byte("cpu"))
+		return b.Put(u64tob(uint64(tmin)), u64tob(uint64(tmax)))
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// u64tob converts a uint64 into an 8-byte slice.
+func u64tob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,603 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Flags for differentiating between engines
+const (
+	B1 EngineFormat = iota
+	BZ1
+	TSM1
+)
+
+// EngineFormat holds the format of the engine a shard uses.
+type EngineFormat int
+
+// String returns the string format of the engine.
+func (e EngineFormat) String() string {
+	switch e {
+	case TSM1:
+		return "tsm1"
+	case B1:
+		return "b1"
+	case BZ1:
+		return "bz1"
+	default:
+		panic("unrecognized shard engine format")
+	}
+}
+
+// MarshalText encodes the format as its name.
+func (e EngineFormat) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+// UnmarshalText decodes the format from its name.
+func (e *EngineFormat) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "tsm1":
+		*e = TSM1
+	case "b1":
+		*e = B1
+	case "bz1":
+		*e = BZ1
+	default:
+		return fmt.Errorf("unrecognized engine format: %s", text)
+	}
+	return nil
+}
+
+// ShardInfo is the description of a shard on disk.
+type ShardInfo struct {
+	Database        string       `json:"database"`
+	RetentionPolicy string       `json:"retentionPolicy"`
+	Path            string       `json:"path"`
+	Format          EngineFormat `json:"format"`
+	Size            int64        `json:"size"`
+
+	// MinTime and MaxTime are the times of the earliest and latest points
+	// in the shard. Both are zero if the shard holds no points.
+	MinTime time.Time `json:"minTime"`
+	MaxTime time.Time `json:"maxTime"`
+
+	// SeriesN is the number of series in the shard. It is zero for tsm1 shards.
+	SeriesN int `json:"seriesN"`
+}
+
+// FormatAsString returns the format of the shard as a string.
+func (s *ShardInfo) FormatAsString() string {
+	return s.Format.String()
+}
+
+// FullPath returns the full path to the shard, given the data directory root.
+func (s *ShardInfo) FullPath(dataPath string) string {
+	return filepath.Join(dataPath, s.Database, s.RetentionPolicy, s.Path)
+}
+
+// GroupStart returns the start of the shard group of duration d holding the
+// shard, aligned as the server aligns shard groups.
+func (s *ShardInfo) GroupStart(d time.Duration) time.Time {
+	if s.MinTime.IsZero() {
+		return time.Time{}
+	}
+	return s.MinTime.Truncate(d)
+}
+
+// ShardInfos is a sortable collection of shard descriptions.
+type ShardInfos []*ShardInfo
+
+func (s ShardInfos) Len() int      { return len(s) }
+func (s ShardInfos) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ShardInfos) Less(i, j int) bool {
+	if s[i].Database == s[j].Database {
+		if s[i].RetentionPolicy == s[j].RetentionPolicy {
+			return s[i].Path < s[j].Path
+		}
+
+		return s[i].RetentionPolicy < s[j].RetentionPolicy
+	}
+
+	return s[i].Database < s[j].Database
+}
+
+// Databases returns the sorted unique set of databases for the shards.
+func (s ShardInfos) Databases() []string {
+	dbm := make(map[string]bool)
+	for _, ss := range s {
+		dbm[ss.Database] = true
+	}
+
+	var dbs []string
+	for k := range dbm {
+		dbs = append(dbs, k)
+	}
+	sort.Strings(dbs)
+	return dbs
+}
+
+// Filter returns a copy of the ShardInfos, with shards of the given
+// format removed.
+func (s ShardInfos) Filter(f EngineFormat) ShardInfos {
+	var a ShardInfos
+	for _, si := range s {
+		if si.Format != f {
+			a = append(a, si)
+		}
+	}
+	return a
+}
+
+// Size returns the space on disk consumed by the shards.
+func (s ShardInfos) Size() int64 {
+	var sz int64
+	for _, si := range s {
+		sz += si.Size
+	}
+	return sz
+}
+
+// ExclusiveDatabases returns a copy of the ShardInfo, with shards associated
+// with the given databases present. If the given set is empty, all databases
+// are returned.
+func (s ShardInfos) ExclusiveDatabases(exc []string) ShardInfos {
+	var a ShardInfos
+
+	// Empty set? Return everything.
+	if len(exc) == 0 {
+		a = make(ShardInfos, len(s))
+		copy(a, s)
+		return a
+	}
+
+	for _, si := range s {
+		if slicesContainsString(si.Database, exc) {
+			a = append(a, si)
+		}
+	}
+	return a
+}
+
+// ExcludeDatabases returns a copy of the ShardInfo, with shards associated
+// with the given databases removed.
+func (s ShardInfos) ExcludeDatabases(exc []string) ShardInfos {
+	var a ShardInfos
+	for _, si := range s {
+		if !slicesContainsString(si.Database, exc) {
+			a = append(a, si)
+		}
+	}
+	return a
+}
+
+// ExclusiveRetentionPolicies returns a copy of the ShardInfo, with only shards
+// of the given retention policies present. If the given set is empty, all
+// retention policies are returned.
+func (s ShardInfos) ExclusiveRetentionPolicies(exc []string) ShardInfos {
+	var a ShardInfos
+
+	// Empty set? Return everything.
+	if len(exc) == 0 {
+		a = make(ShardInfos, len(s))
+		copy(a, s)
+		return a
+	}
+
+	for _, si := range s {
+		if slicesContainsString(si.RetentionPolicy, exc) {
+			a = append(a, si)
+		}
+	}
+	return a
+}
+
+// ExclusiveShards returns a copy of the ShardInfo, with only the shards with
+// the given IDs present. If the given set is empty, all shards are returned.
+func (s ShardInfos) ExclusiveShards(ids []string) ShardInfos {
+	var a ShardInfos
+
+	// Empty set? Return everything.
+	if len(ids) == 0 {
+		a = make(ShardInfos, len(s))
+		copy(a, s)
+		return a
+	}
+
+	for _, si := range s {
+		if slicesContainsString(si.Path, ids) {
+			a = append(a, si)
+		}
+	}
+	return a
+}
+
+// Groups returns the shards grouped into shard groups of duration d, sorted
+// by time. Shards without points are grouped together, first, under the zero time.
+func (s ShardInfos) Groups(d time.Duration) []*ShardGroup {
+	m := make(map[time.Time]*ShardGroup)
+	for _, si := range s {
+		start := si.GroupStart(d)
+		g := m[start]
+		if g == nil {
+			g = &ShardGroup{Start: start}
+			if !start.IsZero() {
+				g.End = start.Add(d)
+			}
+			m[start] = g
+		}
+		g.Shards = append(g.Shards, si)
+	}
+
+	var a []*ShardGroup
+	for _, g := range m {
+		sort.Sort(g.Shards)
+		a = append(a, g)
+	}
+	sort.Sort(shardGroups(a))
+	return a
+}
+
+// Before returns a copy of the ShardInfos, with only the shards of shard
+// groups of duration d ending at or before t present.
+func (s ShardInfos) Before(t time.Time, d time.Duration) ShardInfos {
+	var a ShardInfos
+	for _, si := range s {
+		if start := si.GroupStart(d); !start.IsZero() && !start.Add(d).After(t) {
+			a = append(a, si)
+		}
+	}
+	return a
+}
+
+// Contains returns whether s holds the shard at the same path as si.
+func (s ShardInfos) Contains(si *ShardInfo) bool {
+	for _, x := range s {
+		if x.Database == si.Database && x.RetentionPolicy == si.RetentionPolicy && x.Path == si.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// ShardGroup is the set of shards, across databases and retention policies,
+// covering the same period of time.
+type ShardGroup struct {
+	Start  time.Time
+	End    time.Time
+	Shards ShardInfos
+}
+
+// shardGroups sorts shard groups by start time.
+type shardGroups []*ShardGroup
+
+func (a shardGroups) Len() int           { return len(a) }
+func (a shardGroups) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a shardGroups) Less(i, j int) bool { return a[i].Start.Before(a[j].Start) }
+
+// Database represents an entire database on disk.
+type Database struct {
+	path string
+
+	// Cache, if set, holds shard metadata read previously.
+	Cache *Cache
+
+	// SkipErrors skips shards which can't be read, recording them in
+	// Skipped, rather than failing. Corrupt shards, and files whose names
+	// are not shard IDs, are always skipped.
+	SkipErrors bool
+	Skipped    []*ShardError
+}
+
+// ShardError is the error reading a shard.
+type ShardError struct {
+	Database        string
+	RetentionPolicy string
+	Path            string
+	Err             error
+}
+
+// Error returns the error reading the shard.
+func (e *ShardError) Error() string { return e.Err.Error() }
+
+// CorruptShardError is the error reading a shard whose file is not a valid
+// bolt database, or which has a page that can't be read.
+type CorruptShardError struct {
+	Path string
+	Err  error
+}
+
+// Error returns the corruption found in the shard.
+func (e *CorruptShardError) Error() string {
+	return fmt.Sprintf("shard %v is corrupt: %v", e.Path, e.Err)
+}
+
+// InvalidShardNameError is the error for a file in a retention policy whose
+// name is not a numeric shard ID, such as an editor's backup file. influxd
+// ignores such files.
+type InvalidShardNameError struct {
+	Path string
+}
+
+// Error returns the path of the file.
+func (e *InvalidShardNameError) Error() string {
+	return fmt.Sprintf("%v is not a shard, its name is not a numeric shard ID", e.Path)
+}
+
+// ValidShardName returns true if name is a numeric shard ID.
+func ValidShardName(name string) bool {
+	_, err := strconv.ParseUint(name, 10, 64)
+	return err == nil
+}
+
+// NewDatabase creates a database instance using data at path.
+func NewDatabase(path string) *Database {
+	return &Database{path: path}
+}
+
+// Name returns the name of the database.
+func (d *Database) Name() string {
+	return path.Base(d.path)
+}
+
+// Path returns the path to the database.
+func (d *Database) Path() string {
+	return d.path
+}
+
+// Shards returns information for every shard in the database.
+func (d *Database) Shards() ([]*ShardInfo, error) {
+	fd, err := os.Open(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get each retention policy.
+	rps, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Process each retention policy.
+	var shardInfos []*ShardInfo
+	for _, rp := range rps {
+		rpfd, err := os.Open(filepath.Join(d.path, rp))
+		if err != nil {
+			return nil, err
+		}
+
+		// Process each shard
+		shards, err := rpfd.Readdirnames(-1)
+		rpfd.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sh := range shards {
+			if !ValidShardName(sh) {
+				d.Skipped = append(d.Skipped, &ShardError{Database: d.Name(), RetentionPolicy: path.Base(rp), Path: sh,
+					Err: &InvalidShardNameError{Path: filepath.Join(d.path, rp, sh)}})
+				continue
+			}
+
+			si, err := readShard(filepath.Join(d.path, rp, sh), d.Cache)
+			if _, ok := err.(*CorruptShardError); ok || (err != nil && d.SkipErrors) {
+				d.Skipped = append(d.Skipped, &ShardError{Database: d.Name(), RetentionPolicy: path.Base(rp), Path: sh, Err: err})
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			si.Database = d.Name()
+			si.RetentionPolicy = path.Base(rp)
+			si.Path = sh
+			shardInfos = append(shardInfos, si)
+		}
+	}
+
+	sort.Sort(ShardInfos(shardInfos))
+	return shardInfos, nil
+}
+
+// Shard returns information for a single shard of the database.
+func (d *Database) Shard(rp, name string) (*ShardInfo, error) {
+	si, err := readShard(filepath.Join(d.path, rp, name), d.Cache)
+	if err != nil {
+		return nil, err
+	}
+	si.Database = d.Name()
+	si.RetentionPolicy = rp
+	si.Path = name
+	return si, nil
+}
+
+// readShard returns the format, size on disk, time range and series count of
+// the shard at path. Unchanged shards are read from cache, if not nil.
+func readShard(path string, cache *Cache) (*ShardInfo, error) {
+	// If it's a directory then it's a tsm1 engine
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if si := cache.get(path, fi); si != nil {
+		return si, nil
+	}
+	si := &ShardInfo{Size: fi.Size()}
+	if fi.Mode().IsDir() {
+		si.Format = TSM1
+		return si, nil
+	} else if fi.Size() == 0 {
+		// A shard truncated by a crash, which bolt would initialize as new.
+		return nil, &CorruptShardError{Path: path, Err: fmt.Errorf("empty file")}
+	}
+
+	// It must be a BoltDB-based engine.
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("shard %v is locked by another process, such as a running influxd", path)
+	} else if err == bolt.ErrInvalid || err == bolt.ErrVersionMismatch || err == bolt.ErrChecksum {
+		return nil, &CorruptShardError{Path: path, Err: err}
+	} else if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// bolt panics on reading a corrupt page.
+	if err := readSafely(path, func() error {
+		return db.View(func(tx *bolt.Tx) error { return readFormat(tx, si) })
+	}); err != nil {
+		return nil, err
+	}
+
+	cache.put(path, fi, si)
+	return si, nil
+}
+
+// readFormat sets the format of the shard, and the time range and series
+// count of its format.
+func readFormat(tx *bolt.Tx, si *ShardInfo) error {
+	// Retrieve the meta bucket.
+	b := tx.Bucket([]byte("meta"))
+
+	// If no format is specified then it must be an original b1 database.
+	if b == nil {
+		si.Format = B1
+		readB1(tx, si)
+		return nil
+	}
+
+	// There is an actual format indicator.
+	switch f := string(b.Get([]byte("format"))); f {
+	case "b1", "v1":
+		si.Format = B1
+		readB1(tx, si)
+	case "bz1":
+		si.Format = BZ1
+		readBZ1(tx, si)
+	default:
+		return fmt.Errorf("unrecognized engine format: %s", f)
+	}
+	return nil
+}
+
+// b1Buckets are the top-level buckets of a b1 shard which do not hold series data.
+var b1Buckets = map[string]bool{
+	"fields": true,
+	"meta":   true,
+	"series": true,
+	"wal":    true,
+}
+
+// readB1 sets the time range and series count of a b1 shard, including
+// points not yet flushed from the WAL.
+func readB1(tx *bolt.Tx, si *ShardInfo) {
+	var r timeRange
+	series := make(map[string]bool)
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if b1Buckets[string(name)] {
+			return nil
+		}
+		series[string(name)] = true
+
+		c := b.Cursor()
+		if k, _ := c.First(); k != nil {
+			r.add(btoi64(k))
+		}
+		if k, _ := c.Last(); k != nil {
+			r.add(btoi64(k))
+		}
+		return nil
+	})
+
+	// WAL entries are prefixed by their timestamp, then their series key.
+	if wal := tx.Bucket([]byte("wal")); wal != nil {
+		wal.ForEach(func(k, _ []byte) error {
+			if b := wal.Bucket(k); b != nil {
+				b.ForEach(func(_, v []byte) error {
+					r.add(btoi64(v))
+					n := binary.BigEndian.Uint32(v[8:12])
+					series[string(v[12:12+n])] = true
+					return nil
+				})
+			}
+			return nil
+		})
+	}
+
+	si.MinTime, si.MaxTime = r.times()
+	si.SeriesN = len(series)
+}
+
+// readBZ1 sets the time range and series count of a bz1 shard. Blocks are
+// keyed by their earliest time, and their values are prefixed by their
+// latest time.
+func readBZ1(tx *bolt.Tx, si *ShardInfo) {
+	points := tx.Bucket([]byte("points"))
+	if points == nil {
+		return
+	}
+
+	var r timeRange
+	points.ForEach(func(k, _ []byte) error {
+		b := points.Bucket(k)
+		if b == nil {
+			return nil
+		}
+		si.SeriesN++
+
+		c := b.Cursor()
+		if k, _ := c.First(); k != nil {
+			r.add(btoi64(k))
+		}
+		if _, v := c.Last(); len(v) >= 8 {
+			r.add(btoi64(v))
+		}
+		return nil
+	})
+	si.MinTime, si.MaxTime = r.times()
+}
+
+// timeRange accumulates the earliest and latest of a set of timestamps.
+type timeRange struct {
+	min, max int64
+	ok       bool
+}
+
+func (r *timeRange) add(t int64) {
+	if !r.ok || t < r.min {
+		r.min = t
+	}
+	if !r.ok || t > r.max {
+		r.max = t
+	}
+	r.ok = true
+}
+
+// times returns the range as times, or zero times if the range is empty.
+func (r *timeRange) times() (time.Time, time.Time) {
+	if !r.ok {
+		return time.Time{}, time.Time{}
+	}
+	return time.Unix(0, r.min).UTC(), time.Unix(0, r.max).UTC()
+}
+
+// btoi64 converts the first 8 bytes of b to an int64.
+func btoi64(b []byte) int64 { return int64(binary.BigEndian.Uint64(b)) }
+
+func slicesContainsString(s string, a []string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
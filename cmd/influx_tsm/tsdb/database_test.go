@@ -0,0 +1,180 @@
+package tsdb_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Ensure shards are grouped into aligned shard groups across databases.
+func TestShardInfos_Groups(t *testing.T) {
+	day := 24 * time.Hour
+	shards := tsdb.ShardInfos{
+		{Database: "db0", Path: "1", MinTime: mustParseTime("2016-01-01T10:00:00Z")},
+		{Database: "db0", Path: "2", MinTime: mustParseTime("2016-01-02T10:00:00Z")},
+		{Database: "db1", Path: "3", MinTime: mustParseTime("2016-01-01T23:00:00Z")},
+		{Database: "db1", Path: "4"},
+	}
+
+	groups := shards.Groups(day)
+	var got [][]string
+	for _, g := range groups {
+		var paths []string
+		for _, si := range g.Shards {
+			paths = append(paths, si.Path)
+		}
+		got = append(got, paths)
+	}
+	if exp := [][]string{{"4"}, {"1", "3"}, {"2"}}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected groups: %v", got)
+	}
+
+	if !groups[0].Start.IsZero() {
+		t.Fatalf("unexpected start for empty shards: %v", groups[0].Start)
+	} else if g := groups[1]; !g.Start.Equal(mustParseTime("2016-01-01T00:00:00Z")) || !g.End.Equal(mustParseTime("2016-01-02T00:00:00Z")) {
+		t.Fatalf("unexpected range: %v - %v", g.Start, g.End)
+	}
+
+	// Only whole groups ending by the given time are selected.
+	if a := shards.Before(mustParseTime("2016-01-02T00:00:00Z"), day); len(a) != 2 || a[0].Path != "1" || a[1].Path != "3" {
+		t.Fatalf("unexpected shards: %v", a)
+	}
+}
+
+// Ensure shard info is encoded as JSON with the format as a name.
+func TestShardInfo_MarshalJSON(t *testing.T) {
+	si := &tsdb.ShardInfo{Database: "db0", RetentionPolicy: "default", Path: "1", Format: tsdb.BZ1, Size: 10}
+	b, err := json.Marshal(si)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := `{"database":"db0","retentionPolicy":"default","path":"1","format":"bz1","size":10,"minTime":"0001-01-01T00:00:00Z","maxTime":"0001-01-01T00:00:00Z","seriesN":0}`; string(b) != exp {
+		t.Fatalf("unexpected json: %s", b)
+	}
+}
+
+// Ensure shards of excluded databases are removed.
+func TestShardInfos_ExcludeDatabases(t *testing.T) {
+	shards := tsdb.ShardInfos{
+		{Database: "_internal", Path: "1"},
+		{Database: "db0", Path: "2"},
+		{Database: "staging", Path: "3"},
+	}
+
+	if a := shards.ExcludeDatabases([]string{"_internal", "staging"}); len(a) != 1 || a[0].Path != "2" {
+		t.Fatalf("unexpected shards: %v", a)
+	}
+}
+
+// Ensure shards can be restricted to a set of retention policies.
+func TestShardInfos_ExclusiveRetentionPolicies(t *testing.T) {
+	shards := tsdb.ShardInfos{
+		{Database: "db0", RetentionPolicy: "default", Path: "1"},
+		{Database: "db0", RetentionPolicy: "monitoring", Path: "2"},
+		{Database: "db1", RetentionPolicy: "default", Path: "3"},
+	}
+
+	if a := shards.ExclusiveRetentionPolicies(nil); len(a) != 3 {
+		t.Fatalf("unexpected shard count: %d", len(a))
+	}
+	if a := shards.ExclusiveRetentionPolicies([]string{"default"}); len(a) != 2 || a[0].Path != "1" || a[1].Path != "3" {
+		t.Fatalf("unexpected shards: %v", a)
+	}
+}
+
+// Ensure shards can be selected by ID.
+func TestShardInfos_ExclusiveShards(t *testing.T) {
+	shards := tsdb.ShardInfos{
+		{Database: "db0", Path: "102"},
+		{Database: "db0", Path: "103"},
+		{Database: "db1", Path: "250"},
+	}
+
+	if a := shards.ExclusiveShards([]string{"102", "250"}); len(a) != 2 || a[0].Path != "102" || a[1].Path != "250" {
+		t.Fatalf("unexpected shards: %v", a)
+	}
+}
+
+// mustParseTime parses an RFC3339 time. Panic on error.
+func mustParseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Ensure shards which can't be read fail the database, unless skipped.
+func TestDatabase_Shards_SkipErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx_tsm-database-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	MustCreateBZ1Shard(filepath.Join(dir, "db0", "default", "1"), 10, 20)
+	MustCreateBZ1Shard(filepath.Join(dir, "db0", "default", "2"), 10, 20)
+	MustSetFormat(filepath.Join(dir, "db0", "default", "2"), "unknown")
+
+	db := tsdb.NewDatabase(filepath.Join(dir, "db0"))
+	if _, err := db.Shards(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	db.SkipErrors = true
+	shards, err := db.Shards()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(shards) != 1 || shards[0].Path != "1" {
+		t.Fatalf("unexpected shards: %v", shards)
+	} else if len(db.Skipped) != 1 {
+		t.Fatalf("unexpected skipped shards: %v", db.Skipped)
+	} else if e := db.Skipped[0]; e.Database != "db0" || e.RetentionPolicy != "default" || e.Path != "2" || e.Err == nil {
+		t.Fatalf("unexpected skipped shard: %+v", e)
+	}
+}
+
+// Ensure files whose names are not shard IDs are skipped, and recorded.
+func TestDatabase_Shards_InvalidName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx_tsm-database-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	MustCreateBZ1Shard(filepath.Join(dir, "db0", "default", "57"), 10, 20)
+	MustCreateBZ1Shard(filepath.Join(dir, "db0", "default", "57~"), 10, 20)
+
+	db := tsdb.NewDatabase(filepath.Join(dir, "db0"))
+	shards, err := db.Shards()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(shards) != 1 || shards[0].Path != "57" {
+		t.Fatalf("unexpected shards: %v", shards)
+	} else if len(db.Skipped) != 1 || db.Skipped[0].Path != "57~" {
+		t.Fatalf("unexpected skipped shards: %v", db.Skipped)
+	} else if _, ok := db.Skipped[0].Err.(*tsdb.InvalidShardNameError); !ok {
+		t.Fatalf("unexpected error: %v", db.Skipped[0].Err)
+	}
+}
+
+// MustSetFormat sets the format recorded in the bolt shard at path.
+func MustSetFormat(path, format string) {
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("meta")).Put([]byte("format"), []byte(format))
+	}); err != nil {
+		panic(err)
+	}
+}
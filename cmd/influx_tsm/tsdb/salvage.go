@@ -0,0 +1,140 @@
+package tsdb
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// readSafely runs fn, which reads the bolt file at path, returning a panic
+// raised on reading a corrupt page as a *CorruptShardError. A page which
+// can't be mapped faults, rather than crashing the process.
+func readSafely(path string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &CorruptShardError{Path: path, Err: fmt.Errorf("%v", r)}
+		}
+	}()
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	return fn()
+}
+
+// SalvageResult describes what Salvage copied of a corrupt shard, and what
+// it could not.
+type SalvageResult struct {
+	Buckets int `json:"buckets"`
+	Keys    int `json:"keys"`
+
+	// Lost lists the buckets which could not be copied in full, and why.
+	Lost []string `json:"lost,omitempty"`
+}
+
+// Salvage copies the buckets and keys of the corrupt bolt file at src which
+// can still be read to a new file at dst. Each bucket is read in key order
+// until a corrupt page is reached, so the keys before it are kept, and the
+// rest of the bucket is lost. Other buckets are still copied.
+func Salvage(src, dst string) (*SalvageResult, error) {
+	sdb, err := bolt.Open(src, 0666, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("open %v: %v", src, err)
+	}
+	defer sdb.Close()
+
+	ddb, err := bolt.Open(dst, 0666, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer ddb.Close()
+
+	// Top-level buckets are listed first, so that each can be copied in a
+	// transaction of its own.
+	r := &SalvageResult{}
+	var names [][]byte
+	if err := readSafely(src, func() error {
+		return sdb.View(func(tx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+				names = append(names, clone(name))
+				return nil
+			})
+		})
+	}); err != nil {
+		r.Lost = append(r.Lost, fmt.Sprintf("buckets after %q: %v", last(names), lostErr(err)))
+	}
+
+	for _, name := range names {
+		if err := ddb.Update(func(dtx *bolt.Tx) error {
+			b, err := dtx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			if err := readSafely(src, func() error {
+				return sdb.View(func(stx *bolt.Tx) error {
+					return copyBucket(stx.Bucket(name), b, string(name), r)
+				})
+			}); err != nil {
+				if _, ok := err.(*CorruptShardError); !ok {
+					return err
+				}
+				r.Lost = append(r.Lost, fmt.Sprintf("%s: %v", name, lostErr(err)))
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// copyBucket copies the keys and nested buckets of src to dst, recording
+// nested buckets which can't be read in full in r. Keys are cloned, as they
+// are only valid for the transaction reading them.
+func copyBucket(src, dst *bolt.Bucket, path string, r *SalvageResult) error {
+	r.Buckets++
+	c := src.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil {
+			if err := dst.Put(clone(k), clone(v)); err != nil {
+				return err
+			}
+			r.Keys++
+			continue
+		}
+
+		nested, err := dst.CreateBucketIfNotExists(clone(k))
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%s/%s", path, k)
+		if err := readSafely("", func() error {
+			return copyBucket(src.Bucket(k), nested, name, r)
+		}); err != nil {
+			if _, ok := err.(*CorruptShardError); !ok {
+				return err
+			}
+			r.Lost = append(r.Lost, fmt.Sprintf("%s: %v", name, lostErr(err)))
+		}
+	}
+	return nil
+}
+
+// lostErr returns the cause of a corrupt read, without the path of the shard.
+func lostErr(err error) error {
+	if e, ok := err.(*CorruptShardError); ok {
+		return e.Err
+	}
+	return err
+}
+
+func clone(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+// last returns the last of the names, or an empty string.
+func last(names [][]byte) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return string(names[len(names)-1])
+}
@@ -0,0 +1,143 @@
+package tsdb_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+)
+
+// Ensure a corrupt shard is skipped, rather than failing the database, and
+// its readable buckets can be salvaged.
+func TestSalvage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx_tsm-salvage-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db0", "default", "1")
+	MustCreateB1Shard(path, []string{"cpu", "mem"}, 500)
+	MustCorruptBucket(path, "mem")
+
+	db := tsdb.NewDatabase(filepath.Join(dir, "db0"))
+	shards, err := db.Shards()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(shards) != 0 || len(db.Skipped) != 1 {
+		t.Fatalf("unexpected shards: %v, skipped: %v", shards, db.Skipped)
+	} else if _, ok := db.Skipped[0].Err.(*tsdb.CorruptShardError); !ok {
+		t.Fatalf("unexpected error: %v", db.Skipped[0].Err)
+	}
+
+	dst := filepath.Join(dir, "salvaged")
+	r, err := tsdb.Salvage(path, dst)
+	if err != nil {
+		t.Fatal(err)
+	} else if r.Keys != 500 {
+		t.Fatalf("unexpected keys salvaged: %d", r.Keys)
+	} else if len(r.Lost) != 1 || !strings.HasPrefix(r.Lost[0], "mem: ") {
+		t.Fatalf("unexpected buckets lost: %v", r.Lost)
+	}
+
+	// The salvaged shard can be read, with the series which survived.
+	if err := os.Rename(dst, path); err != nil {
+		t.Fatal(err)
+	}
+	si, err := db.Shard("default", "1")
+	if err != nil {
+		t.Fatal(err)
+	} else if si.Format != tsdb.B1 || si.SeriesN != 2 || si.MaxTime.UnixNano() != 499 {
+		t.Fatalf("unexpected shard: %+v", si)
+	}
+}
+
+// Ensure an empty shard file is reported as corrupt.
+func TestDatabase_Shards_Empty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx_tsm-database-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "db0", "default"), 0777); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(dir, "db0", "default", "1"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	db := tsdb.NewDatabase(filepath.Join(dir, "db0"))
+	if _, err := db.Shards(); err != nil {
+		t.Fatal(err)
+	} else if len(db.Skipped) != 1 || !strings.Contains(db.Skipped[0].Error(), "is corrupt: empty file") {
+		t.Fatalf("unexpected skipped shards: %v", db.Skipped)
+	}
+}
+
+// MustCreateB1Shard creates a b1 shard at path, with n points in each series.
+func MustCreateB1Shard(path string, series []string, n int) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		panic(err)
+	}
+
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range series {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < n; i++ {
+				if err := b.Put(u64tob(uint64(i)), u64tob(uint64(i))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// MustCorruptBucket overwrites the root page of the bucket in the bolt file
+// at path with a branch to a page beyond the end of the file.
+func MustCorruptBucket(path, name string) {
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		panic(err)
+	}
+	var root int64
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = int64(tx.Bucket([]byte(name)).Root())
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	pageSize := db.Info().PageSize
+	db.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	// Page header: id, flags, count and overflow, then a branch element:
+	// position, key size and child page.
+	buf := make([]byte, pageSize)
+	binary.LittleEndian.PutUint16(buf[8:], 0x01)
+	binary.LittleEndian.PutUint16(buf[10:], 1)
+	binary.LittleEndian.PutUint64(buf[24:], 1<<50)
+	if _, err := f.WriteAt(buf, root*int64(pageSize)); err != nil {
+		panic(err)
+	}
+}
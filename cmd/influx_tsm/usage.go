@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Usage is the resources used by a run, so that conversions on similar
+// hardware can be sized from it.
+type Usage struct {
+	// CPU is the user and system CPU time of the process, and MaxRSS its
+	// peak resident set size in bytes. Both are zero where unsupported.
+	CPU    time.Duration `json:"cpu"`
+	MaxRSS int64         `json:"maxRSS"`
+
+	Devices []*DeviceUsage `json:"devices"`
+	Phases  []*PhaseUsage  `json:"phases"`
+}
+
+// DeviceUsage is the number of bytes read and written on a filesystem, as
+// the sizes of the files read and written.
+type DeviceUsage struct {
+	Device  string `json:"device"`
+	Path    string `json:"path"`
+	Read    int64  `json:"read"`
+	Written int64  `json:"written"`
+}
+
+// PhaseUsage is the number of bytes processed by a phase of the run, such
+// as the backups, and how long it took.
+type PhaseUsage struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	Bytes    int64         `json:"bytes"`
+}
+
+// Throughput returns the average bytes processed per second by the phase.
+func (p *PhaseUsage) Throughput() float64 {
+	if p.Duration <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Duration.Seconds()
+}
+
+// Write writes the resources used as tables of the bytes read and written
+// on each device, and the throughput of each phase.
+func (u *Usage) Write(w io.Writer) error {
+	fmt.Fprintf(w, "CPU time:    %v\n", roundDuration(u.CPU))
+	fmt.Fprintf(w, "Peak memory: %d bytes\n\n", u.MaxRSS)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(tw, "Device\tPath\tRead\tWritten")
+	for _, d := range u.Devices {
+		fmt.Fprintf(tw, "%v\t%v\t%d\t%d\n", d.Device, d.Path, d.Read, d.Written)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "Phase\tDuration\tBytes\tThroughput")
+	for _, p := range u.Phases {
+		throughput := "-"
+		if p.Bytes > 0 {
+			throughput = fmt.Sprintf("%.0f bytes/s", p.Throughput())
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%d\t%v\n", p.Name, roundDuration(p.Duration), p.Bytes, throughput)
+	}
+	return tw.Flush()
+}
+
+// usageMeter totals the bytes read and written on each filesystem by a run,
+// and the bytes processed by each phase. It is safe for concurrent use.
+type usageMeter struct {
+	mu      sync.Mutex
+	devices []*DeviceUsage
+	phases  []*PhaseUsage
+}
+
+// device returns the usage of the filesystem holding path. Paths whose
+// filesystem can't be identified, such as S3 locations, are their own
+// device.
+func (m *usageMeter) device(path string) *DeviceUsage {
+	id, err := volumeID(path)
+	if err != nil {
+		id = path
+	}
+	for _, d := range m.devices {
+		if d.Device == id {
+			return d
+		}
+	}
+	d := &DeviceUsage{Device: id, Path: path}
+	m.devices = append(m.devices, d)
+	return d
+}
+
+// Read records n bytes read from the filesystem holding path.
+func (m *usageMeter) Read(path string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.device(path).Read += n
+}
+
+// Wrote records n bytes written to the filesystem holding path.
+func (m *usageMeter) Wrote(path string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.device(path).Written += n
+}
+
+// Phase records the phase of the given name, started at start, as having
+// processed n bytes.
+func (m *usageMeter) Phase(name string, start time.Time, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.phases = append(m.phases, &PhaseUsage{Name: name, Duration: time.Now().Sub(start), Bytes: n})
+}
+
+// Usage returns the resources used by the run so far.
+func (m *usageMeter) Usage() *Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := &Usage{Devices: m.devices, Phases: m.phases}
+	if cpu, rss, err := processUsage(); err == nil {
+		u.CPU, u.MaxRSS = cpu, rss
+	}
+	return u
+}
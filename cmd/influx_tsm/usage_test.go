@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Ensure bytes are totalled by filesystem, and phases recorded in order.
+func TestUsageMeter(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+	MustWriteFile(filepath.Join(dir, "data", "f"), "")
+	MustWriteFile(filepath.Join(dir, "backups", "f"), "")
+
+	m := &usageMeter{}
+	m.Read(filepath.Join(dir, "data"), 100)
+	m.Wrote(filepath.Join(dir, "backups"), 40)
+	m.Wrote(filepath.Join(dir, "data"), 10)
+	m.Wrote("s3://bucket/prefix", 30)
+	m.Phase("backup", time.Now().Add(-time.Second), 100)
+
+	u := m.Usage()
+	if len(u.Devices) != 2 {
+		t.Fatalf("unexpected devices: %+v", u.Devices)
+	} else if d := u.Devices[0]; d.Path != filepath.Join(dir, "data") || d.Read != 100 || d.Written != 50 {
+		t.Fatalf("unexpected device: %+v", d)
+	} else if d := u.Devices[1]; d.Device != "s3://bucket/prefix" || d.Written != 30 {
+		t.Fatalf("unexpected device: %+v", d)
+	}
+	if len(u.Phases) != 1 || u.Phases[0].Name != "backup" || u.Phases[0].Bytes != 100 || u.Phases[0].Duration < time.Second {
+		t.Fatalf("unexpected phases: %+v", u.Phases)
+	}
+}
+
+// Ensure the resources used are written with the throughput of each phase.
+func TestUsage_Write(t *testing.T) {
+	u := &Usage{
+		CPU:     1500 * time.Millisecond,
+		MaxRSS:  1024,
+		Devices: []*DeviceUsage{{Device: "2049", Path: "/data", Read: 3000, Written: 1000}},
+		Phases: []*PhaseUsage{
+			{Name: "convert", Duration: 2 * time.Second, Bytes: 3000},
+			{Name: "swap", Duration: time.Second},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := u.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := strings.Join(strings.Fields(buf.String()), " ")
+	for _, s := range []string{
+		"CPU time: 1.5s",
+		"Peak memory: 1024 bytes",
+		"2049 /data 3000 1000",
+		"convert 2s 3000 1500 bytes/s",
+		"swap 1s 0 -",
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing %q:\n%s", s, buf.String())
+		}
+	}
+}
+
+// Ensure the resources used by a run are in its summary, and its history.
+func TestConvert_Usage(t *testing.T) {
+	dataPath := MustTempDir()
+	defer os.RemoveAll(dataPath)
+	MustCreateBZ1Shard(filepath.Join(dataPath, "db0", "default", "1"), "cpu value=1 1000000000")
+
+	output, code := RunConvert("", "-y", dataPath)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, output)
+	} else if !strings.Contains(output, "Resources:") || !strings.Contains(output, "CPU time:") {
+		t.Fatalf("resources not reported: %s", output)
+	}
+
+	runs, err := NewHistory(filepath.Join(dataPath, historyFile)).Runs()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(runs) != 1 || runs[0].Shards != 1 {
+		t.Fatalf("unexpected runs: %+v", runs)
+	}
+	var phases []string
+	for _, p := range runs[0].Usage.Phases {
+		phases = append(phases, p.Name)
+	}
+	if strings.Join(phases, ",") != "backup,convert" {
+		t.Fatalf("unexpected phases: %v", phases)
+	} else if p := runs[0].Usage.Phases[1]; p.Bytes == 0 {
+		t.Fatalf("unexpected convert phase: %+v", p)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// Verifier checks a converted shard against the shard it was converted
+// from. Sites can add their own checks, such as that daily sums of billing
+// counters match, by registering a Verifier from an init function in a file
+// added to this package.
+type Verifier interface {
+	// Verify returns an error if the converted shard dst does not match the
+	// shard src it was converted from. src is open, and read from its start.
+	Verify(si *tsdb.ShardInfo, src ShardReader, dst *TSMShard) error
+}
+
+// verifiers is a lookup of verifiers by name.
+var verifiers = make(map[string]Verifier)
+
+// RegisterVerifier registers a verifier by name, to be run with -verify.
+func RegisterVerifier(name string, v Verifier) {
+	if _, ok := verifiers[name]; ok {
+		panic("verifier already registered: " + name)
+	}
+	verifiers[name] = v
+}
+
+// RegisteredVerifiers returns the sorted names of the registered verifiers.
+func RegisteredVerifiers() []string {
+	a := make([]string, 0, len(verifiers))
+	for k := range verifiers {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// verifyShard runs the named verifiers against the shard converted to the
+// directory dir, returning the first failure.
+func verifyShard(si *tsdb.ShardInfo, dir string, names []string) error {
+	for _, name := range names {
+		v, ok := verifiers[name]
+		if !ok {
+			return fmt.Errorf("unknown verifier %q", name)
+		}
+		logger.Debugf("Verifying %v against %v with %v\n", dir, si.FullPath(opts.DataPath), name)
+		if err := runVerifier(v, si, dir); err != nil {
+			return fmt.Errorf("verifier %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// runVerifier runs v with a fresh reader of each shard.
+func runVerifier(v Verifier, si *tsdb.ShardInfo, dir string) error {
+	src, err := newShardReader(si)
+	if err != nil {
+		return err
+	}
+	if err := src.Open(); err != nil {
+		return fmt.Errorf("open %v shard: %v", si.FormatAsString(), err)
+	}
+	defer src.Close()
+
+	dst, err := OpenTSMShard(dir)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return v.Verify(si, src, dst)
+}
+
+// TSMShard reads the TSM files of a converted shard.
+type TSMShard struct {
+	readers []*tsm1.TSMReader
+}
+
+// OpenTSMShard opens the TSM files in the directory dir.
+func OpenTSMShard(dir string) (*TSMShard, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*."+tsm1.TSMFileExtension))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	s := &TSMShard{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		r, err := tsm1.NewTSMReader(f)
+		if err != nil {
+			f.Close()
+			s.Close()
+			return nil, fmt.Errorf("open %v: %v", path, err)
+		}
+		s.readers = append(s.readers, r)
+	}
+	return s, nil
+}
+
+// Keys returns the sorted keys of every TSM file.
+func (s *TSMShard) Keys() []string {
+	set := make(map[string]bool)
+	for _, r := range s.readers {
+		for _, k := range r.Keys() {
+			set[k] = true
+		}
+	}
+	return sortedKeys(set)
+}
+
+// ReadAll returns every value of the key, in the order they were written.
+func (s *TSMShard) ReadAll(key string) ([]tsm1.Value, error) {
+	var a []tsm1.Value
+	for _, r := range s.readers {
+		values, err := r.ReadAll(key)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, values...)
+	}
+	return a, nil
+}
+
+// FieldTypes returns the type of each field, by measurement, from the type
+// of the blocks of its keys, as tsm1 loads its field index.
+func (s *TSMShard) FieldTypes() (map[string]map[string]influxql.DataType, error) {
+	types := make(map[string]map[string]influxql.DataType)
+	for _, r := range s.readers {
+		for _, k := range r.Keys() {
+			typ, err := r.Type(k)
+			if err != nil {
+				return nil, err
+			}
+			dt, err := blockDataType(typ)
+			if err != nil {
+				return nil, fmt.Errorf("key %v: %v", k, err)
+			}
+
+			measurement, field := splitKey(k)
+			if types[measurement] == nil {
+				types[measurement] = make(map[string]influxql.DataType)
+			}
+			if _, ok := types[measurement][field]; !ok {
+				types[measurement][field] = dt
+			}
+		}
+	}
+	return types, nil
+}
+
+// MinTime returns the time of the earliest value of every TSM file, or the
+// zero time if there are none.
+func (s *TSMShard) MinTime() time.Time {
+	var min time.Time
+	for _, r := range s.readers {
+		if len(r.Keys()) == 0 {
+			continue
+		}
+		if t, _ := r.TimeRange(); min.IsZero() || t.Before(min) {
+			min = t
+		}
+	}
+	return min
+}
+
+// blockDataType returns the field type of values in a block of type typ.
+func blockDataType(typ byte) (influxql.DataType, error) {
+	switch typ {
+	case tsm1.BlockFloat64:
+		return influxql.Float, nil
+	case tsm1.BlockInt64:
+		return influxql.Integer, nil
+	case tsm1.BlockBool:
+		return influxql.Boolean, nil
+	case tsm1.BlockString:
+		return influxql.String, nil
+	default:
+		return influxql.Unknown, fmt.Errorf("unknown block type: %v", typ)
+	}
+}
+
+// Close closes every TSM file.
+func (s *TSMShard) Close() error {
+	var err error
+	for _, r := range s.readers {
+		if e := r.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func init() {
+	RegisterVerifier("counts", countVerifier{})
+}
+
+// countVerifier checks that every key of the source has as many values in
+// the converted shard, and that the converted shard has no other keys. The
+// source is read with the resolution of its type conflicts, so the values of
+// fields skipped by -type-conflict aren't expected.
+type countVerifier struct{}
+
+func (countVerifier) Verify(si *tsdb.ShardInfo, src ShardReader, dst *TSMShard) error {
+	counts := make(map[string]int)
+	itr := typeConflicts[si].Iterator(src)
+	for itr.Next() {
+		k, v, err := itr.Read()
+		if err != nil {
+			return err
+		}
+		counts[k] += len(v)
+	}
+
+	for _, k := range dst.Keys() {
+		if _, ok := counts[k]; !ok {
+			return fmt.Errorf("key %v is not in the source shard", k)
+		}
+	}
+	for k, n := range counts {
+		values, err := dst.ReadAll(k)
+		if err != nil {
+			return err
+		} else if len(values) != n {
+			return fmt.Errorf("key %v has %d values, expected %d", k, len(values), n)
+		}
+	}
+	return nil
+}
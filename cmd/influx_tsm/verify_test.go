@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/cmd/influx_tsm/tsdb"
+	"github.com/influxdb/influxdb/influxql"
+	"github.com/influxdb/influxdb/tsdb/engine/tsm1"
+)
+
+// Ensure the counts verifier compares the values of each key with the source.
+func TestCountVerifier_Verify(t *testing.T) {
+	dir := MustTempDir()
+	defer os.RemoveAll(dir)
+
+	v := tsm1.NewValue(time.Unix(1, 0), 1.0)
+	keys := []string{"cpu#!~#value", "mem#!~#free"}
+	values := [][]tsm1.Value{{v, tsm1.NewValue(time.Unix(2, 0), 2.0)}, {v}}
+
+	c := NewConverter("1", maxTSMSz, NewDirSink(dir))
+	if err := c.Process(&sliceIterator{keys: keys, values: values}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := OpenTSMShard(filepath.Join(dir, "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	si := &tsdb.ShardInfo{}
+	if err := (countVerifier{}).Verify(si, &sliceReader{sliceIterator{keys: keys, values: values}}, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	values[0] = append(values[0], tsm1.NewValue(time.Unix(3, 0), 3.0))
+	if err := (countVerifier{}).Verify(si, &sliceReader{sliceIterator{keys: keys, values: values}}, dst); err == nil || !strings.Contains(err.Error(), "has 2 values, expected 3") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// sliceReader is a ShardReader over in-memory keys and values.
+type sliceReader struct {
+	sliceIterator
+}
+
+func (r *sliceReader) Open() error            { return nil }
+func (r *sliceReader) Close() error           { return nil }
+func (r *sliceReader) Measurements() []string { return nil }
+func (r *sliceReader) KeyN() int              { return len(r.keys) }
+
+func (r *sliceReader) MeasurementIterator(name string) (MeasurementIterator, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (r *sliceReader) FieldTypes() (map[string]map[string]influxql.DataType, error) {
+	return nil, nil
+}
@@ -285,6 +285,11 @@ func (s *Store) loadIndexes() error {
 			s.Logger.Printf("Skipping database dir: %s. Not a directory", db.Name())
 			continue
 		}
+		// Hidden directories, such as the trash kept by influx_tsm, are not databases.
+		if strings.HasPrefix(db.Name(), ".") {
+			s.Logger.Printf("Skipping database dir: %s. Hidden directory", db.Name())
+			continue
+		}
 		s.databaseIndexes[db.Name()] = NewDatabaseIndex()
 	}
 	return nil
@@ -147,6 +147,33 @@ func TestStoreOpenNotDatabaseDir(t *testing.T) {
 	}
 }
 
+func TestStoreOpenHiddenDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store_test")
+	if err != nil {
+		t.Fatalf("Store.Open() failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".trash", "20160112T112713.123456789Z", "mydb", "myrp")
+	if err := os.MkdirAll(path, 0700); err != nil {
+		t.Fatalf("Store.Open() failed to create hidden dir: %v", err)
+	}
+
+	s := tsdb.NewStore(dir)
+	s.EngineOptions.Config.WALDir = filepath.Join(dir, "wal")
+	if err := s.Open(); err != nil {
+		t.Fatalf("Store.Open() failed: %v", err)
+	}
+
+	if got, exp := s.DatabaseIndexN(), 0; got != exp {
+		t.Fatalf("Store.Open() database index count mismatch: got %v, exp %v", got, exp)
+	}
+
+	if got, exp := s.ShardN(), 0; got != exp {
+		t.Fatalf("Store.Open() shard count mismatch: got %v, exp %v", got, exp)
+	}
+}
+
 func TestStoreOpenNotRPDir(t *testing.T) {
 	dir, err := ioutil.TempDir("", "store_test")
 	if err != nil {